@@ -0,0 +1,700 @@
+package gokogeri
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// A SortedSet is one of the sorted sets used by Sidekiq to hold jobs that are not in a queue. The score of every job
+// in the set is a time value.
+type SortedSet string
+
+const (
+	// ScheduleSet holds jobs that will be enqueued at a later time. The score is the time when they are due.
+	ScheduleSet SortedSet = "schedule"
+
+	// RetrySet holds jobs that have failed and will be retried. The score is the time of the next attempt.
+	RetrySet SortedSet = "retry"
+
+	// DeadSet holds jobs that have failed and will not be retried any more. The score is the time when they died.
+	DeadSet SortedSet = "dead"
+)
+
+// A JobRecord is a job as it is stored in Redis, in a queue or in a sorted set.
+type JobRecord struct {
+	// Job is the decoded job. It is nil if the payload could not be decoded.
+	Job *Job
+
+	// Payload is the JSON representation of the job, exactly as it is stored in Redis.
+	Payload []byte
+
+	// At is the score of the job in a sorted set. It is zero for jobs in a queue.
+	At time.Time
+}
+
+// A JobFilter selects job records for an operation.
+type JobFilter func(*JobRecord) bool
+
+// MatchJobIDs returns a filter that selects the jobs with the given IDs.
+func MatchJobIDs(ids ...string) JobFilter {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return func(r *JobRecord) bool {
+		return r.Job != nil && set[r.Job.ID()]
+	}
+}
+
+// MatchAll returns a filter that selects every job record.
+func MatchAll() JobFilter {
+	return func(*JobRecord) bool {
+		return true
+	}
+}
+
+// Stats holds an overview of the data stored in Redis.
+type Stats struct {
+	// Processed is the number of jobs that have been processed, including the failed ones.
+	Processed int64
+
+	// Failed is the number of jobs that have failed.
+	Failed int64
+
+	// Enqueued is the number of jobs waiting in all the queues.
+	Enqueued int64
+
+	// Queues holds the number of jobs waiting in each queue.
+	Queues map[string]int64
+
+	Scheduled int64
+	Retries   int64
+	Dead      int64
+
+	// Processes is the number of processes that have reported their presence recently.
+	Processes int64
+}
+
+// A Process describes a running process, as reported by its heartbeat.
+type Process struct {
+	Identity    string
+	Hostname    string
+	PID         int
+	StartedAt   time.Time
+	Concurrency int
+	Queues      []string
+
+	// Busy is the number of jobs being processed.
+	Busy int
+
+	// Beat is the time of the last heartbeat.
+	Beat time.Time
+
+	// Quiet reports whether the process has stopped taking new jobs from queues.
+	Quiet bool
+}
+
+// processInfo is the static process information, as it is encoded in Redis.
+type processInfo struct {
+	Hostname    string   `json:"hostname"`
+	StartedAt   float64  `json:"started_at"`
+	PID         int      `json:"pid"`
+	Tag         string   `json:"tag"`
+	Concurrency int      `json:"concurrency"`
+	Queues      []string `json:"queues"`
+	Labels      []string `json:"labels"`
+	Identity    string   `json:"identity"`
+}
+
+// Admin provides operations for inspecting and managing what is stored in Redis: queues, sorted sets, statistics and
+// processes. It is meant for administrative tools and is safe for concurrent use.
+type Admin struct {
+	cp   ConnProvider
+	keys keyspace
+}
+
+// NewAdmin returns a new instance.
+func NewAdmin(cp ConnProvider) *Admin {
+	return &Admin{
+		cp:   cp,
+		keys: newKeyspaceFor(cp),
+	}
+}
+
+// Stats returns an overview of the data stored in Redis.
+func (a *Admin) Stats(ctx context.Context) (*Stats, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	queues, err := redis.Strings(conn.Do("SMEMBERS", a.keys.queues()))
+	if err != nil {
+		return nil, fmt.Errorf("get queue names: %v", err)
+	}
+
+	commands := [][]interface{}{
+		{"GET", a.keys.stat("processed")},
+		{"GET", a.keys.stat("failed")},
+		{"ZCARD", a.keys.sortedSet(ScheduleSet)},
+		{"ZCARD", a.keys.sortedSet(RetrySet)},
+		{"ZCARD", a.keys.sortedSet(DeadSet)},
+		{"SCARD", a.keys.processes()},
+	}
+	for _, q := range queues {
+		commands = append(
+			commands,
+			[]interface{}{"LLEN", a.keys.queue(q)},
+			[]interface{}{"ZCARD", a.keys.priorityQueue(q)},
+		)
+	}
+
+	for _, c := range commands {
+		err = conn.Send(c[0].(string), c[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("send: %v", err)
+		}
+	}
+
+	replies, err := redisutil.DoMany(conn, len(commands))
+	if err != nil {
+		return nil, fmt.Errorf("get stats: %v", err)
+	}
+
+	counts := make([]int64, len(replies))
+	for i, r := range replies {
+		counts[i], err = redisutil.Int64(r)
+		if err != nil {
+			return nil, fmt.Errorf("reply %d: %v", i, err)
+		}
+	}
+
+	s := &Stats{
+		Processed: counts[0],
+		Failed:    counts[1],
+		Scheduled: counts[2],
+		Retries:   counts[3],
+		Dead:      counts[4],
+		Processes: counts[5],
+		Queues:    make(map[string]int64, len(queues)),
+	}
+	for i, q := range queues {
+		n := counts[6+i*2] + counts[7+i*2]
+		s.Queues[q] = n
+		s.Enqueued += n
+	}
+
+	return s, nil
+}
+
+// QueueNames returns the names of all the known queues, sorted alphabetically.
+func (a *Admin) QueueNames(ctx context.Context) ([]string, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	queues, err := redis.Strings(conn.Do("SMEMBERS", a.keys.queues()))
+	if err != nil {
+		return nil, fmt.Errorf("get queue names: %v", err)
+	}
+	sort.Strings(queues)
+	return queues, nil
+}
+
+// QueueSize returns the number of jobs waiting in the queue, including those with a priority.
+func (a *Admin) QueueSize(ctx context.Context, queue string) (int64, error) {
+	return queueSizes(ctx, a.cp, a.keys, []string{queue})
+}
+
+// PeekQueue returns up to count jobs from the queue, skipping the first start jobs, without removing them. The jobs are
+// returned in the order in which they will be processed, starting with the jobs that have a priority.
+func (a *Admin) PeekQueue(ctx context.Context, queue string, start, count int) ([]*JobRecord, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	return a.readQueue(conn, queue, start, count)
+}
+
+// ClearQueue deletes the queue and all the jobs in it.
+func (a *Admin) ClearQueue(ctx context.Context, queue string) error {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.Send(
+		"DEL",
+		a.keys.queue(queue), a.keys.priorityQueue(queue), a.keys.prioritySeq(queue), a.keys.priorityWake(queue),
+	)
+	if err != nil {
+		return fmt.Errorf("send: %v", err)
+	}
+
+	err = conn.Send("SREM", a.keys.queues(), queue)
+	if err != nil {
+		return fmt.Errorf("send: %v", err)
+	}
+
+	_, err = redisutil.DoMany(conn, 2)
+	if err != nil {
+		return fmt.Errorf("clear queue: %v", err)
+	}
+	return nil
+}
+
+// PauseQueue stops all the nodes from taking jobs from the queue, until it is resumed. The nodes notice within
+// their pause poll interval, and a node already waiting on the queue may still take a job until its long poll timeout.
+// A node that reads the queue from several Redis instances, with Node.ProcessShardedQueues, stops taking jobs from it
+// on all of them when it is paused on any of them.
+func (a *Admin) PauseQueue(ctx context.Context, queue string) error {
+	return a.setPaused(ctx, queue, "SADD")
+}
+
+// ResumeQueue lets the nodes take jobs from a queue paused with PauseQueue again.
+func (a *Admin) ResumeQueue(ctx context.Context, queue string) error {
+	return a.setPaused(ctx, queue, "SREM")
+}
+
+// PausedQueues returns the names of the queues paused with PauseQueue, sorted alphabetically.
+func (a *Admin) PausedQueues(ctx context.Context) ([]string, error) {
+	return readPausedQueues(ctx, a.cp, a.keys)
+}
+
+func (a *Admin) setPaused(ctx context.Context, queue, command string) error {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Do(command, a.keys.paused(), queue)
+	if err != nil {
+		return fmt.Errorf("set paused: %v", err)
+	}
+	return nil
+}
+
+// SetSize returns the number of jobs in the sorted set.
+func (a *Admin) SetSize(ctx context.Context, set SortedSet) (int64, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	n, err := redis.Int64(conn.Do("ZCARD", a.keys.sortedSet(set)))
+	if err != nil {
+		return 0, fmt.Errorf("get set size: %v", err)
+	}
+	return n, nil
+}
+
+// PeekSet returns up to count jobs from the sorted set, ordered by score, skipping the first start jobs.
+func (a *Admin) PeekSet(ctx context.Context, set SortedSet, start, count int) ([]*JobRecord, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	return a.readSet(conn, set, start, count)
+}
+
+// FindInSet returns all the jobs in the sorted set selected by the filter, ordered by score.
+func (a *Admin) FindInSet(ctx context.Context, set SortedSet, filter JobFilter) ([]*JobRecord, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	return a.findInSet(conn, set, filter)
+}
+
+var requeueScript = redis.NewScript(3, `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+	redis.call('SADD', KEYS[2], ARGV[3])
+	redis.call('LPUSH', KEYS[3], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// RetryInSet moves the jobs selected by the filter from the sorted set back to their queues, so they will be processed
+// as soon as possible. It returns the number of jobs that were moved.
+//
+// Jobs that have been removed from the set by another process in the meantime are skipped.
+func (a *Admin) RetryInSet(ctx context.Context, set SortedSet, filter JobFilter) (int, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	records, err := a.findInSet(conn, set, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, r := range records {
+		if r.Job == nil {
+			continue
+		}
+
+		payload, err := requeuePayload(r.Payload)
+		if err != nil {
+			return moved, fmt.Errorf("job %s: %v", r.Job.ID(), err)
+		}
+
+		queue := r.Job.Queue()
+		if queue == "" {
+			queue = "default"
+		}
+
+		if _, ok := r.Job.Priority(); ok {
+			n, err := a.requeuePriority(conn, set, r.Job.SetQueue(queue), r.Payload, payload)
+			if err != nil {
+				return moved, fmt.Errorf("requeue job %s: %v", r.Job.ID(), err)
+			}
+			moved += n
+			continue
+		}
+
+		n, err := a.requeue(conn, set, queue, r.Payload, payload)
+		if err != nil {
+			return moved, fmt.Errorf("requeue job %s: %v", r.Job.ID(), err)
+		}
+		moved += n
+	}
+
+	return moved, nil
+}
+
+// requeue moves a job from the sorted set to the queue, unless it is no longer in the set. It returns 1 if the job was
+// moved.
+//
+// With Redis Cluster, the keys are usually in different slots, so they cannot be used in the same script. Removing the
+// job from the set first still guarantees that only one process can move it, but a failure in between loses the job.
+func (a *Admin) requeue(conn redis.Conn, set SortedSet, queue string, old, new []byte) (int, error) {
+	if !a.keys.cluster {
+		return redis.Int(requeueScript.Do(
+			conn,
+			a.keys.sortedSet(set),
+			a.keys.queues(),
+			a.keys.queue(queue),
+			old,
+			new,
+			queue,
+		))
+	}
+
+	n, err := redis.Int(conn.Do("ZREM", a.keys.sortedSet(set), old))
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	err = conn.Send("SADD", a.keys.queues(), queue)
+	if err != nil {
+		return 0, err
+	}
+	err = conn.Send("LPUSH", a.keys.queue(queue), new)
+	if err != nil {
+		return 0, err
+	}
+	_, err = redisutil.DoMany(conn, 2)
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// requeuePriority is like requeue, for a job with a priority. The sorted set and the priority set are in different
+// slots, so a failure in between loses the job, like with Redis Cluster.
+func (a *Admin) requeuePriority(conn redis.Conn, set SortedSet, j *Job, old, new []byte) (int, error) {
+	n, err := redis.Int(conn.Do("ZREM", a.keys.sortedSet(set), old))
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	err = pushPayload(conn, a.keys, j, new)
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// DeleteInSet deletes the jobs selected by the filter from the sorted set. It returns the number of jobs that were
+// deleted.
+func (a *Admin) DeleteInSet(ctx context.Context, set SortedSet, filter JobFilter) (int, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	records, err := a.findInSet(conn, set, filter)
+	if err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	args := make([]interface{}, 0, len(records)+1)
+	args = append(args, a.keys.sortedSet(set))
+	for _, r := range records {
+		args = append(args, r.Payload)
+	}
+
+	n, err := redis.Int(conn.Do("ZREM", args...))
+	if err != nil {
+		return 0, fmt.Errorf("delete jobs: %v", err)
+	}
+	return n, nil
+}
+
+// Processes returns the processes that have reported their presence recently, sorted by identity.
+func (a *Admin) Processes(ctx context.Context) ([]*Process, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	identities, err := redis.Strings(conn.Do("SMEMBERS", a.keys.processes()))
+	if err != nil {
+		return nil, fmt.Errorf("get processes: %v", err)
+	}
+	sort.Strings(identities)
+	if len(identities) == 0 {
+		return nil, nil
+	}
+
+	for _, id := range identities {
+		err = conn.Send("HMGET", a.keys.process(id), "info", "busy", "beat", "quiet")
+		if err != nil {
+			return nil, fmt.Errorf("send: %v", err)
+		}
+	}
+
+	replies, err := redisutil.DoMany(conn, len(identities))
+	if err != nil {
+		return nil, fmt.Errorf("get process details: %v", err)
+	}
+
+	procs := make([]*Process, 0, len(identities))
+	for i, r := range replies {
+		fields, err := redis.Strings(r, nil)
+		if err != nil {
+			return nil, fmt.Errorf("process %s: %v", identities[i], err)
+		}
+		if fields[0] == "" {
+			// The heartbeat has expired, which means the process is gone.
+			continue
+		}
+
+		var info processInfo
+		err = json.Unmarshal([]byte(fields[0]), &info)
+		if err != nil {
+			return nil, fmt.Errorf("process %s: decoding info: %v", identities[i], err)
+		}
+
+		busy, _ := strconv.Atoi(fields[1])
+		beat, _ := strconv.ParseFloat(fields[2], 64)
+
+		procs = append(procs, &Process{
+			Identity:    identities[i],
+			Hostname:    info.Hostname,
+			PID:         info.PID,
+			StartedAt:   sidekiq.ToTime(info.StartedAt),
+			Concurrency: info.Concurrency,
+			Queues:      info.Queues,
+			Busy:        busy,
+			Beat:        sidekiq.ToTime(beat),
+			Quiet:       fields[3] == "true",
+		})
+	}
+
+	return procs, nil
+}
+
+// QuietProcess asks the process to stop taking new jobs from queues. The jobs in progress are allowed to finish.
+func (a *Admin) QuietProcess(ctx context.Context, identity string) error {
+	return a.signal(ctx, identity, signalQuiet)
+}
+
+// StopProcess asks the process to shut down, as if Node.Stop had been called with the process's shutdown timeout.
+func (a *Admin) StopProcess(ctx context.Context, identity string) error {
+	return a.signal(ctx, identity, signalStop)
+}
+
+func (a *Admin) signal(ctx context.Context, identity, sig string) error {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	key := a.keys.signals(identity)
+
+	err = conn.Send("LPUSH", key, sig)
+	if err != nil {
+		return fmt.Errorf("send: %v", err)
+	}
+
+	err = conn.Send("EXPIRE", key, 60)
+	if err != nil {
+		return fmt.Errorf("send: %v", err)
+	}
+
+	_, err = redisutil.DoMany(conn, 2)
+	if err != nil {
+		return fmt.Errorf("signal process: %v", err)
+	}
+	return nil
+}
+
+func newJobRecord(payload []byte, score float64) *JobRecord {
+	r := &JobRecord{Payload: payload}
+	r.Job, _ = newJobFromJSON(payload)
+	if score != 0 {
+		r.At = sidekiq.ToTime(score)
+	}
+	return r
+}
+
+// pageSize is the number of jobs read at once when scanning a queue or a sorted set.
+const pageSize = 100
+
+// readQueue returns jobs from the queue in the order in which they will be processed: the jobs of its priority set,
+// and then the jobs of its list.
+func (a *Admin) readQueue(conn redis.Conn, queue string, start, count int) ([]*JobRecord, error) {
+	n, err := redis.Int(conn.Do("ZCARD", a.keys.priorityQueue(queue)))
+	if err != nil {
+		return nil, fmt.Errorf("read priority set size: %v", err)
+	}
+	if start >= n {
+		return a.readList(conn, queue, start-n, count)
+	}
+
+	records, err := a.readPriority(conn, queue, start, count)
+	if err != nil || len(records) == count {
+		return records, err
+	}
+	more, err := a.readList(conn, queue, 0, count-len(records))
+	if err != nil {
+		return nil, err
+	}
+	return append(records, more...), nil
+}
+
+// readList returns jobs from the list of the queue in the order in which they will be processed.
+func (a *Admin) readList(conn redis.Conn, queue string, start, count int) ([]*JobRecord, error) {
+	// Jobs are pushed on the left and popped from the right, so the next job is the last element of the list.
+	payloads, err := redis.ByteSlices(conn.Do("LRANGE", a.keys.queue(queue), -start-count, -start-1))
+	if err != nil {
+		return nil, fmt.Errorf("read queue: %v", err)
+	}
+
+	records := make([]*JobRecord, 0, len(payloads))
+	for i := len(payloads) - 1; i >= 0; i-- {
+		records = append(records, newJobRecord(payloads[i], 0))
+	}
+	return records, nil
+}
+
+func (a *Admin) readSet(conn redis.Conn, set SortedSet, start, count int) ([]*JobRecord, error) {
+	values, err := redis.Values(conn.Do("ZRANGE", a.keys.sortedSet(set), start, start+count-1, "WITHSCORES"))
+	if err != nil {
+		return nil, fmt.Errorf("read set: %v", err)
+	}
+
+	records := make([]*JobRecord, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		payload, err := redis.Bytes(values[i], nil)
+		if err != nil {
+			return nil, fmt.Errorf("read set: %v", err)
+		}
+		score, err := redis.Float64(values[i+1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("read set: %v", err)
+		}
+		records = append(records, newJobRecord(payload, score))
+	}
+	return records, nil
+}
+
+func (a *Admin) findInSet(conn redis.Conn, set SortedSet, filter JobFilter) ([]*JobRecord, error) {
+	var found []*JobRecord
+	for start := 0; ; start += pageSize {
+		records, err := a.readSet(conn, set, start, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if filter(r) {
+				found = append(found, r)
+			}
+		}
+		if len(records) < pageSize {
+			return found, nil
+		}
+	}
+}
+
+// requeuePayload prepares the payload of a job taken from a sorted set to be pushed to a queue again. Unknown fields
+// are preserved.
+func requeuePayload(payload []byte) ([]byte, error) {
+	return rewritePayload(payload, func(fields map[string]interface{}) {
+		fields["enqueued_at"] = sidekiq.Time(time.Now())
+
+		// Sidekiq increments the counter before each retry, so a manual retry should not use up an attempt.
+		if n, ok := fields["retry_count"].(json.Number); ok {
+			if count, err := n.Int64(); err == nil && count > 0 {
+				fields["retry_count"] = count - 1
+			}
+		}
+	})
+}
+
+// rewritePayload decodes the payload of a job, lets the function change its fields and encodes it again. Unlike
+// decoding it into a Job, this preserves the fields that gokogeri does not know about. Numbers are decoded as
+// json.Number.
+func rewritePayload(payload []byte, rewrite func(map[string]interface{})) ([]byte, error) {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	err := dec.Decode(&fields)
+	if err != nil {
+		return nil, fmt.Errorf("decoding job json: %v", err)
+	}
+
+	rewrite(fields)
+
+	return json.Marshal(fields)
+}
@@ -0,0 +1,411 @@
+package gokogeri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// batchTTL is how long a batch is kept in Redis after it last changed.
+const batchTTL = time.Hour * 24 * 30
+
+// batchOpen is the pending member that keeps a batch from completing until it is committed.
+const batchOpen = "open"
+
+// BatchOptions configures a new Batch.
+type BatchOptions struct {
+	// Description is shown by Admin.BatchStatus.
+	Description string
+
+	// OnComplete is enqueued once every job of the batch, and every child batch, has been processed, whether it
+	// succeeded or not.
+	OnComplete *Job
+
+	// OnSuccess is enqueued once every job of the batch, and every child batch, has succeeded. It is not enqueued while
+	// the last run of any of them has failed.
+	OnSuccess *Job
+
+	// Parent is the ID of the batch that the new batch belongs to, usually the one of the job that creates it. The
+	// parent does not complete before its children.
+	Parent string
+}
+
+// A Batch is a group of jobs whose progress is tracked together, in order to enqueue callback jobs when they are done.
+// Jobs are added with Enqueue, and the batch can only complete after Commit has been called.
+type Batch struct {
+	id       string
+	enqueuer *Enqueuer
+}
+
+// NewBatch creates a batch in Redis. It does not work with a sharded Enqueuer.
+func (e *Enqueuer) NewBatch(ctx context.Context, opts BatchOptions) (*Batch, error) {
+	if e.router != nil {
+		return nil, fmt.Errorf("batches are not supported by a sharded enqueuer")
+	}
+
+	id, err := sidekiq.JobID()
+	if err != nil {
+		return nil, fmt.Errorf("create batch ID: %v", err)
+	}
+
+	fields := []interface{}{"created_at", sidekiq.Time(time.Now()), "description", opts.Description, "total", 0}
+	for _, cb := range []struct {
+		field string
+		job   *Job
+	}{
+		{"on_complete", opts.OnComplete},
+		{"on_success", opts.OnSuccess},
+	} {
+		if cb.job == nil {
+			continue
+		}
+		err = cb.job.setDefaults()
+		if err != nil {
+			return nil, fmt.Errorf("setting callback defaults: %v", err)
+		}
+		enc, err := cb.job.encode()
+		if err != nil {
+			return nil, fmt.Errorf("encode callback: %v", err)
+		}
+		fields = append(fields, cb.field, enc)
+	}
+	if opts.Parent != "" {
+		fields = append(fields, "parent", opts.Parent)
+	}
+
+	conn, err := e.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	if opts.Parent != "" {
+		ok, err := redis.Bool(addToBatchScript.Do(conn, e.keys.batch(opts.Parent), e.keys.batchPending(opts.Parent),
+			batchMember(id), batchTTL.Milliseconds()))
+		if err != nil {
+			return nil, fmt.Errorf("add to parent batch: %v", err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("parent batch %s not found", opts.Parent)
+		}
+	}
+
+	commands := [][]interface{}{
+		append([]interface{}{"HSET", e.keys.batch(id)}, fields...),
+		{"PEXPIRE", e.keys.batch(id), batchTTL.Milliseconds()},
+		{"SADD", e.keys.batchPending(id), batchOpen},
+		{"PEXPIRE", e.keys.batchPending(id), batchTTL.Milliseconds()},
+	}
+	for _, c := range commands {
+		err = conn.Send(c[0].(string), c[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("send: %v", err)
+		}
+	}
+	_, err = redisutil.DoMany(conn, len(commands))
+	if err != nil {
+		return nil, fmt.Errorf("create batch: %v", err)
+	}
+
+	return &Batch{id: id, enqueuer: e}, nil
+}
+
+// ID returns the ID of the batch, which is stored in its jobs as bid.
+func (b *Batch) ID() string {
+	return b.id
+}
+
+// Enqueue adds the job to the batch and enqueues it. Do not call it after Commit, unless from a job of the batch.
+func (b *Batch) Enqueue(ctx context.Context, j *Job) error {
+	err := j.setDefaults()
+	if err != nil {
+		return fmt.Errorf("setting job defaults: %v", err)
+	}
+	j.enc.BatchID = b.id
+
+	e := b.enqueuer
+	err = b.add(ctx, j.enc.JobID)
+	if err != nil {
+		return err
+	}
+
+	err = e.push(ctx, j, time.Time{})
+	if err != nil {
+		// The job is not part of the batch after all.
+		rerr := b.remove(ctx, j.enc.JobID)
+		if rerr != nil {
+			return fmt.Errorf("%v, and failed to remove it from the batch: %v", err, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Commit closes the batch. It can complete once its jobs are done, or right away if they are already done.
+func (b *Batch) Commit(ctx context.Context) error {
+	e := b.enqueuer
+	conn, err := e.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	t := &batchTracker{log: zerolog.Nop(), keys: e.keys}
+	return t.finish(conn, b.id, batchOpen, false)
+}
+
+func (b *Batch) add(ctx context.Context, member string) error {
+	e := b.enqueuer
+	conn, err := e.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	ok, err := redis.Bool(addToBatchScript.Do(conn, e.keys.batch(b.id), e.keys.batchPending(b.id), member,
+		batchTTL.Milliseconds()))
+	if err != nil {
+		return fmt.Errorf("add to batch: %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("batch %s not found", b.id)
+	}
+	return nil
+}
+
+func (b *Batch) remove(ctx context.Context, member string) error {
+	e := b.enqueuer
+	conn, err := e.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	removed, err := redis.Bool(conn.Do("SREM", e.keys.batchPending(b.id), member))
+	if err != nil {
+		return fmt.Errorf("remove from batch: %v", err)
+	}
+	if !removed {
+		return nil
+	}
+	_, err = conn.Do("HINCRBY", e.keys.batch(b.id), "total", -1)
+	if err != nil {
+		return fmt.Errorf("remove from batch: %v", err)
+	}
+	return nil
+}
+
+// batchMember is the pending member of a parent batch that stands for a child batch.
+func batchMember(bid string) string {
+	return "batch:" + bid
+}
+
+// addToBatchScript adds ARGV[1] to the pending members of the batch at KEYS[1] and KEYS[2], if it exists.
+var addToBatchScript = redis.NewScript(2, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('SADD', KEYS[2], ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'total', 1)
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return 1
+`)
+
+// finishInBatchScript records that the pending member ARGV[1] of the batch at KEYS[1], KEYS[2] and KEYS[3] has been
+// processed, and has failed if ARGV[2] is 1. It returns whether the batch has just completed, whether it has just
+// succeeded, whether it has failures, and its parent.
+var finishInBatchScript = redis.NewScript(3, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return {0, 0, 0, ''}
+end
+redis.call('SREM', KEYS[2], ARGV[1])
+if ARGV[2] == '1' then
+	redis.call('SADD', KEYS[3], ARGV[1])
+else
+	redis.call('SREM', KEYS[3], ARGV[1])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('PEXPIRE', KEYS[3], ARGV[3])
+
+local completed, succeeded = 0, 0
+local failures = redis.call('SCARD', KEYS[3])
+if redis.call('SCARD', KEYS[2]) == 0 then
+	completed = redis.call('HSETNX', KEYS[1], 'completed_at', ARGV[4])
+	if failures == 0 then
+		succeeded = redis.call('HSETNX', KEYS[1], 'succeeded_at', ARGV[4])
+	end
+end
+return {completed, succeeded, failures, redis.call('HGET', KEYS[1], 'parent') or ''}
+`)
+
+// batchTracker records the jobs of batches as they are processed, and enqueues the callbacks.
+type batchTracker struct {
+	log  zerolog.Logger
+	keys keyspace
+}
+
+// finish records that the member of the batch has been processed, and if the batch has just completed or succeeded,
+// enqueues its callback and updates its parent, recursively.
+func (t *batchTracker) finish(conn redis.Conn, bid, member string, failed bool) error {
+	failedArg := 0
+	if failed {
+		failedArg = 1
+	}
+
+	reply, err := redis.Values(finishInBatchScript.Do(conn, t.keys.batch(bid), t.keys.batchPending(bid),
+		t.keys.batchFailed(bid), member, failedArg, batchTTL.Milliseconds(), sidekiq.Time(time.Now())))
+	if err != nil {
+		return fmt.Errorf("finish in batch: %v", err)
+	}
+
+	var completed, succeeded, failures int
+	var parent string
+	_, err = redis.Scan(reply, &completed, &succeeded, &failures, &parent)
+	if err != nil {
+		return fmt.Errorf("finish in batch: %v", err)
+	}
+
+	if completed == 1 {
+		t.log.Info().Str("bid", bid).Int("failures", failures).Msg("Batch complete")
+		err = t.callback(conn, bid, "on_complete")
+		if err != nil {
+			return err
+		}
+	}
+	if succeeded == 1 {
+		t.log.Info().Str("bid", bid).Msg("Batch succeeded")
+		err = t.callback(conn, bid, "on_success")
+		if err != nil {
+			return err
+		}
+	}
+
+	if parent != "" && (completed == 1 || succeeded == 1) {
+		return t.finish(conn, parent, batchMember(bid), failures > 0)
+	}
+	return nil
+}
+
+// callback enqueues the callback job in the field of the batch, if there is one.
+func (t *batchTracker) callback(conn redis.Conn, bid, field string) error {
+	payload, err := redis.Bytes(conn.Do("HGET", t.keys.batch(bid), field))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get batch callback: %v", err)
+	}
+
+	j, err := newJobFromJSON(payload)
+	if err != nil {
+		return fmt.Errorf("batch callback: %v", err)
+	}
+	err = j.setDefaults()
+	if err != nil {
+		return fmt.Errorf("setting callback defaults: %v", err)
+	}
+	enc, err := j.encode()
+	if err != nil {
+		return fmt.Errorf("encode callback: %v", err)
+	}
+	return pushPayload(conn, t.keys, j, enc)
+}
+
+// ErrBatchNotFound is returned by Admin.BatchStatus for a batch that does not exist, or has expired.
+var ErrBatchNotFound = errors.New("batch not found")
+
+// BatchStatus describes the progress of a batch.
+type BatchStatus struct {
+	ID          string
+	Description string
+	Parent      string
+	CreatedAt   time.Time
+
+	// Total is the number of jobs and child batches that have been added to the batch.
+	Total int64
+
+	// Pending is the number of jobs and child batches that have not been processed yet.
+	Pending int64
+
+	// Failed holds the IDs of the jobs that failed, and of the child batches with failures, prefixed with "batch:".
+	Failed []string
+
+	// Committed is false until Batch.Commit has been called.
+	Committed bool
+
+	// CompletedAt and SucceededAt are zero until the batch has completed or succeeded.
+	CompletedAt time.Time
+	SucceededAt time.Time
+}
+
+// BatchStatus returns the progress of the batch.
+func (a *Admin) BatchStatus(ctx context.Context, bid string) (*BatchStatus, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	commands := [][]interface{}{
+		{"HGETALL", a.keys.batch(bid)},
+		{"SCARD", a.keys.batchPending(bid)},
+		{"SISMEMBER", a.keys.batchPending(bid), batchOpen},
+		{"SMEMBERS", a.keys.batchFailed(bid)},
+	}
+	for _, c := range commands {
+		err = conn.Send(c[0].(string), c[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("send: %v", err)
+		}
+	}
+	replies, err := redisutil.DoMany(conn, len(commands))
+	if err != nil {
+		return nil, fmt.Errorf("get batch: %v", err)
+	}
+
+	fields, err := redis.StringMap(replies[0], nil)
+	if err != nil {
+		return nil, fmt.Errorf("get batch: %v", err)
+	}
+	if len(fields) == 0 {
+		return nil, ErrBatchNotFound
+	}
+	pending, _ := redis.Int64(replies[1], nil)
+	open, _ := redis.Bool(replies[2], nil)
+	failed, _ := redis.Strings(replies[3], nil)
+
+	s := &BatchStatus{
+		ID:          bid,
+		Description: fields["description"],
+		Parent:      fields["parent"],
+		CreatedAt:   parseTimeField(fields["created_at"]),
+		Failed:      failed,
+		Committed:   !open,
+		CompletedAt: parseTimeField(fields["completed_at"]),
+		SucceededAt: parseTimeField(fields["succeeded_at"]),
+	}
+	s.Total, _ = strconv.ParseInt(fields["total"], 10, 64)
+	s.Pending = pending
+	if open {
+		s.Pending--
+	}
+	return s, nil
+}
+
+// parseTimeField parses a time stored in Redis in the format of Sidekiq. It returns the zero time if it is missing.
+func parseTimeField(v string) time.Time {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return sidekiq.ToTime(f)
+}
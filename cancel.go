@@ -0,0 +1,274 @@
+package gokogeri
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+)
+
+// cancelTTL is how long a cancelled job is remembered, to skip it if it is still waiting in a queue.
+const cancelTTL = time.Hour * 24
+
+// cancelPingInterval is how often the connection subscribed to the cancelled jobs is pinged, so that it does not reach
+// its read timeout.
+const cancelPingInterval = time.Second * 2
+
+// Cancel cancels a job. If the job is waiting in a queue, or scheduled, it is skipped when it is dequeued in the next
+// 24 hours. If it is running, the Context passed to Worker.Work is cancelled, on any Node connected to the same Redis
+// instance, so the worker should watch it to stop early. A skipped or cancelled job counts as failed in its batch or
+// workflow.
+//
+// Cancelling a running job relies on Redis pub/sub, which is not supported by the goredis package, nor with Redis
+// Cluster.
+func (a *Admin) Cancel(ctx context.Context, jid string) error {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.Send("SET", a.keys.cancelled(jid), 1, "EX", int64(cancelTTL/time.Second))
+	if err != nil {
+		return fmt.Errorf("send: %v", err)
+	}
+	err = conn.Send("PUBLISH", a.keys.cancelChannel(), jid)
+	if err != nil {
+		return fmt.Errorf("send: %v", err)
+	}
+	_, err = redisutil.DoMany(conn, 2)
+	if err != nil {
+		return fmt.Errorf("cancel job: %v", err)
+	}
+	return nil
+}
+
+// SetSkipCancelledJobs sets whether the Node skips the jobs cancelled with Admin.Cancel while they were waiting in a
+// queue. It is enabled by default. The dequeuers check every batch of jobs they pop with one more round trip to Redis,
+// which SetSkipCancelledJobs(false) saves, if jobs are never cancelled before they run. Do not call it after calling
+// Run.
+func (n *Node) SetSkipCancelledJobs(skip bool) {
+	n.dqOpts.skipCancelled = skip
+}
+
+// recentCancelTTL is how long a Node remembers a job that was cancelled through pub/sub, so that a job which was
+// dequeued before it was cancelled, but started after, is cancelled too.
+const recentCancelTTL = time.Minute
+
+// runningJobs holds a way to cancel every job that is running on a Node. It is safe for concurrent use.
+type runningJobs struct {
+	mu   sync.Mutex
+	jobs map[string][]*runningJob
+
+	// recent holds when the jobs were cancelled, for recentCancelTTL.
+	recent map[string]time.Time
+}
+
+type runningJob struct {
+	cancel context.CancelFunc
+
+	// cancelled is set if the job was cancelled recently, before it was added.
+	cancelled bool
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{
+		jobs:   make(map[string][]*runningJob),
+		recent: make(map[string]time.Time),
+	}
+}
+
+// add records a running job. The same job can run more than once if it was enqueued twice. If the job was cancelled
+// recently, it is cancelled right away. Like remove, it does nothing if r is nil.
+func (r *runningJobs) add(jid string, cancel context.CancelFunc) *runningJob {
+	j := &runningJob{cancel: cancel}
+	if r == nil {
+		return j
+	}
+	r.mu.Lock()
+	r.jobs[jid] = append(r.jobs[jid], j)
+	at, ok := r.recent[jid]
+	r.mu.Unlock()
+
+	if ok && time.Since(at) < recentCancelTTL {
+		j.cancelled = true
+		cancel()
+	}
+	return j
+}
+
+func (r *runningJobs) remove(jid string, j *runningJob) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := r.jobs[jid]
+	for i, other := range list {
+		if other == j {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(r.jobs, jid)
+	} else {
+		r.jobs[jid] = list
+	}
+}
+
+// cancel cancels the running job, and reports whether it was found. The job is remembered for a while, in case it is
+// about to start.
+func (r *runningJobs) cancel(jid string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for other, at := range r.recent {
+		if now.Sub(at) >= recentCancelTTL {
+			delete(r.recent, other)
+		}
+	}
+	r.recent[jid] = now
+
+	for _, j := range r.jobs[jid] {
+		j.cancel()
+	}
+	return len(r.jobs[jid]) > 0
+}
+
+// cancelledJobs reports which of the payloads are jobs cancelled with Admin.Cancel, with one EXISTS for each job, sent
+// in a single pipeline on the connection of the dequeuer. It returns nil if the Node does not skip cancelled jobs, or
+// if that cannot be checked, in which case the jobs run.
+func (dq *dequeuer) cancelledJobs(payloads [][]byte) []bool {
+	if !dq.opts.skipCancelled || len(payloads) == 0 {
+		return nil
+	}
+
+	err := dq.sendCancelChecks(payloads)
+	var replies []interface{}
+	if err == nil {
+		replies, err = redisutil.DoMany(dq.conn, len(payloads))
+	}
+	if err != nil {
+		dq.log.Warn().Err(err).Msg("Failed to check whether the jobs were cancelled")
+		return nil
+	}
+
+	cancelled := make([]bool, len(payloads))
+	for i, reply := range replies {
+		cancelled[i], _ = redis.Bool(reply, nil)
+	}
+	return cancelled
+}
+
+func (dq *dequeuer) sendCancelChecks(payloads [][]byte) error {
+	for _, p := range payloads {
+		var job struct {
+			JID string `json:"jid"`
+		}
+		// A payload that cannot be read fails later, when it is processed.
+		_ = json.Unmarshal(p, &job)
+		err := dq.conn.Send("EXISTS", dq.keys.cancelled(job.JID))
+		if err != nil {
+			return fmt.Errorf("send: %v", err)
+		}
+	}
+	return nil
+}
+
+// listenForCancels cancels the running jobs that are cancelled with Admin.Cancel on the Redis instance, until the
+// Context is cancelled. It reconnects with the policy of the dequeuers.
+func (n *Node) listenForCancels(ctx context.Context, cp ConnProvider) {
+	log := n.rawLog.With().Str("component", "cancel").Logger()
+	keys := newKeyspaceFor(cp)
+	policy := n.dqOpts.reconnect
+	limiter := logLimiter{interval: policy.LogInterval}
+	rnd := newRand()
+
+	attempt := 0
+	for {
+		err := n.subscribeCancels(ctx, log, cp, keys, func() {
+			attempt = 0
+			limiter.reset()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		attempt++
+		delay := policy.delay(attempt+1, rnd.Float64())
+		if ok, suppressed := limiter.allow(time.Now()); ok {
+			log.Error().
+				Err(err).
+				Int("attempt", attempt).
+				Int("suppressed", suppressed).
+				Dur("delay", delay).
+				Msg("Failed to listen for cancelled jobs")
+		}
+		if !sleep(ctx, delay) {
+			return
+		}
+	}
+}
+
+// subscribeCancels listens for cancelled jobs on a new connection until there is an error, which it returns.
+func (n *Node) subscribeCancels(ctx context.Context, log zerolog.Logger, cp ConnProvider, keys keyspace,
+	subscribed func()) error {
+	conn, err := cp.DialLongPoll(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %v", err)
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	err = psc.Subscribe(keys.cancelChannel())
+	if err != nil {
+		return fmt.Errorf("subscribe: %v", err)
+	}
+
+	// Closing the connection stops Receive.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(cancelPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				psc.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				if psc.Ping("") != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			jid := string(v.Data)
+			if n.runningJobs.cancel(jid) {
+				log.Info().Str("job_id", jid).Msg("Cancelling a running job")
+			}
+		case redis.Subscription:
+			if v.Kind == "subscribe" {
+				subscribed()
+			}
+		case error:
+			return v
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package gokogeri
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunningJobs(t *testing.T) {
+	assert := require.New(t)
+
+	r := newRunningJobs()
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	defer cancel3()
+
+	j1 := r.add("a", cancel1)
+	j2 := r.add("a", cancel2)
+	r.add("b", cancel3)
+
+	r.remove("a", j1)
+	assert.True(r.cancel("a"))
+	assert.NoError(ctx1.Err(), "removed")
+	assert.Error(ctx2.Err())
+	assert.NoError(ctx3.Err(), "other job")
+
+	r.remove("a", j2)
+	assert.False(r.cancel("a"))
+	assert.Len(r.jobs, 1)
+
+	// A job that starts just after it was cancelled is cancelled right away.
+	ctx4, cancel4 := context.WithCancel(context.Background())
+	assert.True(r.add("a", cancel4).cancelled)
+	assert.Error(ctx4.Err())
+	r.recent["a"] = time.Now().Add(-recentCancelTTL)
+	ctx5, cancel5 := context.WithCancel(context.Background())
+	defer cancel5()
+	assert.False(r.add("a", cancel5).cancelled)
+	assert.NoError(ctx5.Err())
+
+	var none *runningJobs
+	none.remove("a", none.add("a", cancel1))
+}
+
+type noPubSubProvider struct {
+	plainProvider
+}
+
+func (noPubSubProvider) PubSub() bool { return false }
+
+func TestSupportsPubSub(t *testing.T) {
+	assert := require.New(t)
+
+	assert.True(supportsPubSub(plainProvider{}), "default")
+	assert.False(supportsPubSub(noPubSubProvider{}))
+}
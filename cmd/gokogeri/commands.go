@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kapvode/gokogeri"
+)
+
+func (a *app) enqueue(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	queue := fs.String("queue", "", "override the queue of the job")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch fs.NArg() {
+	case 0:
+		data, err = io.ReadAll(a.stdin)
+		if err != nil {
+			return fmt.Errorf("read stdin: %v", err)
+		}
+	case 1:
+		data = []byte(fs.Arg(0))
+	default:
+		return fmt.Errorf("expected at most one JSON argument")
+	}
+
+	job, err := gokogeri.ParseJob(data)
+	if err != nil {
+		return err
+	}
+	if job.Class() == "" {
+		return fmt.Errorf("the job has no class")
+	}
+	if *queue != "" {
+		job.SetQueue(*queue)
+	}
+
+	err = gokogeri.NewEnqueuer(a.cm).Enqueue(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(a.stdout, job.ID())
+	return nil
+}
+
+func (a *app) stats(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	s, err := a.admin.Stats(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Processed:\t%d\n", s.Processed)
+	fmt.Fprintf(w, "Failed:\t%d\n", s.Failed)
+	fmt.Fprintf(w, "Enqueued:\t%d\n", s.Enqueued)
+	fmt.Fprintf(w, "Scheduled:\t%d\n", s.Scheduled)
+	fmt.Fprintf(w, "Retries:\t%d\n", s.Retries)
+	fmt.Fprintf(w, "Dead:\t%d\n", s.Dead)
+	fmt.Fprintf(w, "Processes:\t%d\n", s.Processes)
+	return w.Flush()
+}
+
+func (a *app) queues(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("queues", flag.ContinueOnError)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	s, err := a.admin.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	names, err := a.admin.QueueNames(ctx)
+	if err != nil {
+		return err
+	}
+	paused, err := a.admin.PausedQueues(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tSIZE\tPAUSED")
+	for _, q := range names {
+		fmt.Fprintf(w, "%s\t%d\t%t\n", q, s.Queues[q], containsString(paused, q))
+	}
+	return w.Flush()
+}
+
+func (a *app) pause(ctx context.Context, args []string) error {
+	return a.setPaused(ctx, "pause", "Paused", args, a.admin.PauseQueue)
+}
+
+func (a *app) resume(ctx context.Context, args []string) error {
+	return a.setPaused(ctx, "resume", "Resumed", args, a.admin.ResumeQueue)
+}
+
+func (a *app) setPaused(
+	ctx context.Context,
+	name string,
+	done string,
+	args []string,
+	set func(context.Context, string) error,
+) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("expected queue names")
+	}
+
+	for _, q := range fs.Args() {
+		err = set(ctx, q)
+		if err != nil {
+			return fmt.Errorf("%s: %v", q, err)
+		}
+		fmt.Fprintf(a.stdout, "%s %s\n", done, q)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *app) peek(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("peek", flag.ContinueOnError)
+	start := fs.Int("start", 0, "number of jobs to skip")
+	count := fs.Int("count", 10, "number of jobs to show")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a queue or a sorted set")
+	}
+
+	var records []*gokogeri.JobRecord
+	if set, ok := parseSet(fs.Arg(0)); ok {
+		records, err = a.admin.PeekSet(ctx, set, *start, *count)
+	} else {
+		records, err = a.admin.PeekQueue(ctx, fs.Arg(0), *start, *count)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.printRecords(records)
+	return nil
+}
+
+func (a *app) retry(ctx context.Context, args []string) error {
+	set, filter, err := parseSetFilter("retry", args)
+	if err != nil {
+		return err
+	}
+
+	n, err := a.admin.RetryInSet(ctx, set, filter)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(a.stdout, "Moved %d jobs from %s to their queues\n", n, set)
+	return nil
+}
+
+func (a *app) delete(ctx context.Context, args []string) error {
+	set, filter, err := parseSetFilter("delete", args)
+	if err != nil {
+		return err
+	}
+
+	n, err := a.admin.DeleteInSet(ctx, set, filter)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(a.stdout, "Deleted %d jobs from %s\n", n, set)
+	return nil
+}
+
+func (a *app) export(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("o", "", "write to this `file` instead of stdout")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a queue or a sorted set")
+	}
+
+	w := a.stdout
+	var f *os.File
+	if *output != "" {
+		f, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	var n int
+	if set, ok := parseSet(fs.Arg(0)); ok {
+		n, err = a.admin.ExportSet(ctx, set, w)
+	} else {
+		n, err = a.admin.ExportQueue(ctx, fs.Arg(0), w)
+	}
+	if f != nil {
+		// The file may not be complete until it is closed.
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(a.stderr, "Exported %d jobs\n", n)
+	return nil
+}
+
+func (a *app) importJobs(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	var opts gokogeri.ImportOptions
+	fs.StringVar(&opts.Queue, "queue", "", "import the jobs into this queue, instead of the one in each job")
+	set := fs.String("set", "", "import the jobs into this sorted set: schedule, retry or dead")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "validate the input without importing anything")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *set != "" {
+		var ok bool
+		opts.Set, ok = parseSet(*set)
+		if !ok {
+			return fmt.Errorf("unknown sorted set: %s", *set)
+		}
+	}
+
+	r := a.stdin
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	default:
+		return fmt.Errorf("expected at most one file")
+	}
+
+	n, err := a.admin.Import(ctx, r, opts)
+	if err != nil {
+		return fmt.Errorf("imported %d jobs before the error: %v", n, err)
+	}
+
+	if opts.DryRun {
+		fmt.Fprintf(a.stdout, "Would import %d jobs\n", n)
+	} else {
+		fmt.Fprintf(a.stdout, "Imported %d jobs\n", n)
+	}
+	return nil
+}
+
+func (a *app) processes(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("processes", flag.ContinueOnError)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	procs, err := a.admin.Processes(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IDENTITY\tSTARTED\tBUSY\tCONCURRENCY\tQUIET\tQUEUES")
+	for _, p := range procs {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%d\t%d\t%t\t%s\n",
+			p.Identity,
+			p.StartedAt.Format(time.RFC3339),
+			p.Busy,
+			p.Concurrency,
+			p.Quiet,
+			strings.Join(p.Queues, ","),
+		)
+	}
+	return w.Flush()
+}
+
+func (a *app) cancel(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cancel", flag.ContinueOnError)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("expected job IDs")
+	}
+
+	for _, jid := range fs.Args() {
+		err = a.admin.Cancel(ctx, jid)
+		if err != nil {
+			return fmt.Errorf("%s: %v", jid, err)
+		}
+		fmt.Fprintf(a.stdout, "Cancelled %s\n", jid)
+	}
+	return nil
+}
+
+func (a *app) quiet(ctx context.Context, args []string) error {
+	return a.signal(ctx, "quiet", args, a.admin.QuietProcess)
+}
+
+func (a *app) stop(ctx context.Context, args []string) error {
+	return a.signal(ctx, "stop", args, a.admin.StopProcess)
+}
+
+func (a *app) signal(
+	ctx context.Context,
+	name string,
+	args []string,
+	send func(context.Context, string) error,
+) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	all := fs.Bool("all", false, "signal all the running processes")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	identities := fs.Args()
+	if *all {
+		procs, err := a.admin.Processes(ctx)
+		if err != nil {
+			return err
+		}
+		identities = identities[:0]
+		for _, p := range procs {
+			identities = append(identities, p.Identity)
+		}
+	} else if len(identities) == 0 {
+		return fmt.Errorf("expected process identities or -all")
+	}
+
+	for _, id := range identities {
+		err = send(ctx, id)
+		if err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+		fmt.Fprintf(a.stdout, "Sent %s to %s\n", name, id)
+	}
+	return nil
+}
+
+func (a *app) printRecords(records []*gokogeri.JobRecord) {
+	for _, r := range records {
+		if !r.At.IsZero() {
+			fmt.Fprintf(a.stdout, "%s\t", r.At.Format(time.RFC3339))
+		}
+		fmt.Fprintln(a.stdout, string(r.Payload))
+	}
+}
+
+func parseSet(name string) (gokogeri.SortedSet, bool) {
+	switch set := gokogeri.SortedSet(name); set {
+	case gokogeri.ScheduleSet, gokogeri.RetrySet, gokogeri.DeadSet:
+		return set, true
+	}
+	return "", false
+}
+
+// parseSetFilter parses the arguments of the commands that operate on the jobs in a sorted set.
+func parseSetFilter(name string, args []string) (gokogeri.SortedSet, gokogeri.JobFilter, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var jids stringList
+	fs.Var(&jids, "jid", "select the job with this `ID`, can be repeated")
+	class := fs.String("class", "", "select the jobs with this class")
+	queue := fs.String("queue", "", "select the jobs that belong to this queue")
+	all := fs.Bool("all", false, "select all the jobs")
+	err := fs.Parse(args)
+	if err != nil {
+		return "", nil, err
+	}
+	if fs.NArg() != 1 {
+		return "", nil, fmt.Errorf("expected a sorted set: schedule, retry or dead")
+	}
+
+	set, ok := parseSet(fs.Arg(0))
+	if !ok {
+		return "", nil, fmt.Errorf("unknown sorted set: %s", fs.Arg(0))
+	}
+
+	if !*all && len(jids) == 0 && *class == "" && *queue == "" {
+		return "", nil, fmt.Errorf("expected -jid, -class, -queue or -all")
+	}
+
+	var byID gokogeri.JobFilter
+	if len(jids) > 0 {
+		byID = gokogeri.MatchJobIDs(jids...)
+	}
+
+	filter := func(r *gokogeri.JobRecord) bool {
+		if *all {
+			return true
+		}
+		if r.Job == nil {
+			return false
+		}
+		if byID != nil && !byID(r) {
+			return false
+		}
+		if *class != "" && r.Job.Class() != *class {
+			return false
+		}
+		if *queue != "" && r.Job.Queue() != *queue {
+			return false
+		}
+		return true
+	}
+
+	return set, filter, nil
+}
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
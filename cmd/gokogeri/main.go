@@ -0,0 +1,145 @@
+// Command gokogeri is a tool for operating gokogeri and Sidekiq queues: it can enqueue jobs, show statistics, inspect
+// queues and sorted sets, pause queues, retry, delete or cancel jobs, and quiet or stop running processes.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kapvode/gokogeri"
+	"github.com/kapvode/gokogeri/redis"
+)
+
+const usage = `Usage: gokogeri [flags] <command> [command flags] [arguments]
+
+Commands:
+  enqueue [JSON]                  enqueue a job from JSON, read from stdin if omitted
+  stats                           show statistics
+  queues                          list the queues, their sizes and whether they are paused
+  pause <queue>...                stop all the processes from taking jobs from the queues
+  resume <queue>...               let the processes take jobs from paused queues again
+  peek <queue|schedule|retry|dead>
+                                  show the next jobs in a queue or a sorted set
+  retry <schedule|retry|dead>     move jobs from a sorted set back to their queues
+  delete <schedule|retry|dead>    delete jobs from a sorted set
+  export <queue|schedule|retry|dead>
+                                  write the jobs in a queue or a sorted set as JSON Lines
+  import [FILE]                   import jobs written by export, read from stdin if omitted
+  cancel <jid>...                 cancel queued or running jobs
+  processes                       list the running processes
+  quiet <identity>...             stop processes from taking new jobs
+  stop <identity>...              shut processes down
+
+Run "gokogeri <command> -h" for the command flags.
+
+Flags:
+`
+
+// app holds what the commands need.
+type app struct {
+	cfg     *redis.Config
+	timeout time.Duration
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+
+	cm    *redis.ConnManager
+	admin *gokogeri.Admin
+}
+
+type command func(a *app, ctx context.Context, args []string) error
+
+var commands = map[string]command{
+	"enqueue":   (*app).enqueue,
+	"stats":     (*app).stats,
+	"queues":    (*app).queues,
+	"pause":     (*app).pause,
+	"resume":    (*app).resume,
+	"peek":      (*app).peek,
+	"retry":     (*app).retry,
+	"delete":    (*app).delete,
+	"export":    (*app).export,
+	"import":    (*app).importJobs,
+	"cancel":    (*app).cancel,
+	"processes": (*app).processes,
+	"quiet":     (*app).quiet,
+	"stop":      (*app).stop,
+}
+
+func main() {
+	err := run(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gokogeri:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	a := &app{
+		cfg:    redis.NewDefaultConfig(),
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+	a.cfg.ClientName = "gokogeri-cli"
+	if url := os.Getenv("REDIS_URL"); url != "" {
+		a.cfg.URL = url
+	}
+
+	fs := flag.NewFlagSet("gokogeri", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&a.cfg.URL, "url", a.cfg.URL, "Redis `URL`, the default can be set with REDIS_URL")
+	fs.StringVar(&a.cfg.Namespace, "namespace", "", "prefix of all the keys")
+	fs.StringVar(&a.cfg.Username, "username", "", "Redis ACL username, overrides the URL")
+	fs.StringVar(
+		&a.cfg.Password,
+		"password",
+		os.Getenv("REDIS_PASSWORD"),
+		"Redis password, overrides the URL, the default can be set with REDIS_PASSWORD",
+	)
+	var tlsCfg redis.TLSConfig
+	fs.StringVar(&tlsCfg.CAFile, "tls-ca", "", "enable TLS and verify the server with the CA certificates in `file`")
+	fs.StringVar(&tlsCfg.CertFile, "tls-cert", "", "enable TLS and use the client certificate in this PEM `file`")
+	fs.StringVar(&tlsCfg.KeyFile, "tls-key", "", "the key of the client certificate, in a PEM `file`")
+	fs.StringVar(&tlsCfg.ServerName, "tls-server-name", "", "enable TLS and verify the server certificate for `name`")
+	fs.BoolVar(&tlsCfg.InsecureSkipVerify, "tls-skip-verify", false, "enable TLS without verifying the server certificate")
+	fs.DurationVar(&a.cfg.ReadTimeout, "read-timeout", a.cfg.ReadTimeout, "Redis read timeout")
+	fs.DurationVar(&a.cfg.WriteTimeout, "write-timeout", a.cfg.WriteTimeout, "Redis write timeout")
+	fs.DurationVar(&a.timeout, "timeout", time.Second*30, "timeout for the whole command")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if tlsCfg != (redis.TLSConfig{}) {
+		a.cfg.TLS = &tlsCfg
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing command")
+	}
+
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command: %s", fs.Arg(0))
+	}
+
+	a.cm = redis.NewConnManager(a.cfg)
+	defer a.cm.Close()
+	a.admin = gokogeri.NewAdmin(a.cm)
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	return cmd(a, ctx, fs.Args()[1:])
+}
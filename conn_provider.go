@@ -12,6 +12,21 @@ import (
 //
 // The provided Context should only affect the process of establishing a connection. If the context expires afterwards,
 // it should not affect the use of the connection.
+//
+// A provider can also have the following methods, which gokogeri uses if they are present:
+//
+//	// Namespace returns the prefix of all the keys used by gokogeri, without the separating colon. An empty
+//	// namespace means no prefix, which is the default.
+//	Namespace() string
+//
+//	// Cluster reports whether the connections lead to a Redis Cluster. In that case, the connections must route
+//	// every command to the node serving the slot of its first key, and gokogeri uses hash tags in the queue keys, so
+//	// that they can be spread across the nodes. The default is false.
+//	Cluster() bool
+//
+//	// PubSub reports whether the connections returned by DialLongPoll support SUBSCRIBE, which is needed to
+//	// cancel running jobs. The default is true.
+//	PubSub() bool
 type ConnProvider interface {
 	// Conn returns a connection, which can come from a shared pool. The caller will call Close on the connection when
 	// it is done with it.
@@ -21,3 +36,47 @@ type ConnProvider interface {
 	// will close the connection.
 	DialLongPoll(context.Context) (redis.Conn, error)
 }
+
+// namespacer is implemented by a ConnProvider that has a namespace.
+type namespacer interface {
+	Namespace() string
+}
+
+// clusterer is implemented by a ConnProvider that can lead to a Redis Cluster.
+type clusterer interface {
+	Cluster() bool
+}
+
+// pubSubber is implemented by a ConnProvider that can tell whether it supports pub/sub.
+type pubSubber interface {
+	PubSub() bool
+}
+
+// supportsPubSub reports whether the connections of the provider can subscribe to channels.
+func supportsPubSub(cp ConnProvider) bool {
+	ps, ok := cp.(pubSubber)
+	return !ok || ps.PubSub()
+}
+
+type connInfoKey struct{}
+
+// ConnInfo describes who is requesting a connection from a ConnProvider and what for. gokogeri adds it to the Context
+// passed to DialLongPoll, so that providers can label the connections, for example with CLIENT SETNAME.
+type ConnInfo struct {
+	// Identity is the identity of the Node, as reported by Node.Identity.
+	Identity string
+
+	// Component is the part of gokogeri that uses the connection, such as "dequeuer".
+	Component string
+}
+
+// WithConnInfo returns a copy of the Context carrying the connection information.
+func WithConnInfo(ctx context.Context, info ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// ConnInfoFromContext returns the connection information carried by the Context, if any.
+func ConnInfoFromContext(ctx context.Context) (ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(ConnInfo)
+	return info, ok
+}
@@ -0,0 +1,337 @@
+package gokogeri
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/cron"
+)
+
+// A CronJob is enqueued periodically by one of the nodes that have it.
+type CronJob struct {
+	// Name identifies the job on all the nodes. It must be unique.
+	Name string
+
+	// Schedule is a cron expression with five fields, or six with the seconds first, such as "*/10 * * * * *". The
+	// descriptors @yearly, @monthly, @weekly, @daily and @hourly are also accepted.
+	Schedule string
+
+	// Location is the time zone of the schedule. The default is UTC.
+	Location *time.Location
+
+	// NewJob returns the job to enqueue for a tick of the schedule, or nil to skip it.
+	NewJob func(tick time.Time) *Job
+}
+
+const (
+	// cronLeaseTTL is how long the leader keeps the lease without renewing it. It is renewed three times as often.
+	cronLeaseTTL = time.Second * 15
+
+	// cronCatchUp is how far back a new leader enqueues the ticks missed since the last one, for example while the
+	// previous leader was stopping.
+	cronCatchUp = cronLeaseTTL * 2
+
+	// cronTickTTL is how long a tick is remembered after it was enqueued.
+	cronTickTTL = time.Minute * 10
+)
+
+type cronEntry struct {
+	job      CronJob
+	schedule *cron.Schedule
+	next     time.Time
+}
+
+func newCronEntry(job CronJob) (*cronEntry, error) {
+	if job.Name == "" {
+		return nil, fmt.Errorf("the name is empty")
+	}
+	if job.NewJob == nil {
+		return nil, fmt.Errorf("NewJob is nil")
+	}
+
+	s, err := cron.Parse(job.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("parse schedule: %v", err)
+	}
+
+	if job.Location == nil {
+		job.Location = time.UTC
+	}
+	return &cronEntry{job: job, schedule: s}, nil
+}
+
+// cronScheduler enqueues the cron jobs while it holds the lease in Redis, so that only one node does it. Each tick is
+// also claimed with a key of its own before it is enqueued, in case two nodes briefly believe they are the leader.
+type cronScheduler struct {
+	log      zerolog.Logger
+	cp       ConnProvider
+	keys     keyspace
+	identity string
+	enqueuer *Enqueuer
+	entries  []*cronEntry
+}
+
+func newCronScheduler(log zerolog.Logger, cp ConnProvider, identity string, entries []*cronEntry) *cronScheduler {
+	return &cronScheduler{
+		log:      log.With().Str("component", "cron").Logger(),
+		cp:       cp,
+		keys:     newKeyspaceFor(cp),
+		identity: identity,
+		enqueuer: NewEnqueuer(cp),
+		entries:  entries,
+	}
+}
+
+// Run blocks until the Context is cancelled, and then gives up the lease.
+func (s *cronScheduler) Run(ctx context.Context) {
+	leader := false
+	for {
+		ok, err := s.lease(ctx)
+		if err != nil && ctx.Err() == nil {
+			s.log.Error().Err(err).Msg("Failed to get the cron lease")
+		}
+
+		if ok && !leader {
+			s.log.Info().Msg("Became the cron leader")
+			err = s.start(ctx, time.Now())
+			if err != nil && ctx.Err() == nil {
+				s.log.Error().Err(err).Msg("Failed to read the last ticks")
+			}
+		} else if !ok && leader {
+			s.log.Info().Msg("No longer the cron leader")
+		}
+		leader = ok
+
+		renewAt := time.Now().Add(cronLeaseTTL / 3)
+		if leader {
+			s.tickUntil(ctx, renewAt)
+		} else {
+			sleep(ctx, time.Until(renewAt))
+		}
+
+		if ctx.Err() != nil {
+			if leader {
+				s.release()
+			}
+			s.log.Debug().Msg("Stopped")
+			return
+		}
+	}
+}
+
+// leaseScript takes or renews the lease for the process in ARGV[1], for ARGV[2] milliseconds.
+var leaseScript = redis.NewScript(1, `
+local holder = redis.call('GET', KEYS[1])
+if holder == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+if not holder then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseScript deletes a lease or a lock, if it is held by the process or the job in ARGV[1].
+var releaseScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// lease takes or renews the lease, and reports whether the scheduler is the leader.
+func (s *cronScheduler) lease(ctx context.Context) (bool, error) {
+	conn, err := s.cp.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	ok, err := redis.Bool(leaseScript.Do(conn, s.keys.cronLeader(), s.identity, cronLeaseTTL.Milliseconds()))
+	if err != nil {
+		return false, fmt.Errorf("lease: %v", err)
+	}
+	return ok, nil
+}
+
+// release gives up the lease, so that another node can take over without waiting for it to expire.
+func (s *cronScheduler) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := s.cp.Conn(ctx)
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to release the cron lease")
+		return
+	}
+	defer conn.Close()
+
+	_, err = releaseScript.Do(conn, s.keys.cronLeader(), s.identity)
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to release the cron lease")
+	}
+}
+
+// start computes the next tick of every job after becoming the leader, starting from the last tick enqueued by any
+// node, if it is recent enough.
+func (s *cronScheduler) start(ctx context.Context, now time.Time) error {
+	from := now.Add(-cronCatchUp)
+	for _, e := range s.entries {
+		e.next = e.schedule.Next(now.In(e.job.Location))
+	}
+
+	conn, err := s.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	last, err := redis.Int64Map(conn.Do("HGETALL", s.keys.cronLast()))
+	if err != nil {
+		return fmt.Errorf("get last ticks: %v", err)
+	}
+
+	for _, e := range s.entries {
+		unix, ok := last[e.job.Name]
+		if !ok {
+			continue
+		}
+		t := time.Unix(unix, 0)
+		if t.Before(from) {
+			t = from
+		}
+		e.next = e.schedule.Next(t.In(e.job.Location))
+	}
+	return nil
+}
+
+// tickUntil enqueues the jobs that are due until the given time, or until the Context is cancelled.
+func (s *cronScheduler) tickUntil(ctx context.Context, until time.Time) {
+	for {
+		var next time.Time
+		for _, e := range s.entries {
+			if !e.next.IsZero() && (next.IsZero() || e.next.Before(next)) {
+				next = e.next
+			}
+		}
+
+		if next.IsZero() || next.After(until) {
+			sleep(ctx, time.Until(until))
+			return
+		}
+		if !sleep(ctx, time.Until(next)) {
+			return
+		}
+
+		for _, e := range s.entries {
+			if !e.next.IsZero() && !e.next.After(next) {
+				s.enqueue(ctx, e, e.next)
+				e.next = e.schedule.Next(e.next)
+			}
+		}
+	}
+}
+
+// enqueue enqueues the job for the tick, unless it was already enqueued.
+func (s *cronScheduler) enqueue(ctx context.Context, e *cronEntry, tick time.Time) {
+	log := s.log.With().Str("cron_job", e.job.Name).Time("tick", tick).Logger()
+
+	claimed, err := s.claim(ctx, e.job.Name, tick)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to claim the tick")
+		return
+	}
+	if !claimed {
+		log.Debug().Msg("Already enqueued")
+		return
+	}
+
+	j := e.job.NewJob(tick)
+	if j == nil {
+		log.Debug().Msg("Skipped")
+		return
+	}
+
+	err = s.enqueuer.Enqueue(ctx, j)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to enqueue")
+		s.unclaim(e.job.Name, tick)
+		return
+	}
+	log.Info().Str("job_id", j.ID()).Msg("Enqueued")
+
+	err = s.setLast(ctx, e.job.Name, tick)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to record the tick")
+	}
+}
+
+func (s *cronScheduler) claim(ctx context.Context, name string, tick time.Time) (bool, error) {
+	conn, err := s.cp.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	key := s.keys.cronTick(name, tick.Unix())
+	_, err = redis.String(conn.Do("SET", key, s.identity, "NX", "PX", cronTickTTL.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("claim tick: %v", err)
+	}
+	return true, nil
+}
+
+// unclaim lets the tick be enqueued again after a failure.
+func (s *cronScheduler) unclaim(name string, tick time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := s.cp.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, _ = conn.Do("DEL", s.keys.cronTick(name, tick.Unix()))
+}
+
+func (s *cronScheduler) setLast(ctx context.Context, name string, tick time.Time) error {
+	conn, err := s.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", s.keys.cronLast(), name, strconv.FormatInt(tick.Unix(), 10))
+	if err != nil {
+		return fmt.Errorf("set last tick: %v", err)
+	}
+	return nil
+}
+
+// sleep waits for the duration, and reports false if the Context was cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
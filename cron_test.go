@@ -0,0 +1,26 @@
+package gokogeri
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddCronJob(t *testing.T) {
+	assert := require.New(t)
+
+	newJob := func(tick time.Time) *Job {
+		return &Job{}
+	}
+
+	n := NewNode(zerolog.Nop(), namedProvider("a"), 1)
+	assert.NoError(n.AddCronJob(CronJob{Name: "report", Schedule: "0 6 * * *", NewJob: newJob}))
+	assert.Equal(time.UTC, n.cronEntries[0].job.Location)
+
+	assert.Error(n.AddCronJob(CronJob{Name: "report", Schedule: "0 7 * * *", NewJob: newJob}))
+	assert.Error(n.AddCronJob(CronJob{Schedule: "0 7 * * *", NewJob: newJob}))
+	assert.Error(n.AddCronJob(CronJob{Name: "cleanup", Schedule: "0 7 * *", NewJob: newJob}))
+	assert.Error(n.AddCronJob(CronJob{Name: "cleanup", Schedule: "0 7 * * *"}))
+}
@@ -2,69 +2,108 @@ package gokogeri
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
 )
 
+// dequeuerOptions holds the settings shared by all the dequeuers of a Node. They are read when a dequeuer starts.
+type dequeuerOptions struct {
+	reconnect   ReconnectPolicy
+	onConnState func(ConnStateEvent)
+
+	// skipCancelled checks whether the popped jobs were cancelled.
+	skipCancelled bool
+}
+
 type dequeuerFactory struct {
 	log        zerolog.Logger
 	cp         ConnProvider
 	popTimeout int // seconds
+	identity   string
+	keys       keyspace
+	opts       *dequeuerOptions
 }
 
-func newDequeuerFactory(log zerolog.Logger, cp ConnProvider, popTimeout int) *dequeuerFactory {
+func newDequeuerFactory(
+	log zerolog.Logger,
+	cp ConnProvider,
+	popTimeout int,
+	identity string,
+	opts *dequeuerOptions,
+) *dequeuerFactory {
 	return &dequeuerFactory{
 		log:        log,
 		cp:         cp,
 		popTimeout: popTimeout,
+		identity:   identity,
+		keys:       newKeyspaceFor(cp),
+		opts:       opts,
 	}
 }
 
-func (f *dequeuerFactory) newDequeuer(qset QueueSet) *dequeuer {
+// newDequeuer returns a dequeuer that fetches jobs for the demand.
+func (f *dequeuerFactory) newDequeuer(d demand) *dequeuer {
 	dq := &dequeuer{
 		cp:         f.cp,
-		qset:       qset,
+		keys:       f.keys,
+		demand:     d,
 		popTimeout: f.popTimeout,
+		opts:       f.opts,
+		rand:       newRand(),
 	}
 	dq.ctx, dq.cancel = context.WithCancel(context.Background())
-	dq.C = make(chan workItem)
-	dq.log = f.log.With().Str("component", "dequeuer").Strs("queue_set", qset.Names()).Logger()
+	dq.dialCtx = WithConnInfo(dq.ctx, ConnInfo{Identity: f.identity, Component: "dequeuer"})
+	dq.log = f.log.With().Str("component", "dequeuer").Strs("queue_set", d.names()).Logger()
 	return dq
 }
 
 type dequeuer struct {
-	log zerolog.Logger
-	cp  ConnProvider
+	log  zerolog.Logger
+	cp   ConnProvider
+	keys keyspace
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	qset       QueueSet
+	// dialCtx is ctx with the connection information.
+	dialCtx context.Context
+
+	demand     demand
 	popArgs    []interface{}
 	popTimeout int // seconds
 
+	opts *dequeuerOptions
+	rand *rand.Rand
+
+	// noLMPOP is set when the server does not support BLMPOP.
+	noLMPOP bool
+
+	// attempt is the number of connection attempts since the dequeuer last read from the queues successfully.
+	attempt    int
+	logLimiter logLimiter
+
 	// mu guards changes to the value of conn, not its use. Concurrent access is expected only when closing, between
 	// conn.Close and conn.Do.
 	mu   sync.Mutex
 	conn redis.Conn
-
-	// C is the channel on which the dequeuer will send what it reads from one of the queues in the set. It will close
-	// the channel when it is shut down, indicating there will be no more work.
-	C chan workItem
 }
 
 // Run blocks until the dequeuer is stopped.
 func (dq *dequeuer) Run() {
-	defer close(dq.C)
-
 	// - Connect in a loop.
 	// - Pause between attempts if there is a problem.
 	// - When we have a connection, run the poll / pop loop.
-	// - Send what we popped on the channel.
-	// - When asked to stop, close the channel.
+	// - Deliver what we popped.
+	// - When asked to stop, return.
+	dq.logLimiter.interval = dq.opts.reconnect.LogInterval
 	dq.connectLoop()
 
 	dq.log.Debug().Msg("Stopped")
@@ -78,29 +117,67 @@ func (dq *dequeuer) Stop() {
 }
 
 func (dq *dequeuer) connectLoop() {
-	for {
-		select {
-		case <-dq.ctx.Done():
-			return
-		default:
-			dq.log.Info().Msg("Connecting")
-			if err := dq.connect(); err != nil {
-				if dq.notClosing() {
-					time.Sleep(time.Second)
-				}
-				continue
+	for dq.notClosing() {
+		dq.attempt++
+		dq.log.Debug().Int("attempt", dq.attempt).Msg("Connecting")
+
+		err := dq.connect()
+		if err != nil {
+			if dq.notClosing() {
+				dq.reconnect("Failed to connect to Redis", err)
 			}
+			continue
+		}
+
+		dq.log.Info().Int("attempt", dq.attempt).Msg("Connected")
+		dq.notify(ConnStateEvent{State: ConnStateConnected, Attempt: dq.attempt})
+
+		err = dq.readLoop()
+		if dq.notClosing() {
+			dq.reconnect("Failed to read from the queue set", err)
 		}
+	}
+}
+
+// reconnect reports the failure and waits before the next attempt. The failures are logged at a limited rate.
+func (dq *dequeuer) reconnect(msg string, err error) {
+	delay := dq.opts.reconnect.delay(dq.attempt+1, dq.rand.Float64())
+
+	if ok, suppressed := dq.logLimiter.allow(time.Now()); ok {
+		dq.log.Error().
+			Err(err).
+			Int("attempt", dq.attempt).
+			Int("suppressed", suppressed).
+			Dur("delay", delay).
+			Msg(msg)
+	}
+
+	dq.notify(ConnStateEvent{State: ConnStateReconnecting, Attempt: dq.attempt, Delay: delay, Err: err})
 
-		dq.log.Info().Msg("Connected")
-		dq.readLoop()
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-dq.ctx.Done():
+	case <-timer.C:
 	}
 }
 
+func (dq *dequeuer) notify(ev ConnStateEvent) {
+	if dq.opts.onConnState == nil {
+		return
+	}
+	ev.QueueSet = dq.demand.names()
+	dq.opts.onConnState(ev)
+}
+
 func (dq *dequeuer) connect() error {
-	conn, err := dq.cp.DialLongPoll(dq.ctx)
+	conn, err := dq.cp.DialLongPoll(dq.dialCtx)
 	if err != nil {
-		dq.log.Error().Err(err).Msg("Failed to connect to Redis")
 		return err
 	}
 
@@ -108,37 +185,45 @@ func (dq *dequeuer) connect() error {
 	return nil
 }
 
-func (dq *dequeuer) readLoop() {
+// readLoop reads from the queues until the dequeuer is stopped or there is an error, which it returns.
+func (dq *dequeuer) readLoop() error {
 	defer func() {
 		dq.conn.Close()
 		dq.setConn(nil)
 	}()
 
 	for {
-		select {
-		case <-dq.ctx.Done():
-			return
-		default:
-			dq.log.Trace().Msg("BRPOP")
-			results, err := redis.ByteSlices(dq.conn.Do("BRPOP", dq.getPopArgs()...))
-			if err != nil {
-				if err == redis.ErrNil {
-					dq.log.Trace().Msg("BRPOP timeout")
-					continue
-				}
-				if dq.notClosing() {
-					dq.log.Error().Err(err).Msg("Failed to read from the queue set")
-				}
-				return
-			}
-			if len(results) != 2 {
-				dq.log.Error().Msgf("Expected 2 results, got %d", len(results))
-				return
-			}
-			dq.C <- workItem{
-				Q: string(results[0]),
-				P: results[1],
-			}
+		r := dq.demand.reserve(dq.ctx)
+		if r == nil {
+			return nil
+		}
+
+		key, payloads, err := dq.pop(r)
+		var cancelled []bool
+		if err == nil {
+			cancelled = dq.cancelledJobs(payloads)
+		}
+		for i, p := range payloads {
+			r.deliver(workItem{
+				Q:         dq.keys.queueName(key),
+				P:         p,
+				cp:        dq.cp,
+				keys:      dq.keys,
+				cancelled: cancelled != nil && cancelled[i],
+			})
+		}
+		r.release()
+
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+
+		// The connection works, so the next failure starts a new series of attempts.
+		dq.attempt = 0
+		dq.logLimiter.reset()
+
+		if err == redis.ErrNil {
+			dq.log.Trace().Msg("Pop timeout")
 		}
 	}
 }
@@ -161,16 +246,236 @@ func (dq *dequeuer) notClosing() bool {
 	return dq.ctx.Err() == nil
 }
 
-func (dq *dequeuer) getPopArgs() []interface{} {
-	queues := dq.qset.GetQueues()
+// pop reads up to r.count jobs from the queues of the reservation, all from the same queue. It returns the key of the
+// queue and the payloads, or redis.ErrNil on timeout. It can return both payloads and an error, if the error happened
+// after some jobs were taken from the queue.
+//
+// It first takes the jobs that are ready without blocking, which also takes the jobs of the priority sets atomically,
+// and only blocks if every queue is empty.
+func (dq *dequeuer) pop(r *reservation) (string, [][]byte, error) {
+	if dq.keys.cluster {
+		groups := groupBySlot(dq.keys, r.queues)
+		if len(groups) > 1 {
+			return dq.popCluster(groups, r.count)
+		}
+	}
+
+	key, payloads, err := dq.popNow(r.queues, r.count)
+	if err != nil || len(payloads) > 0 {
+		return key, payloads, err
+	}
+
+	timeout := dq.popTimeout
+	if r.partial {
+		timeout = dq.shortPopTimeout()
+	}
+	return dq.popWait(r.queues, timeout, r.count)
+}
+
+// popCluster reads from queues in different slots, which cannot be used in the same command. It checks every group of
+// queues in order without blocking, and if they are all empty, it blocks briefly on the group of the queue that comes
+// first, so that the other groups are checked again soon.
+func (dq *dequeuer) popCluster(groups [][]string, count int) (string, [][]byte, error) {
+	for _, group := range groups {
+		key, payloads, err := dq.popNow(group, count)
+		if err != nil || len(payloads) > 0 {
+			return key, payloads, err
+		}
+	}
+
+	return dq.popWait(groups[0], dq.shortPopTimeout(), count)
+}
+
+// popWait blocks until one of the queues has jobs, and reads up to count jobs from it. A job added to a priority set
+// wakes it up through the wake list of the queue, after which the job is taken from the set.
+func (dq *dequeuer) popWait(queues []string, timeout, count int) (string, [][]byte, error) {
+	var key string
+	var payloads [][]byte
+	var err error
+	if count > 1 && !dq.noLMPOP {
+		key, payloads, err = dq.blmpop(queues, timeout, count)
+		if isUnknownCommand(err) {
+			dq.noLMPOP = true
+			dq.log.Info().Msg("BLMPOP is not supported, using BRPOP and a script instead")
+		}
+	}
+	if count == 1 || dq.noLMPOP {
+		var payload []byte
+		key, payload, err = dq.brpop(queues, timeout)
+		payloads = [][]byte{payload}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, q := range queues {
+		if key == dq.keys.priorityWake(q) {
+			// The wake-ups are discarded. The jobs of the set may have been taken already.
+			return dq.popNow([]string{q}, count)
+		}
+	}
+	if len(payloads) >= count {
+		return key, payloads, nil
+	}
+
+	_, more, err := dq.popNow([]string{dq.keys.queueName(key)}, count-len(payloads))
+	return key, append(payloads, more...), err
+}
+
+func (dq *dequeuer) brpop(queues []string, timeout int) (string, []byte, error) {
+	dq.log.Trace().Msg("BRPOP")
+	results, err := redis.ByteSlices(dq.conn.Do("BRPOP", dq.getPopArgs(queues, timeout)...))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(results) != 2 {
+		return "", nil, fmt.Errorf("expected 2 results, got %d", len(results))
+	}
+	return string(results[0]), results[1], nil
+}
+
+// blmpop reads up to count jobs from the first queue that is not empty, with the BLMPOP command of Redis 7.
+func (dq *dequeuer) blmpop(queues []string, timeout, count int) (string, [][]byte, error) {
+	args := make([]interface{}, 0, len(queues)*2+5)
+	args = append(args, timeout, len(queues)*2)
+	for _, q := range queues {
+		args = append(args, dq.keys.queue(q), dq.keys.priorityWake(q))
+	}
+	args = append(args, "RIGHT", "COUNT", count)
+
+	dq.log.Trace().Msg("BLMPOP")
+	results, err := redis.Values(dq.conn.Do("BLMPOP", args...))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(results) != 2 {
+		return "", nil, fmt.Errorf("expected 2 results, got %d", len(results))
+	}
+	key, err := redis.String(results[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	payloads, err := redis.ByteSlices(results[1], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, payloads, nil
+}
+
+// popScript pops up to ARGV[1] jobs from the first of the queues that has jobs, without blocking. Each queue is given
+// by three keys: its list, its priority set and its wake list. The jobs of the priority set are taken first, by
+// priority, and then the jobs of the list. The wake list is trimmed to the number of jobs left in the priority set. It
+// returns the position of the queue, from 0, and the jobs, or nil if every queue is empty.
+var popScript = redis.NewScript(-1, `
+local count = tonumber(ARGV[1])
+for i = 1, #KEYS, 3 do
+	local jobs = {}
+	local popped = redis.call('ZPOPMIN', KEYS[i + 1], count)
+	for j = 1, #popped, 2 do
+		table.insert(jobs, popped[j])
+	end
+
+	local left = redis.call('ZCARD', KEYS[i + 1])
+	if left == 0 then
+		redis.call('DEL', KEYS[i + 2])
+	else
+		redis.call('LTRIM', KEYS[i + 2], 0, left - 1)
+	end
+
+	while #jobs < count do
+		local job = redis.call('RPOP', KEYS[i])
+		if not job then
+			break
+		end
+		table.insert(jobs, job)
+	end
+
+	if #jobs > 0 then
+		return {(i - 1) / 3, jobs}
+	end
+end
+return false
+`)
+
+// popNow reads up to count jobs from the first of the queues that has jobs, without blocking, taking the jobs of its
+// priority set first. It returns no payloads if every queue is empty.
+func (dq *dequeuer) popNow(queues []string, count int) (string, [][]byte, error) {
+	args := make([]interface{}, 0, len(queues)*3+2)
+	args = append(args, len(queues)*3)
+	for _, q := range queues {
+		args = append(args, dq.keys.queue(q), dq.keys.priorityQueue(q), dq.keys.priorityWake(q))
+	}
+	args = append(args, count)
+
+	dq.log.Trace().Msg("Pop script")
+	reply, err := redis.Values(popScript.Do(dq.conn, args...))
+	if err == redis.ErrNil {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reply) != 2 {
+		return "", nil, fmt.Errorf("expected 2 results, got %d", len(reply))
+	}
+	i, err := redis.Int(reply[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if i < 0 || i >= len(queues) {
+		return "", nil, fmt.Errorf("unexpected queue position %d", i)
+	}
+	payloads, err := redis.ByteSlices(reply[1], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return dq.keys.queue(queues[i]), payloads, nil
+}
+
+func isUnknownCommand(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "ERR unknown command")
+}
+
+// shortPopTimeout is the timeout in seconds for BRPOP when other queues have to be checked again soon.
+const shortPopTimeout = 1
+
+func (dq *dequeuer) shortPopTimeout() int {
+	if dq.popTimeout > 0 && dq.popTimeout < shortPopTimeout {
+		return dq.popTimeout
+	}
+	return shortPopTimeout
+}
+
+// groupBySlot groups the queues by the slot of their keys, keeping the order of the queues within a group, and the
+// order of the groups by their first queue.
+func groupBySlot(keys keyspace, queues []string) [][]string {
+	var groups [][]string
+	var slots []int
+	for _, q := range queues {
+		slot := redisutil.HashSlot(keys.queue(q))
+		i := 0
+		for i < len(slots) && slots[i] != slot {
+			i++
+		}
+		if i == len(slots) {
+			slots = append(slots, slot)
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], q)
+	}
+	return groups
+}
+
+func (dq *dequeuer) getPopArgs(queues []string, timeout int) []interface{} {
 	if dq.popArgs == nil {
-		// size = number of queues + timeout
-		dq.popArgs = make([]interface{}, 0, len(queues)+1)
+		// size = number of queues and their wake lists + timeout
+		dq.popArgs = make([]interface{}, 0, len(queues)*2+1)
 	}
 	dq.popArgs = dq.popArgs[:0]
 	for _, q := range queues {
-		dq.popArgs = append(dq.popArgs, "queue:"+q)
+		dq.popArgs = append(dq.popArgs, dq.keys.queue(q), dq.keys.priorityWake(q))
 	}
-	dq.popArgs = append(dq.popArgs, dq.popTimeout)
+	dq.popArgs = append(dq.popArgs, timeout)
 	return dq.popArgs
 }
@@ -0,0 +1,18 @@
+package gokogeri
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupBySlot(t *testing.T) {
+	assert := require.New(t)
+
+	keys := newKeyspace("", true)
+	groups := groupBySlot(keys, []string{"{a}high", "default", "{a}low", "low"})
+	assert.Equal([][]string{{"{a}high", "{a}low"}, {"default"}, {"low"}}, groups)
+
+	groups = groupBySlot(keys, []string{"{a}high"})
+	assert.Equal([][]string{{"{a}high"}}, groups)
+}
@@ -3,52 +3,187 @@ package gokogeri
 import (
 	"context"
 	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
 
 	"github.com/kapvode/gokogeri/internal/redisutil"
+	"github.com/kapvode/gokogeri/internal/sidekiq"
 )
 
 // Enqueuer puts jobs in queues.
 type Enqueuer struct {
-	cp ConnProvider
+	cp        ConnProvider
+	keys      keyspace
+	router    Router
+	uniqueKey UniqueKeyFunc
 }
 
 // NewEnqueuer returns a new instance.
 func NewEnqueuer(cp ConnProvider) *Enqueuer {
-	return &Enqueuer{cp: cp}
+	return &Enqueuer{
+		cp:   cp,
+		keys: newKeyspaceFor(cp),
+	}
+}
+
+// NewShardedEnqueuer returns an instance that stores every job in the Redis instance chosen by the Router, such as
+// Shards.
+func NewShardedEnqueuer(r Router) *Enqueuer {
+	return &Enqueuer{router: r}
+}
+
+// SetUniqueKeyFunc configures the function that tells which unique jobs are equal. The default is DefaultUniqueKey.
+func (e *Enqueuer) SetUniqueKeyFunc(fn UniqueKeyFunc) {
+	e.uniqueKey = fn
 }
 
 // Enqueue adds the job to the queue configured in the job, or the default one, if no queue is configured.
+//
+// For a unique job, it returns ErrDuplicateJob if an equal job holds the lock.
 func (e *Enqueuer) Enqueue(ctx context.Context, j *Job) error {
+	return e.push(ctx, j, time.Time{})
+}
+
+// EnqueueAt adds the job to the schedule set. It is pushed to its queue at the given time by a running Node, or a
+// Sidekiq process.
+//
+// For a unique job, it returns ErrDuplicateJob if an equal job holds the lock.
+func (e *Enqueuer) EnqueueAt(ctx context.Context, j *Job, at time.Time) error {
+	return e.push(ctx, j, at)
+}
+
+// EnqueueIn is like EnqueueAt, with a time relative to now.
+func (e *Enqueuer) EnqueueIn(ctx context.Context, j *Job, d time.Duration) error {
+	return e.push(ctx, j, time.Now().Add(d))
+}
+
+// push adds the job to its queue, or to the schedule set if the time is not zero.
+func (e *Enqueuer) push(ctx context.Context, j *Job, at time.Time) error {
 	err := j.setDefaults()
 	if err != nil {
 		return fmt.Errorf("setting job defaults: %v", err)
 	}
 
+	if j.enc.UniqueFor > 0 && !j.enc.UniqueUntil.valid() {
+		// The lock would never be released before its lifetime expires.
+		return fmt.Errorf("unknown unique policy %q", j.enc.UniqueUntil)
+	}
+
+	scheduled := !at.IsZero()
+	if scheduled && j.expiresIn > 0 {
+		j.enc.ExpiresAt = sidekiq.Time(at.Add(j.expiresIn))
+	}
+	unique := j.enc.UniqueFor > 0 && (scheduled || j.enc.UniqueUntil != UniqueWhileScheduled)
+	if unique {
+		keyFunc := e.uniqueKey
+		if keyFunc == nil {
+			keyFunc = DefaultUniqueKey
+		}
+		j.enc.UniqueKey = keyFunc(j)
+	} else {
+		j.enc.UniqueKey = ""
+	}
+
 	enc, err := j.encode()
 	if err != nil {
 		return fmt.Errorf("encode job: %v", err)
 	}
 
-	conn, err := e.cp.Conn(ctx)
+	cp, keys := e.cp, e.keys
+	if e.router != nil {
+		cp = e.router.Route(j)
+		keys = newKeyspaceFor(cp)
+	}
+
+	conn, err := cp.Conn(ctx)
 	if err != nil {
 		return fmt.Errorf("get conn: %v", err)
 	}
 	defer conn.Close()
 
-	err = conn.Send("SADD", "queues", j.enc.Queue)
-	if err != nil {
-		return fmt.Errorf("send: %v", err)
+	if unique {
+		err = lockUnique(conn, keys, j)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = conn.Send("LPUSH", "queue:"+j.enc.Queue, enc)
+	if j.enc.StatusTTL > 0 {
+		// The status is written first, so that it cannot replace the one written by a worker.
+		state := StatusQueued
+		if scheduled {
+			state = StatusScheduled
+		}
+		err = sendStatus(conn, keys, j, []interface{}{"state", state})
+		if err != nil {
+			if unique {
+				_ = unlockUnique(conn, keys, j)
+			}
+			return err
+		}
+	}
+
+	if scheduled {
+		_, err = conn.Do("ZADD", keys.sortedSet(ScheduleSet), sidekiq.Time(at), enc)
+		if err != nil {
+			err = fmt.Errorf("schedule job: %v", err)
+		}
+	} else {
+		err = pushPayload(conn, keys, j, enc)
+	}
+
+	if err != nil && unique {
+		// Let the job be enqueued again. If this fails too, the lock expires.
+		_ = unlockUnique(conn, keys, j)
+	}
+	return err
+}
+
+// pushPayload adds the payload of the job to its queue, or to the priority set of the queue if the job has a priority.
+func pushPayload(conn redis.Conn, keys keyspace, j *Job, payload []byte) error {
+	commands, err := pushCommands(keys, j, payload)
 	if err != nil {
-		return fmt.Errorf("send: %v", err)
+		return err
+	}
+
+	for _, c := range commands {
+		err = sendCommand(conn, c)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = redisutil.DoMany(conn, 2)
+	_, err = redisutil.DoMany(conn, len(commands))
 	if err != nil {
 		return fmt.Errorf("enqueue job: %v", err)
 	}
+	return nil
+}
+
+// pushCommands returns the Redis commands that push the payload of the job, for pushPayload.
+func pushCommands(keys keyspace, j *Job, payload []byte) ([][]interface{}, error) {
+	queue := j.enc.Queue
+	if j.enc.Priority != nil {
+		return priorityCommands(keys, queue, *j.enc.Priority, payload)
+	}
+
+	return [][]interface{}{
+		{"SADD", keys.queues(), queue},
+		{"LPUSH", keys.queue(queue), payload},
+	}, nil
+}
 
+// sendCommand sends a command made of its name and arguments, or of a script and its keys and arguments.
+func sendCommand(conn redis.Conn, c []interface{}) error {
+	var err error
+	if script, ok := c[0].(*redis.Script); ok {
+		err = script.Send(conn, c[1:]...)
+	} else {
+		err = conn.Send(c[0].(string), c[1:]...)
+	}
+	if err != nil {
+		return fmt.Errorf("send: %v", err)
+	}
 	return nil
 }
@@ -0,0 +1,76 @@
+package gokogeri
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// SetKeepExpiredJobs makes the Node move the jobs that are dequeued after they have expired to the dead set, where they
+// can be inspected and retried with Admin, instead of discarding them. Do not call it after calling Run.
+func (n *Node) SetKeepExpiredJobs(keep bool) {
+	n.keepExpired = keep
+}
+
+// expire handles a job that was dequeued after it had expired. It is not processed, but skipped.
+func (m *workerManager) expire(log zerolog.Logger, r workItem, job *Job) {
+	if m.keepExpired {
+		err := m.bury(r, time.Now())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to move the expired job to the dead set")
+		}
+	}
+	log.Info().Time("expires_at", job.ExpiresAt()).Msg("Job expired")
+	m.skip(log, r, job)
+}
+
+// skip treats a job that is not processed like a job that failed, except that its unique lock is released, since the
+// job will not be retried. Its batch and workflow are updated.
+func (m *workerManager) skip(log zerolog.Logger, r workItem, job *Job) {
+	m.trackStatus(log, r, job, StatusSkipped, "finished_at", sidekiq.Time(time.Now()))
+	if job.enc.UniqueUntil == UniqueUntilExecuting || job.enc.UniqueUntil == UniqueUntilExecuted {
+		m.unlockUnique(log, r, job)
+	}
+	if job.enc.BatchID != "" {
+		m.finishInBatch(log, r, job, true)
+	}
+	if job.enc.WorkflowID != "" {
+		m.finishStep(log, r, job, true)
+	}
+}
+
+// bury adds an expired job to the dead set of the Redis instance it came from, with the error fields that Sidekiq
+// shows.
+func (m *workerManager) bury(r workItem, now time.Time) error {
+	if r.cp == nil {
+		return fmt.Errorf("unknown origin")
+	}
+
+	payload, err := rewritePayload(r.P, func(fields map[string]interface{}) {
+		fields["error_class"] = "Gokogeri::JobExpired"
+		fields["error_message"] = "the job expired before it was processed"
+		fields["failed_at"] = sidekiq.Time(now)
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := r.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("ZADD", r.keys.sortedSet(DeadSet), sidekiq.Time(now), payload)
+	if err != nil {
+		return fmt.Errorf("add to dead set: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package gokogeri
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// exportRecord is a single line of an export in the JSON Lines format.
+type exportRecord struct {
+	// Payload is the job, exactly as it is stored in Redis.
+	Payload json.RawMessage `json:"payload"`
+
+	// Score is the score of the job in a sorted set. It is omitted for jobs exported from a queue.
+	Score float64 `json:"score,omitempty"`
+}
+
+// ImportOptions configures Admin.Import.
+type ImportOptions struct {
+	// Queue overrides the queue of every imported job. The queue field in the payload is changed accordingly.
+	// If it is empty, every job goes to the queue named in its payload.
+	Queue string
+
+	// Set imports the jobs into a sorted set, with their exported scores, instead of pushing them to a queue. Jobs
+	// without a score, such as those exported from a queue, get the current time as their score.
+	Set SortedSet
+
+	// DryRun reads and validates the input without writing anything to Redis.
+	DryRun bool
+}
+
+// ExportQueue writes the jobs in the queue to w in the JSON Lines format, in the order in which they would be
+// processed. It returns the number of exported jobs. The jobs with a priority are imported with their priority.
+//
+// The queue is read in pages, so jobs that are added or removed while exporting may be missed or exported twice. Stop
+// the producers and consumers of the queue if you need a consistent snapshot.
+func (a *Admin) ExportQueue(ctx context.Context, queue string, w io.Writer) (int, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	return exportPages(w, pages(func(start int) ([]*JobRecord, error) {
+		return a.readQueue(conn, queue, start, pageSize)
+	}))
+}
+
+// ExportSet writes the jobs in the sorted set to w in the JSON Lines format, ordered by score. It returns the number of
+// exported jobs.
+//
+// The same consistency caveats as for ExportQueue apply.
+func (a *Admin) ExportSet(ctx context.Context, set SortedSet, w io.Writer) (int, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	return exportPages(w, pages(func(start int) ([]*JobRecord, error) {
+		return a.readSet(conn, set, start, pageSize)
+	}))
+}
+
+// Import reads jobs in the JSON Lines format produced by ExportQueue and ExportSet, and adds them to queues or to a
+// sorted set, according to the options. Jobs are pushed to queues in the order in which they are read, so a queue
+// that is exported and imported keeps its processing order. It returns the number of imported jobs, or the number of
+// jobs that would be imported in a dry run.
+//
+// Invalid input stops the import at the offending line. The jobs before it have already been imported.
+func (a *Admin) Import(ctx context.Context, r io.Reader, opts ImportOptions) (int, error) {
+	var conn redis.Conn
+	if !opts.DryRun {
+		var err error
+		conn, err = a.cp.Conn(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("get conn: %v", err)
+		}
+		defer conn.Close()
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	imported := 0
+	line := 0
+
+	// Jobs are sent in batches. The counts refer to the current batch.
+	pendingJobs := 0
+	pendingCommands := 0
+
+	flush := func() error {
+		if pendingJobs == 0 {
+			return nil
+		}
+		_, err := redisutil.DoMany(conn, pendingCommands)
+		if err != nil {
+			return fmt.Errorf("import jobs: %v", err)
+		}
+		imported += pendingJobs
+		pendingJobs = 0
+		pendingCommands = 0
+		return nil
+	}
+
+	// stop ends the import at invalid input, after importing the jobs sent before it.
+	stop := func(err error) (int, error) {
+		ferr := flush()
+		if ferr != nil {
+			return imported, ferr
+		}
+		return imported, err
+	}
+
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec exportRecord
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return stop(fmt.Errorf("line %d: %v", line, err))
+		}
+
+		commands, err := a.importCommands(&rec, opts)
+		if err != nil {
+			return stop(fmt.Errorf("line %d: %v", line, err))
+		}
+
+		if opts.DryRun {
+			imported++
+			continue
+		}
+
+		for _, c := range commands {
+			err = sendCommand(conn, c)
+			if err != nil {
+				return imported, err
+			}
+		}
+		pendingJobs++
+		pendingCommands += len(commands)
+
+		if pendingJobs >= pageSize {
+			err = flush()
+			if err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stop(fmt.Errorf("read input: %v", err))
+	}
+
+	if opts.DryRun {
+		return imported, nil
+	}
+
+	err := flush()
+	if err != nil {
+		return imported, err
+	}
+	return imported, nil
+}
+
+// importCommands returns the Redis commands that import a single job.
+func (a *Admin) importCommands(rec *exportRecord, opts ImportOptions) ([][]interface{}, error) {
+	job, err := newJobFromJSON(rec.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := []byte(rec.Payload)
+	queue := job.Queue()
+	if opts.Queue != "" && opts.Queue != queue {
+		queue = opts.Queue
+		payload, err = rewritePayload(payload, func(fields map[string]interface{}) {
+			fields["queue"] = queue
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if queue == "" {
+		return nil, fmt.Errorf("job %s has no queue", job.ID())
+	}
+
+	if priority, ok := job.Priority(); ok && opts.Set == "" {
+		return priorityCommands(a.keys, queue, priority, payload)
+	}
+
+	if opts.Set != "" {
+		score := rec.Score
+		if score == 0 {
+			score = sidekiq.Time(time.Now())
+		}
+		return [][]interface{}{
+			{"ZADD", a.keys.sortedSet(opts.Set), score, payload},
+		}, nil
+	}
+
+	return [][]interface{}{
+		{"SADD", a.keys.queues(), queue},
+		{"LPUSH", a.keys.queue(queue), payload},
+	}, nil
+}
+
+// pages returns a function that reads the pages of a queue or a sorted set in turn, and then nothing.
+func pages(read func(start int) ([]*JobRecord, error)) func() ([]*JobRecord, error) {
+	start := 0
+	done := false
+	return func() ([]*JobRecord, error) {
+		if done {
+			return nil, nil
+		}
+		records, err := read(start)
+		if err != nil {
+			return nil, err
+		}
+		start += pageSize
+		done = len(records) < pageSize
+		return records, nil
+	}
+}
+
+// exportPages writes the jobs returned by next until it returns none.
+func exportPages(w io.Writer, next func() ([]*JobRecord, error)) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	exported := 0
+	for {
+		records, err := next()
+		if err != nil {
+			return exported, err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, r := range records {
+			rec := exportRecord{Payload: r.Payload}
+			if !r.At.IsZero() {
+				rec.Score = sidekiq.Time(r.At)
+			}
+			err = enc.Encode(&rec)
+			if err != nil {
+				return exported, fmt.Errorf("write job: %v", err)
+			}
+			exported++
+		}
+	}
+
+	err := bw.Flush()
+	if err != nil {
+		return exported, fmt.Errorf("write jobs: %v", err)
+	}
+	return exported, nil
+}
@@ -0,0 +1,284 @@
+package gokogeri
+
+import (
+	"context"
+	"sync"
+)
+
+// A demand tells a dequeuer when to fetch a job, from which queues, and where to deliver it.
+type demand interface {
+	// reserve blocks until a job can be fetched. It returns nil if the Context is cancelled first.
+	reserve(ctx context.Context) *reservation
+
+	// names returns the names of all the queues that can be requested, for logging.
+	names() []string
+}
+
+// reservation is what a dequeuer needs to fetch jobs. The dequeuer calls deliver for every job it fetched, and then
+// release.
+type reservation struct {
+	// queues holds the queues to check, in order.
+	queues []string
+
+	// count is the maximum number of jobs to fetch.
+	count int
+
+	// partial means the reservation does not cover all the queues of the demand, so the dequeuer should not block for
+	// long, in order to check the others again soon.
+	partial bool
+
+	// deliver hands over a job that was fetched.
+	deliver func(workItem)
+
+	// release gives back what was reserved for the jobs that were not fetched.
+	release func()
+}
+
+// capacity counts the workers of a manager that are ready for a job, plus the jobs that can be prefetched. A job can
+// only be fetched for the manager after acquiring a slot, which is released when the job is done. It is safe for
+// concurrent use.
+type capacity struct {
+	mu   sync.Mutex
+	free int
+	// changed is closed and replaced when a slot is released.
+	changed chan struct{}
+
+	// onRelease is called after a slot is released. It is set before the capacity is used.
+	onRelease func()
+}
+
+func newCapacity(n int) *capacity {
+	return &capacity{
+		free:    n,
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire waits for a free slot and acquires it. It returns false if the Context is cancelled first.
+func (c *capacity) acquire(ctx context.Context) bool {
+	for {
+		c.mu.Lock()
+		if c.free > 0 {
+			c.free--
+			c.mu.Unlock()
+			return true
+		}
+		wait := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-wait:
+		}
+	}
+}
+
+// tryAcquire acquires a slot if one is free.
+func (c *capacity) tryAcquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.free <= 0 {
+		return false
+	}
+	c.free--
+	return true
+}
+
+// add changes the number of slots, for example when scaling. Removed slots that are in use are taken back when they
+// are released.
+func (c *capacity) add(n int) {
+	c.mu.Lock()
+	c.free += n
+	if n > 0 {
+		close(c.changed)
+		c.changed = make(chan struct{})
+	}
+	c.mu.Unlock()
+
+	if n > 0 && c.onRelease != nil {
+		c.onRelease()
+	}
+}
+
+func (c *capacity) release() {
+	c.mu.Lock()
+	c.free++
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+
+	if c.onRelease != nil {
+		c.onRelease()
+	}
+}
+
+// fetchGroup is the demand of several managers that share their dequeuers, instead of having one each. Every time a
+// dequeuer reserves a job, the group reserves a slot from every manager with an idle worker and asks for the queues of
+// all of them, each manager in the order of its own QueueSet. The job goes to the first of those managers that
+// processes the queue it came from. The managers take turns at being first.
+type fetchGroup struct {
+	// mu guards the fields below.
+	mu       sync.Mutex
+	managers []*workerManager
+	next     int
+	// changed is closed and replaced when a slot is released, to wake up the waiting dequeuers.
+	changed chan struct{}
+
+	// pauses is set before the dequeuers start.
+	pauses *pauses
+}
+
+func newFetchGroup() *fetchGroup {
+	return &fetchGroup{
+		changed: make(chan struct{}),
+	}
+}
+
+// add makes the manager use the dequeuers of the group. It can be called while the dequeuers are running.
+func (g *fetchGroup) add(m *workerManager) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	m.cap.onRelease = g.signal
+	g.managers = append(g.managers, m)
+
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// remove stops reserving jobs for the manager. It reports whether the manager was in the group. Reservations that are
+// already in progress can still deliver jobs to the manager until m.reserved is done.
+func (g *fetchGroup) remove(m *workerManager) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, other := range g.managers {
+		if other == m {
+			g.managers = append(g.managers[:i], g.managers[i+1:]...)
+			if g.next >= len(g.managers) {
+				g.next = 0
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// removeAll removes all the managers and returns them.
+func (g *fetchGroup) removeAll() []*workerManager {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	managers := g.managers
+	g.managers = nil
+	return managers
+}
+
+func (g *fetchGroup) signal() {
+	g.mu.Lock()
+	close(g.changed)
+	g.changed = make(chan struct{})
+	g.mu.Unlock()
+}
+
+// reserve implements demand. Managers whose queues are all paused are left out.
+func (g *fetchGroup) reserve(ctx context.Context) *reservation {
+	for {
+		g.mu.Lock()
+		wait := g.changed
+		var resumed <-chan struct{}
+		var reserved []*workerManager
+		var queues [][]string
+		n := len(g.managers)
+		for i := 0; i < n; i++ {
+			m := g.managers[(g.next+i)%n]
+			var active []string
+			active, resumed = g.pauses.filter(m.qset.GetQueues())
+			if len(active) > 0 && m.cap.tryAcquire() {
+				m.reserved.Add(1)
+				reserved = append(reserved, m)
+				queues = append(queues, active)
+			}
+		}
+		if len(reserved) > 0 {
+			g.next = (g.next + 1) % n
+		}
+		g.mu.Unlock()
+
+		if len(reserved) > 0 {
+			return g.reservation(reserved, queues, len(reserved) < n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wait:
+		case <-resumed:
+		}
+	}
+}
+
+// reservation returns a reservation for the queues of the reserved managers, which are in the same order.
+func (g *fetchGroup) reservation(reserved []*workerManager, managerQueues [][]string, partial bool) *reservation {
+	var queues []string
+	seen := make(map[string]bool)
+	for _, qs := range managerQueues {
+		for _, q := range qs {
+			if !seen[q] {
+				seen[q] = true
+				queues = append(queues, q)
+			}
+		}
+	}
+
+	var target *workerManager
+	return &reservation{
+		queues:  queues,
+		count:   1,
+		partial: partial,
+		deliver: func(w workItem) {
+			target = reserved[0]
+			for _, m := range reserved {
+				if containsString(m.qset.Names(), w.Q) {
+					target = m
+					break
+				}
+			}
+			target.c <- w
+		},
+		release: func() {
+			for _, m := range reserved {
+				if m != target {
+					m.cap.release()
+				}
+				m.reserved.Done()
+			}
+		},
+	}
+}
+
+// names implements demand.
+func (g *fetchGroup) names() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var names []string
+	for _, m := range g.managers {
+		for _, q := range m.qset.Names() {
+			if !containsString(names, q) {
+				names = append(names, q)
+			}
+		}
+	}
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package gokogeri
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchGroup(t *testing.T) {
+	assert := require.New(t)
+
+	ctx := context.Background()
+
+	critical := &workerManager{qset: OrderedQueueSet{"critical", "default"}, instances: 1}
+	critical.setPrefetch(0)
+	low := &workerManager{qset: OrderedQueueSet{"low"}, instances: 1}
+	low.setPrefetch(0)
+
+	g := newFetchGroup()
+	g.add(critical)
+	g.add(low)
+	assert.Equal([]string{"critical", "default", "low"}, g.names())
+
+	r := g.reserve(ctx)
+	assert.Equal([]string{"critical", "default", "low"}, r.queues)
+	assert.False(r.partial)
+
+	// The job goes to the manager of its queue and the slot of the other one is released.
+	r.deliver(workItem{Q: "low"})
+	r.release()
+	assert.Equal("low", (<-low.c).Q)
+
+	// Only the managers with idle workers are included.
+	r = g.reserve(ctx)
+	assert.Equal([]string{"critical", "default"}, r.queues)
+	assert.True(r.partial)
+	r.release()
+
+	low.done()
+	r = g.reserve(ctx)
+	assert.Equal([]string{"critical", "default", "low"}, r.queues)
+	r.release()
+
+	// The managers take turns at being first.
+	r = g.reserve(ctx)
+	assert.Equal([]string{"low", "critical", "default"}, r.queues)
+	r.release()
+
+	// Nothing is reserved while all the workers are busy.
+	assert.True(critical.cap.tryAcquire())
+	assert.True(low.cap.tryAcquire())
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Nil(g.reserve(cancelled))
+
+	critical.done()
+	r = g.reserve(ctx)
+	assert.Equal([]string{"critical", "default"}, r.queues)
+}
+
+func TestFetchGroupRemove(t *testing.T) {
+	assert := require.New(t)
+
+	ctx := context.Background()
+
+	critical := &workerManager{qset: OrderedQueueSet{"critical"}, instances: 1}
+	critical.setPrefetch(0)
+	low := &workerManager{qset: OrderedQueueSet{"low"}, instances: 1}
+	low.setPrefetch(0)
+
+	g := newFetchGroup()
+	g.add(critical)
+	g.add(low)
+
+	r := g.reserve(ctx)
+	assert.True(g.remove(low))
+	assert.False(g.remove(low))
+
+	// The reservation in progress can still deliver to the removed manager.
+	removed := make(chan struct{})
+	go func() {
+		low.reserved.Wait()
+		close(removed)
+	}()
+	r.deliver(workItem{Q: "low"})
+	r.release()
+	<-removed
+	assert.Equal("low", (<-low.c).Q)
+
+	r = g.reserve(ctx)
+	assert.Equal([]string{"critical"}, r.queues)
+	r.release()
+
+	assert.Equal([]*workerManager{critical}, g.removeAll())
+	assert.Empty(g.names())
+}
+
+func TestManagerReserve(t *testing.T) {
+	assert := require.New(t)
+
+	ctx := context.Background()
+
+	m := &workerManager{qset: OrderedQueueSet{"default"}, instances: 2}
+	m.setPrefetch(1)
+
+	// Two workers and one prefetched job.
+	for i := 0; i < 3; i++ {
+		r := m.reserve(ctx)
+		assert.NotNil(r)
+		r.deliver(workItem{Q: "default"})
+		r.release()
+	}
+
+	// Nothing more can be fetched until a worker is done.
+	timeout, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	assert.Nil(m.reserve(timeout))
+
+	<-m.c
+	m.done()
+	assert.NotNil(m.reserve(ctx))
+}
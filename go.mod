@@ -4,12 +4,15 @@ go 1.17
 
 require (
 	github.com/gomodule/redigo v1.8.9
+	github.com/redis/go-redis/v9 v9.5.1
 	github.com/rs/zerolog v1.28.0
 	github.com/stretchr/testify v1.8.0
 )
 
 require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
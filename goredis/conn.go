@@ -0,0 +1,256 @@
+package goredis
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+// errClosed is returned when using a connection that has been closed.
+var errClosed = errors.New("goredis: connection closed")
+
+// conn implements redigo.Conn with a go-redis client. Replies are converted to the types used by redigo, for example
+// bulk strings to []byte and error replies to redigo.Error.
+//
+// Close may be called concurrently with the other methods, to interrupt a blocking command.
+type conn struct {
+	client redis.UniversalClient
+	// owned means the client belongs to the connection and is closed with it.
+	owned bool
+
+	pending [][]interface{}
+	replies []interface{}
+
+	// mu guards closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+func newConn(client redis.UniversalClient, owned bool) *conn {
+	return &conn{
+		client: client,
+		owned:  owned,
+	}
+}
+
+// Close implements redigo.Conn.
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.owned {
+		return c.client.Close()
+	}
+	return nil
+}
+
+// Err implements redigo.Conn.
+func (c *conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	return nil
+}
+
+// Do implements redigo.Conn.
+func (c *conn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		if len(c.pending) == 0 {
+			return nil, nil
+		}
+		err := c.Flush()
+		if err != nil {
+			return nil, err
+		}
+		replies := c.replies
+		c.replies = nil
+		return replies, nil
+	}
+
+	err := c.Send(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	// Like redigo, return the last reply and the first error among the replies.
+	var first error
+	for _, r := range c.replies {
+		if e, ok := r.(redigo.Error); ok && first == nil {
+			first = e
+		}
+	}
+	reply := c.replies[len(c.replies)-1]
+	c.replies = nil
+	return reply, first
+}
+
+// Send implements redigo.Conn.
+func (c *conn) Send(cmd string, args ...interface{}) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	c.pending = append(c.pending, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+// Flush implements redigo.Conn. It executes the pending commands and keeps their replies for Receive.
+func (c *conn) Flush() error {
+	pending := c.pending
+	c.pending = nil
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+
+	if len(pending) == 1 {
+		val, err := c.client.Do(ctx, pending[0]...).Result()
+		reply, err := convertResult(pending[0][0].(string), val, err)
+		if err != nil {
+			return err
+		}
+		c.replies = append(c.replies, reply)
+		return nil
+	}
+
+	pipe := c.client.Pipeline()
+	cmds := make([]*redis.Cmd, len(pending))
+	for i, args := range pending {
+		cmds[i] = pipe.Do(ctx, args...)
+	}
+	// Errors are checked for every command below.
+	_, _ = pipe.Exec(ctx)
+
+	for i, cmd := range cmds {
+		val, err := cmd.Result()
+		reply, err := convertResult(pending[i][0].(string), val, err)
+		if err != nil {
+			return err
+		}
+		c.replies = append(c.replies, reply)
+	}
+	return nil
+}
+
+// Receive implements redigo.Conn.
+func (c *conn) Receive() (interface{}, error) {
+	if len(c.replies) == 0 {
+		err := c.Flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.replies) == 0 {
+		return nil, errors.New("goredis: no pending replies")
+	}
+
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if e, ok := reply.(redigo.Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// scoredCommands are the commands that reply with an array of [member, score] pairs in RESP3, instead of the flat
+// array of RESP2, when they return scores.
+var scoredCommands = map[string]bool{
+	"ZRANGE":           true,
+	"ZRANGEBYSCORE":    true,
+	"ZREVRANGE":        true,
+	"ZREVRANGEBYSCORE": true,
+	"ZPOPMIN":          true,
+	"ZPOPMAX":          true,
+	"ZRANDMEMBER":      true,
+	"ZUNION":           true,
+	"ZINTER":           true,
+	"ZDIFF":            true,
+}
+
+// convertResult converts the result of a go-redis command to a redigo reply. Error replies become redigo.Error values,
+// while other errors, such as network errors, are returned as errors.
+func convertResult(cmd string, val interface{}, err error) (interface{}, error) {
+	if err == redis.Nil {
+		return nil, nil
+	}
+	var rerr redis.Error
+	if errors.As(err, &rerr) {
+		return redigo.Error(err.Error()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if scoredCommands[strings.ToUpper(cmd)] {
+		val = flattenPairs(val)
+	}
+	return convertValue(val), nil
+}
+
+// flattenPairs turns an array of [member, score] pairs into the flat array that RESP2 returns. Other values are
+// returned unchanged.
+func flattenPairs(val interface{}) interface{} {
+	pairs, ok := val.([]interface{})
+	if !ok {
+		return val
+	}
+	flat := make([]interface{}, 0, len(pairs)*2)
+	for _, p := range pairs {
+		pair, ok := p.([]interface{})
+		if !ok || len(pair) != 2 {
+			return val
+		}
+		flat = append(flat, pair...)
+	}
+	return flat
+}
+
+// convertValue converts a value read by go-redis to the type redigo would have read. The RESP3 types, which redigo does
+// not support, are converted to their RESP2 equivalents.
+func convertValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case string:
+		return []byte(v)
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = convertValue(e)
+		}
+		return res
+	case map[interface{}]interface{}:
+		res := make([]interface{}, 0, len(v)*2)
+		for k, e := range v {
+			res = append(res, convertValue(k), convertValue(e))
+		}
+		return res
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case *big.Int:
+		return []byte(v.String())
+	case redis.Error:
+		return redigo.Error(v.Error())
+	default:
+		return v
+	}
+}
@@ -0,0 +1,132 @@
+// Package goredis implements gokogeri.ConnProvider on top of go-redis, for applications that already use it, so that
+// they can share its connection pool instead of opening a separate one with the redis package.
+package goredis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/kapvode/gokogeri"
+)
+
+var _ gokogeri.ConnProvider = (*ConnProvider)(nil)
+
+// defaultReadTimeout is the read timeout used by go-redis when it is not configured.
+const defaultReadTimeout = time.Second * 3
+
+// Options holds the settings of ConnProvider that go-redis does not have.
+type Options struct {
+	// Namespace is the prefix of all the keys used by gokogeri. See redis.Config for more.
+	Namespace string
+
+	// LongPollTimeout is the timeout in seconds for the BRPOP Redis command that reads from the queues. It must be the
+	// same as the value passed to gokogeri.NewNode. Zero means no timeout.
+	LongPollTimeout int
+}
+
+// ConnProvider implements gokogeri.ConnProvider with a go-redis client, which can be a *redis.Client, including one
+// created with redis.NewFailoverClient, or a *redis.ClusterClient.
+//
+// The connections returned by Conn run every command through the client, so they share its pool. The commands of a
+// pipeline are sent with a go-redis pipeline. The long poll connections use a separate client with the same options,
+// a single connection and a longer read timeout, so that closing it interrupts a blocking command.
+type ConnProvider struct {
+	client redis.UniversalClient
+	opts   Options
+}
+
+// NewConnProvider returns a new instance. The client remains owned by the caller, who closes it.
+func NewConnProvider(client redis.UniversalClient, opts Options) *ConnProvider {
+	return &ConnProvider{
+		client: client,
+		opts:   opts,
+	}
+}
+
+// Conn implements gokogeri.ConnProvider.
+func (cp *ConnProvider) Conn(ctx context.Context) (redigo.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return newConn(cp.client, false), nil
+}
+
+// DialLongPoll implements gokogeri.ConnProvider.
+func (cp *ConnProvider) DialLongPoll(ctx context.Context) (redigo.Conn, error) {
+	var client redis.UniversalClient
+
+	switch c := cp.client.(type) {
+	case *redis.Client:
+		opts := *c.Options()
+		opts.PoolSize = 1
+		opts.MinIdleConns = 0
+		opts.MaxIdleConns = 0
+		opts.ReadTimeout = cp.readTimeout(opts.ReadTimeout)
+		opts.ClientName = clientName(ctx, opts.ClientName)
+		client = redis.NewClient(&opts)
+	case *redis.ClusterClient:
+		opts := *c.Options()
+		opts.PoolSize = 1
+		opts.MinIdleConns = 0
+		opts.MaxIdleConns = 0
+		opts.ReadTimeout = cp.readTimeout(opts.ReadTimeout)
+		opts.ClientName = clientName(ctx, opts.ClientName)
+		client = redis.NewClusterClient(&opts)
+	default:
+		return nil, fmt.Errorf("unsupported go-redis client: %T", cp.client)
+	}
+
+	err := client.Ping(ctx).Err()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return newConn(client, true), nil
+}
+
+// Namespace implements gokogeri.ConnProvider.
+func (cp *ConnProvider) Namespace() string {
+	return cp.opts.Namespace
+}
+
+// PubSub implements gokogeri.ConnProvider. The connections only read the replies to the commands they send, so they
+// do not support pub/sub.
+func (cp *ConnProvider) PubSub() bool {
+	return false
+}
+
+// Cluster implements gokogeri.ConnProvider. It reports whether the client is a *redis.ClusterClient.
+func (cp *ConnProvider) Cluster() bool {
+	_, ok := cp.client.(*redis.ClusterClient)
+	return ok
+}
+
+// readTimeout returns the read timeout of the long poll connections, based on the one of the client.
+func (cp *ConnProvider) readTimeout(base time.Duration) time.Duration {
+	if cp.opts.LongPollTimeout == 0 {
+		// No timeout.
+		return -1
+	}
+	if base < 0 {
+		return base
+	}
+	if base == 0 {
+		base = defaultReadTimeout
+	}
+	return base + time.Second*time.Duration(cp.opts.LongPollTimeout)
+}
+
+// clientName adds the connection information to the name of the client, if it has one.
+func clientName(ctx context.Context, base string) string {
+	info, ok := gokogeri.ConnInfoFromContext(ctx)
+	if base == "" || !ok {
+		return base
+	}
+	return strings.ReplaceAll(strings.Join([]string{base, info.Identity, info.Component}, ":"), " ", "_")
+}
@@ -0,0 +1,55 @@
+package goredis
+
+import (
+	"errors"
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertResult(t *testing.T) {
+	assert := require.New(t)
+
+	reply, err := convertResult("GET", nil, redis.Nil)
+	assert.NoError(err)
+	assert.Nil(reply)
+
+	reply, err = convertResult("BRPOP", []interface{}{"queue:default", "payload"}, nil)
+	assert.NoError(err)
+	values, err := redigo.ByteSlices(reply, nil)
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("queue:default"), []byte("payload")}, values)
+
+	reply, err = convertResult("GET", true, nil)
+	assert.NoError(err)
+	assert.Equal(int64(1), reply)
+
+	reply, err = convertResult("GET", 1.5, nil)
+	assert.NoError(err)
+	assert.Equal([]byte("1.5"), reply)
+
+	reply, err = convertResult("GET", map[interface{}]interface{}{"a": int64(1)}, nil)
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]byte("a"), int64(1)}, reply)
+
+	// RESP3 pairs of members and scores are flattened like in RESP2.
+	reply, err = convertResult("zrange", []interface{}{[]interface{}{"a", 1.5}, []interface{}{"b", float64(2)}}, nil)
+	assert.NoError(err)
+	values, err = redigo.ByteSlices(reply, nil)
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("a"), []byte("1.5"), []byte("b"), []byte("2")}, values)
+
+	reply, err = convertResult("ZPOPMIN", []interface{}{"a", 1.5}, nil)
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]byte("a"), []byte("1.5")}, reply)
+
+	reply, err = convertResult("ZRANGE", []interface{}{"a", "b"}, nil)
+	assert.NoError(err)
+	assert.Equal([]interface{}{[]byte("a"), []byte("b")}, reply)
+
+	network := errors.New("connection reset")
+	_, err = convertResult("GET", nil, network)
+	assert.Equal(network, err)
+}
@@ -0,0 +1,109 @@
+//go:build integration
+
+package goredis_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kapvode/gokogeri"
+	"github.com/kapvode/gokogeri/goredis"
+)
+
+func TestConnProvider(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 10})
+	defer client.Close()
+
+	assert := require.New(t)
+	assert.NoError(client.FlushDB(ctx).Err())
+
+	cp := goredis.NewConnProvider(client, goredis.Options{Namespace: "app", LongPollTimeout: 1})
+
+	job := gokogeri.Job{}
+	job.SetClass("TestJob")
+
+	err := gokogeri.NewEnqueuer(cp).Enqueue(ctx, &job)
+	assert.NoError(err)
+
+	n, err := client.LLen(ctx, "app:queue:default").Result()
+	assert.NoError(err)
+	assert.Equal(int64(1), n)
+
+	workerDone := make(chan struct{})
+
+	node := gokogeri.NewNode(zerolog.Nop(), cp, 1)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			close(workerDone)
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case <-workerDone:
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+
+	stats, err := gokogeri.NewAdmin(cp).Stats(ctx)
+	assert.NoError(err)
+	assert.Equal(int64(1), stats.Processed)
+	assert.Equal(int64(0), stats.Enqueued)
+}
+
+func TestSortedSets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	// go-redis uses RESP3, where the scores of sorted sets are returned in pairs.
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 10, Protocol: 3})
+	defer client.Close()
+
+	assert := require.New(t)
+	assert.NoError(client.FlushDB(ctx).Err())
+
+	cp := goredis.NewConnProvider(client, goredis.Options{})
+
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, id := range []string{"j1", "j2"} {
+		job := gokogeri.Job{}
+		job.SetID(id).SetClass("TestJob")
+		assert.NoError(gokogeri.NewEnqueuer(cp).EnqueueAt(ctx, &job, at))
+	}
+
+	admin := gokogeri.NewAdmin(cp)
+	records, err := admin.PeekSet(ctx, gokogeri.ScheduleSet, 0, 10)
+	assert.NoError(err)
+	assert.Len(records, 2)
+	for i, id := range []string{"j1", "j2"} {
+		assert.Equal(id, records[i].Job.ID())
+		assert.True(at.Equal(records[i].At), "score")
+	}
+
+	n, err := admin.DeleteInSet(ctx, gokogeri.ScheduleSet, gokogeri.MatchJobIDs("j1"))
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
@@ -0,0 +1,226 @@
+package gokogeri
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// Signals that can be sent to a process through Redis, compatible with Sidekiq.
+const (
+	signalQuiet = "TSTP"
+	signalStop  = "TERM"
+)
+
+const (
+	// heartbeatInterval is how often a process reports its presence.
+	heartbeatInterval = time.Second * 5
+
+	// heartbeatTTL is how long the process information is kept after the last heartbeat.
+	heartbeatTTL = 60
+)
+
+// processStats counts the jobs processed by a Node between heartbeats. It is safe for concurrent use.
+type processStats struct {
+	processed int64
+	failed    int64
+	busy      int64
+}
+
+func (s *processStats) start() {
+	atomic.AddInt64(&s.busy, 1)
+}
+
+func (s *processStats) finish(failed bool) {
+	atomic.AddInt64(&s.busy, -1)
+	atomic.AddInt64(&s.processed, 1)
+	if failed {
+		atomic.AddInt64(&s.failed, 1)
+	}
+}
+
+// heartbeat periodically stores information about the process in Redis, flushes the statistics and checks for signals
+// sent by Admin.
+type heartbeat struct {
+	log   zerolog.Logger
+	cp    ConnProvider
+	keys  keyspace
+	stats *processStats
+
+	identity string
+	info     processInfo
+
+	// describe updates the queues and the concurrency in the process information before every beat, if set.
+	describe func(*processInfo)
+
+	// quiet reports whether the process is quiet.
+	quiet func() bool
+
+	// onSignal is called with every signal received.
+	onSignal func(string)
+}
+
+func newHeartbeat(
+	log zerolog.Logger,
+	cp ConnProvider,
+	stats *processStats,
+	identity string,
+	info processInfo,
+) (*heartbeat, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("get hostname: %v", err)
+	}
+	info.Hostname = host
+	info.PID = os.Getpid()
+	info.Identity = identity
+	info.StartedAt = sidekiq.Time(time.Now())
+	if info.Labels == nil {
+		info.Labels = []string{}
+	}
+
+	return &heartbeat{
+		log:      log.With().Str("component", "heartbeat").Logger(),
+		cp:       cp,
+		keys:     newKeyspaceFor(cp),
+		stats:    stats,
+		identity: identity,
+		info:     info,
+	}, nil
+}
+
+// Run beats until the Context is cancelled, at which point it removes the process information from Redis.
+func (h *heartbeat) Run(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	h.beat(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			h.clear()
+			return
+		case <-ticker.C:
+			h.beat(ctx)
+		}
+	}
+}
+
+func (h *heartbeat) beat(ctx context.Context) {
+	processed := atomic.SwapInt64(&h.stats.processed, 0)
+	failed := atomic.SwapInt64(&h.stats.failed, 0)
+
+	sig, err := h.send(ctx, processed, failed)
+	if err != nil {
+		// Keep the counts for the next attempt.
+		atomic.AddInt64(&h.stats.processed, processed)
+		atomic.AddInt64(&h.stats.failed, failed)
+		h.log.Error().Err(err).Msg("Heartbeat failed")
+		return
+	}
+
+	if sig != "" {
+		h.log.Info().Str("signal", sig).Msg("Received signal")
+		if h.onSignal != nil {
+			h.onSignal(sig)
+		}
+	}
+}
+
+func (h *heartbeat) send(ctx context.Context, processed, failed int64) (string, error) {
+	info := h.info
+	if h.describe != nil {
+		h.describe(&info)
+	}
+	enc, err := json.Marshal(info)
+	if err != nil {
+		return "", fmt.Errorf("encode process info: %v", err)
+	}
+
+	conn, err := h.cp.Conn(ctx)
+	if err != nil {
+		return "", fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	quiet := "false"
+	if h.quiet != nil && h.quiet() {
+		quiet = "true"
+	}
+
+	commands := [][]interface{}{
+		{"SADD", h.keys.processes(), h.identity},
+		{
+			"HSET", h.keys.process(h.identity),
+			"info", enc,
+			"busy", atomic.LoadInt64(&h.stats.busy),
+			"beat", sidekiq.Time(time.Now()),
+			"quiet", quiet,
+		},
+		{"EXPIRE", h.keys.process(h.identity), heartbeatTTL},
+		{"INCRBY", h.keys.stat("processed"), processed},
+		{"INCRBY", h.keys.stat("failed"), failed},
+		{"RPOP", h.keys.signals(h.identity)},
+	}
+
+	for _, c := range commands {
+		err = conn.Send(c[0].(string), c[1:]...)
+		if err != nil {
+			return "", fmt.Errorf("send: %v", err)
+		}
+	}
+
+	replies, err := redisutil.DoMany(conn, len(commands))
+	if err != nil {
+		return "", fmt.Errorf("heartbeat: %v", err)
+	}
+
+	sig, err := redis.String(replies[len(replies)-1], nil)
+	if err != nil && err != redis.ErrNil {
+		return "", fmt.Errorf("read signal: %v", err)
+	}
+	return sig, nil
+}
+
+// clear flushes the remaining statistics and removes the process information from Redis.
+func (h *heartbeat) clear() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := h.cp.Conn(ctx)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to clear the heartbeat")
+		return
+	}
+	defer conn.Close()
+
+	commands := [][]interface{}{
+		{"INCRBY", h.keys.stat("processed"), atomic.SwapInt64(&h.stats.processed, 0)},
+		{"INCRBY", h.keys.stat("failed"), atomic.SwapInt64(&h.stats.failed, 0)},
+		{"SREM", h.keys.processes(), h.identity},
+		{"DEL", h.keys.process(h.identity)},
+	}
+
+	for _, c := range commands {
+		err = conn.Send(c[0].(string), c[1:]...)
+		if err != nil {
+			h.log.Error().Err(err).Msg("Failed to clear the heartbeat")
+			return
+		}
+	}
+
+	_, err = redisutil.DoMany(conn, len(commands))
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to clear the heartbeat")
+	}
+}
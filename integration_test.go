@@ -3,11 +3,17 @@
 package gokogeri_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	redigo "github.com/gomodule/redigo/redis"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 
@@ -166,6 +172,1945 @@ func TestNoOpJobSuccess(t *testing.T) {
 	assert.Equal(workerJob.CreatedAt(), workerJob.EnqueuedAt())
 }
 
+func TestAdminSortedSets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	conn, err := cm.Conn(ctx)
+	assert.NoError(err)
+	defer conn.Close()
+
+	_, err = conn.Do("ZADD", "dead", 1669852800, `{"class":"A","queue":"q1","jid":"a1","retry_count":3}`)
+	assert.NoError(err)
+	_, err = conn.Do("ZADD", "dead", 1669852801, `{"class":"B","queue":"q2","jid":"b1"}`)
+	assert.NoError(err)
+	_, err = conn.Do("ZADD", "dead", 1669852802, `{"class":"B","queue":"q2","jid":"b2"}`)
+	assert.NoError(err)
+
+	admin := gokogeri.NewAdmin(cm)
+
+	records, err := admin.PeekSet(ctx, gokogeri.DeadSet, 0, 10)
+	assert.NoError(err)
+	assert.Len(records, 3)
+	assert.Equal("a1", records[0].Job.ID())
+	assert.Equal(time.Unix(1669852800, 0), records[0].At)
+
+	n, err := admin.RetryInSet(ctx, gokogeri.DeadSet, gokogeri.MatchJobIDs("a1"))
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	queued, err := admin.PeekQueue(ctx, "q1", 0, 10)
+	assert.NoError(err)
+	assert.Len(queued, 1)
+	assert.Equal("a1", queued[0].Job.ID())
+	assert.Contains(string(queued[0].Payload), `"retry_count":2`)
+
+	n, err = admin.DeleteInSet(ctx, gokogeri.DeadSet, func(r *gokogeri.JobRecord) bool {
+		return r.Job.Class() == "B"
+	})
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	stats, err := admin.Stats(ctx)
+	assert.NoError(err)
+	assert.Equal(int64(0), stats.Dead)
+	assert.Equal(int64(1), stats.Enqueued)
+	assert.Equal(int64(1), stats.Queues["q1"])
+}
+
+func TestAdminExportImport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	for _, id := range []string{"j1", "j2", "j3"} {
+		var job gokogeri.Job
+		job.SetID(id).SetClass("ExportJob").SetQueue("src")
+		assert.NoError(enqueuer.Enqueue(ctx, &job))
+	}
+
+	admin := gokogeri.NewAdmin(cm)
+
+	var buf bytes.Buffer
+	n, err := admin.ExportQueue(ctx, "src", &buf)
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	export := buf.String()
+
+	n, err = admin.Import(ctx, strings.NewReader(export), gokogeri.ImportOptions{Queue: "dst", DryRun: true})
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	size, err := admin.QueueSize(ctx, "dst")
+	assert.NoError(err)
+	assert.Equal(int64(0), size)
+
+	n, err = admin.Import(ctx, strings.NewReader(export), gokogeri.ImportOptions{Queue: "dst"})
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	records, err := admin.PeekQueue(ctx, "dst", 0, 10)
+	assert.NoError(err)
+	assert.Len(records, 3)
+	for i, id := range []string{"j1", "j2", "j3"} {
+		assert.Equal(id, records[i].Job.ID())
+		assert.Equal("dst", records[i].Job.Queue())
+	}
+
+	n, err = admin.Import(ctx, strings.NewReader(export), gokogeri.ImportOptions{Set: gokogeri.DeadSet})
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	buf.Reset()
+	n, err = admin.ExportSet(ctx, gokogeri.DeadSet, &buf)
+	assert.NoError(err)
+	assert.Equal(3, n)
+	assert.Equal(3, strings.Count(buf.String(), `"score":`))
+
+	_, err = admin.Import(ctx, strings.NewReader("{}\n"), gokogeri.ImportOptions{})
+	assert.ErrorContains(err, "line 1")
+
+	// The jobs before an invalid line are imported.
+	n, err = admin.Import(ctx, strings.NewReader(export+"{}\n"), gokogeri.ImportOptions{Queue: "partial"})
+	assert.ErrorContains(err, "line 4")
+	assert.Equal(3, n)
+	size, err = admin.QueueSize(ctx, "partial")
+	assert.NoError(err)
+	assert.Equal(int64(3), size)
+}
+
+func TestNodeHeartbeat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"a", "b"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			return nil
+		}),
+		3,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	admin := gokogeri.NewAdmin(cm)
+
+	var procs []*gokogeri.Process
+	for len(procs) == 0 && ctx.Err() == nil {
+		var err error
+		procs, err = admin.Processes(ctx)
+		assert.NoError(err)
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	assert.Len(procs, 1)
+	assert.Equal(node.Identity(), procs[0].Identity)
+	assert.Equal(3, procs[0].Concurrency)
+	assert.Equal([]string{"a", "b"}, procs[0].Queues)
+	assert.False(procs[0].Quiet)
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+
+	procs, err := admin.Processes(ctx)
+	assert.NoError(err)
+	assert.Len(procs, 0)
+}
+
+func TestNamespace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cfg := testConfig()
+	cfg.Namespace = "tenant"
+	cm := redis.NewConnManager(cfg)
+	defer cm.Close()
+
+	plain := redis.NewConnManager(testConfig())
+	defer plain.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	job := gokogeri.Job{}
+	job.SetClass("TestJob")
+
+	err := gokogeri.NewEnqueuer(cm).Enqueue(ctx, &job)
+	assert.NoError(err)
+
+	conn, err := plain.Conn(ctx)
+	assert.NoError(err)
+	defer conn.Close()
+
+	n, err := redigo.Int(conn.Do("LLEN", "tenant:queue:default"))
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	isMember, err := redigo.Bool(conn.Do("SISMEMBER", "tenant:queues", "default"))
+	assert.NoError(err)
+	assert.True(isMember)
+
+	stats, err := gokogeri.NewAdmin(plain).Stats(ctx)
+	assert.NoError(err)
+	assert.Equal(int64(0), stats.Enqueued)
+
+	workerDone := make(chan struct{})
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			close(workerDone)
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case <-workerDone:
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+
+	stats, err = gokogeri.NewAdmin(cm).Stats(ctx)
+	assert.NoError(err)
+	assert.Equal(int64(0), stats.Enqueued)
+	assert.Equal(int64(1), stats.Processed)
+}
+
+func TestShards(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cm1 := redis.NewConnManager(testConfig())
+	defer cm1.Close()
+
+	cfg := testConfig()
+	cfg.URL = "redis://localhost/11"
+	cm2 := redis.NewConnManager(cfg)
+	defer cm2.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm1)
+	flushDB(t, cm2)
+
+	shards := gokogeri.NewShards(cm1, cm2).AssignQueue("default", 1)
+	enqueuer := gokogeri.NewShardedEnqueuer(shards)
+
+	for i := 0; i < 4; i++ {
+		job := gokogeri.Job{}
+		job.SetClass("TestJob").SetQueue("sharded").SetShardKey(fmt.Sprintf("customer-%d", i))
+		assert.NoError(enqueuer.Enqueue(ctx, &job))
+	}
+
+	job := gokogeri.Job{}
+	job.SetClass("TestJob").SetShardKey("ignored")
+	assert.NoError(enqueuer.Enqueue(ctx, &job))
+
+	size, err := gokogeri.NewAdmin(cm2).QueueSize(ctx, "default")
+	assert.NoError(err)
+	assert.Equal(int64(1), size)
+
+	size1, err := gokogeri.NewAdmin(cm1).QueueSize(ctx, "sharded")
+	assert.NoError(err)
+	size2, err := gokogeri.NewAdmin(cm2).QueueSize(ctx, "sharded")
+	assert.NoError(err)
+	assert.Equal(int64(4), size1+size2)
+
+	var mu sync.Mutex
+	processed := 0
+	allDone := make(chan struct{})
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm1, 1)
+	node.ProcessShardedQueues(
+		shards.Providers(),
+		gokogeri.OrderedQueueSet{"default", "sharded"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed++
+			if processed == 5 {
+				close(allDone)
+			}
+			return nil
+		}),
+		2,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case <-allDone:
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+}
+
+func TestSharedFetchers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	for _, q := range []string{"critical", "low", "critical", "low"} {
+		job := gokogeri.Job{}
+		job.SetClass("TestJob").SetQueue(q)
+		assert.NoError(enqueuer.Enqueue(ctx, &job))
+	}
+
+	var mu sync.Mutex
+	processed := make(map[string][]string)
+	allDone := make(chan struct{})
+
+	worker := func(name string) gokogeri.Worker {
+		return gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed[name] = append(processed[name], j.Queue())
+			if len(processed["critical"])+len(processed["low"]) == 4 {
+				close(allDone)
+			}
+			return nil
+		})
+	}
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.SetSharedFetchers(1)
+	node.ProcessQueues(gokogeri.OrderedQueueSet{"critical"}, worker("critical"), 2)
+	node.ProcessQueues(gokogeri.OrderedQueueSet{"low"}, worker("low"), 1)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case <-allDone:
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+
+	assert.Equal([]string{"critical", "critical"}, processed["critical"])
+	assert.Equal([]string{"low", "low"}, processed["low"])
+}
+
+func TestFetchOnDemand(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	for i := 0; i < 3; i++ {
+		job := gokogeri.Job{}
+		job.SetClass("TestJob")
+		assert.NoError(enqueuer.Enqueue(ctx, &job))
+	}
+
+	started := make(chan struct{}, 3)
+	unblock := make(chan struct{})
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			started <- struct{}{}
+			<-unblock
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	<-started
+	// Give the dequeuer a chance to fetch more than it should.
+	time.Sleep(time.Millisecond * 100)
+
+	size, err := gokogeri.NewAdmin(cm).QueueSize(ctx, "default")
+	assert.NoError(err)
+	assert.Equal(int64(2), size)
+
+	close(unblock)
+	<-started
+	<-started
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+}
+
+func TestBatchFetch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	for i := 0; i < 10; i++ {
+		job := gokogeri.Job{}
+		job.SetClass("TestJob").SetArgs([]interface{}{i})
+		assert.NoError(enqueuer.Enqueue(ctx, &job))
+	}
+
+	var mu sync.Mutex
+	processed := 0
+	allDone := make(chan struct{})
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.SetBatchSize(4)
+	node.SetPrefetch(2)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed++
+			if processed == 10 {
+				close(allDone)
+			}
+			return nil
+		}),
+		3,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case <-allDone:
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+}
+
+func TestReconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cfg := testConfig()
+	cfg.URL = "redis://localhost:1"
+	cm := redis.NewConnManager(cfg)
+	defer cm.Close()
+
+	assert := require.New(t)
+
+	events := make(chan gokogeri.ConnStateEvent, 10)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.SetReconnectPolicy(gokogeri.ReconnectPolicy{
+		MinDelay:   time.Millisecond * 10,
+		MaxDelay:   time.Millisecond * 20,
+		Multiplier: 2,
+	})
+	node.OnConnState(func(ev gokogeri.ConnStateEvent) {
+		select {
+		case events <- ev:
+		default:
+		}
+	})
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case <-ctx.Done():
+			assert.NoError(ctx.Err()) // fail on timeout
+		case ev := <-events:
+			assert.Equal(gokogeri.ConnStateReconnecting, ev.State)
+			assert.Equal(i, ev.Attempt)
+			assert.Equal([]string{"default"}, ev.QueueSet)
+			assert.Error(ev.Err)
+		}
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+}
+
+func TestAutoscale(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	for i := 0; i < 6; i++ {
+		job := gokogeri.Job{}
+		job.SetClass("TestJob")
+		assert.NoError(enqueuer.Enqueue(ctx, &job))
+	}
+
+	started := make(chan struct{}, 6)
+	unblock := make(chan struct{})
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	h := node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			started <- struct{}{}
+			<-unblock
+			return nil
+		}),
+		1,
+	)
+	h.Autoscale(time.Millisecond*20, func(s gokogeri.ScaleState) int {
+		n := s.Busy + int(s.Backlog)
+		if n > 4 {
+			n = 4
+		}
+		return n
+	})
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	for i := 0; i < 4; i++ {
+		select {
+		case <-ctx.Done():
+			assert.NoError(ctx.Err()) // fail on timeout
+		case <-started:
+		}
+	}
+	assert.Equal(4, h.Instances())
+
+	assert.NoError(h.Scale(1))
+	close(unblock)
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+}
+
+func TestAddRemoveQueueSet(t *testing.T) {
+	for _, shared := range []int{0, 1} {
+		shared := shared
+		t.Run(fmt.Sprintf("shared=%d", shared), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+
+			cm := redis.NewConnManager(testConfig())
+			defer cm.Close()
+
+			assert := require.New(t)
+			flushDB(t, cm)
+
+			noop := gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+				return nil
+			})
+
+			node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+			node.SetSharedFetchers(shared)
+			node.ProcessQueues(gokogeri.OrderedQueueSet{"default"}, noop, 1)
+
+			var wg sync.WaitGroup
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				node.Run()
+			}()
+
+			started := make(chan struct{}, 1)
+			unblock := make(chan struct{})
+			h := node.ProcessQueues(
+				gokogeri.OrderedQueueSet{"tenant"},
+				gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+					started <- struct{}{}
+					<-unblock
+					return nil
+				}),
+				1,
+			)
+
+			enqueuer := gokogeri.NewEnqueuer(cm)
+			job := gokogeri.Job{}
+			job.SetQueue("tenant").SetClass("TestJob")
+			assert.NoError(enqueuer.Enqueue(ctx, &job))
+
+			select {
+			case <-ctx.Done():
+				assert.NoError(ctx.Err()) // fail on timeout
+			case <-started:
+			}
+
+			removed := make(chan error)
+			go func() {
+				removed <- h.Remove(ctx)
+			}()
+
+			// The job in progress is allowed to finish.
+			time.Sleep(time.Millisecond * 50)
+			close(unblock)
+			assert.NoError(<-removed)
+			assert.Error(h.Remove(ctx))
+
+			job = gokogeri.Job{}
+			job.SetQueue("tenant").SetClass("TestJob")
+			assert.NoError(enqueuer.Enqueue(ctx, &job))
+			time.Sleep(time.Millisecond * 100)
+
+			size, err := gokogeri.NewAdmin(cm).QueueSize(ctx, "tenant")
+			assert.NoError(err)
+			assert.Equal(int64(1), size)
+
+			node.Stop(ctx)
+			wg.Wait()
+			assert.NoError(ctx.Err())
+		})
+	}
+}
+
+func TestPauseQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	admin := gokogeri.NewAdmin(cm)
+	assert.NoError(admin.PauseQueue(ctx, "default"))
+	paused, err := admin.PausedQueues(ctx)
+	assert.NoError(err)
+	assert.Equal([]string{"default"}, paused)
+
+	processed := make(chan string, 2)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.SetPausePollInterval(time.Millisecond * 20)
+	node.PauseQueue("low")
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default", "low"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			processed <- j.Queue()
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	for _, q := range []string{"default", "low"} {
+		job := gokogeri.Job{}
+		job.SetQueue(q).SetClass("TestJob")
+		assert.NoError(enqueuer.Enqueue(ctx, &job))
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	for _, q := range []string{"default", "low"} {
+		size, err := admin.QueueSize(ctx, q)
+		assert.NoError(err)
+		assert.Equal(int64(1), size, q)
+	}
+
+	assert.NoError(admin.ResumeQueue(ctx, "default"))
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case q := <-processed:
+		assert.Equal("default", q)
+	}
+
+	node.ResumeQueue("low")
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case q := <-processed:
+		assert.Equal("low", q)
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+}
+
+func TestPauseShardedQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm1 := redis.NewConnManager(testConfig())
+	defer cm1.Close()
+
+	cfg := testConfig()
+	cfg.URL = "redis://localhost/11"
+	cm2 := redis.NewConnManager(cfg)
+	defer cm2.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm1)
+	flushDB(t, cm2)
+
+	// The queue is paused on the shard that is not the main Redis instance of the Node.
+	admin := gokogeri.NewAdmin(cm2)
+	assert.NoError(admin.PauseQueue(ctx, "default"))
+
+	processed := make(chan string, 1)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm1, 1)
+	node.SetPausePollInterval(time.Millisecond * 20)
+	node.ProcessShardedQueues(
+		[]gokogeri.ConnProvider{cm1, cm2},
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			processed <- j.Class()
+			return nil
+		}),
+		2,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+	job := gokogeri.Job{}
+	job.SetClass("TestJob")
+	assert.NoError(gokogeri.NewEnqueuer(cm2).Enqueue(ctx, &job))
+
+	time.Sleep(time.Millisecond * 100)
+	size, err := admin.QueueSize(ctx, "default")
+	assert.NoError(err)
+	assert.Equal(int64(1), size)
+
+	assert.NoError(admin.ResumeQueue(ctx, "default"))
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case class := <-processed:
+		assert.Equal("TestJob", class)
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+}
+
+func TestCronJobs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	var mu sync.Mutex
+	ticks := make(map[string]int)
+
+	var wg sync.WaitGroup
+	var nodes []*gokogeri.Node
+
+	// Both nodes have the same cron job, but each tick is enqueued once.
+	for i := 0; i < 2; i++ {
+		node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+		err := node.AddCronJob(gokogeri.CronJob{
+			Name:     "every_second",
+			Schedule: "* * * * * *",
+			NewJob: func(tick time.Time) *gokogeri.Job {
+				j := &gokogeri.Job{}
+				j.SetClass("TickJob").SetArgs([]interface{}{tick.Format(time.RFC3339)})
+				return j
+			},
+		})
+		assert.NoError(err)
+		node.ProcessQueues(
+			gokogeri.OrderedQueueSet{"default"},
+			gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+				mu.Lock()
+				ticks[j.Args()[0].(string)]++
+				mu.Unlock()
+				return nil
+			}),
+			1,
+		)
+		nodes = append(nodes, node)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			node.Run()
+		}()
+	}
+
+	time.Sleep(time.Millisecond * 2500)
+
+	for _, node := range nodes {
+		node.Stop(ctx)
+	}
+	wg.Wait()
+	assert.NoError(ctx.Err())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.GreaterOrEqual(len(ticks), 2)
+	for tick, n := range ticks {
+		assert.Equal(1, n, tick)
+	}
+
+	// The leader gives up its lease when it stops.
+	conn, err := cm.Conn(ctx)
+	assert.NoError(err)
+	defer conn.Close()
+	exists, err := redigo.Bool(conn.Do("EXISTS", "cron:leader"))
+	assert.NoError(err)
+	assert.False(exists)
+}
+
+func TestUniqueJobs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	newJob := func(name string, until gokogeri.UniquePolicy) *gokogeri.Job {
+		j := &gokogeri.Job{}
+		j.SetClass("RebuildCache").SetArgs([]interface{}{name}).SetUnique(until, time.Minute)
+		return j
+	}
+	policies := map[string]gokogeri.UniquePolicy{
+		"executing": gokogeri.UniqueUntilExecuting,
+		"executed":  gokogeri.UniqueUntilExecuted,
+		"enqueued":  gokogeri.UniqueUntilEnqueued,
+		"failing":   gokogeri.UniqueUntilExecuted,
+	}
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	for _, name := range []string{"executing", "executed", "enqueued"} {
+		assert.NoError(enqueuer.Enqueue(ctx, newJob(name, policies[name])))
+		assert.Equal(gokogeri.ErrDuplicateJob, enqueuer.Enqueue(ctx, newJob(name, policies[name])))
+	}
+	// Not locked unless scheduled.
+	assert.NoError(enqueuer.Enqueue(ctx, newJob("scheduled", gokogeri.UniqueWhileScheduled)))
+	assert.NoError(enqueuer.Enqueue(ctx, newJob("scheduled", gokogeri.UniqueWhileScheduled)))
+	assert.NoError(enqueuer.Enqueue(ctx, newJob("failing", policies["failing"])))
+
+	started := make(chan string, 8)
+	unblock := make(chan struct{})
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			name := j.Args()[0].(string)
+			started <- name
+			<-unblock
+			if name == "failing" {
+				return errors.New("failed")
+			}
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	// The jobs were pushed on the left and are processed from the right.
+	assert.Equal("executing", <-started)
+	assert.NoError(enqueuer.Enqueue(ctx, newJob("executing", policies["executing"])))
+	unblock <- struct{}{}
+
+	assert.Equal("executed", <-started)
+	assert.Equal(gokogeri.ErrDuplicateJob, enqueuer.Enqueue(ctx, newJob("executed", policies["executed"])))
+	unblock <- struct{}{}
+
+	assert.Equal("enqueued", <-started)
+	assert.NoError(enqueuer.Enqueue(ctx, newJob("executed", policies["executed"])))
+	assert.NoError(enqueuer.Enqueue(ctx, newJob("enqueued", policies["enqueued"])))
+	unblock <- struct{}{}
+
+	assert.Equal("scheduled", <-started)
+	unblock <- struct{}{}
+	assert.Equal("scheduled", <-started)
+	unblock <- struct{}{}
+	assert.Equal("failing", <-started)
+	unblock <- struct{}{}
+
+	// A job that failed keeps the lock of UniqueUntilExecuted while it is retried.
+	assert.Equal("executing", <-started)
+	assert.Equal(gokogeri.ErrDuplicateJob, enqueuer.Enqueue(ctx, newJob("failing", policies["failing"])))
+
+	close(unblock)
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+}
+
+func TestScheduledJobs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	newJob := func() *gokogeri.Job {
+		j := &gokogeri.Job{}
+		j.SetClass("SendReminder").SetUnique(gokogeri.UniqueWhileScheduled, time.Minute)
+		return j
+	}
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	assert.NoError(enqueuer.EnqueueAt(ctx, newJob(), time.Now().Add(-time.Second)))
+	assert.Equal(gokogeri.ErrDuplicateJob, enqueuer.EnqueueIn(ctx, newJob(), time.Hour))
+
+	admin := gokogeri.NewAdmin(cm)
+	size, err := admin.SetSize(ctx, gokogeri.ScheduleSet)
+	assert.NoError(err)
+	assert.Equal(int64(1), size)
+
+	processed := make(chan *gokogeri.Job, 1)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.SetSchedulePollInterval(time.Millisecond * 20)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			processed <- j
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case j := <-processed:
+		assert.Equal("SendReminder", j.Class())
+		assert.WithinDuration(time.Now(), j.EnqueuedAt(), time.Second)
+	}
+
+	// The lock was released when the job was pushed to its queue.
+	assert.NoError(enqueuer.EnqueueIn(ctx, newJob(), time.Hour))
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+}
+
+func TestBatches(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	newJob := func(class string) *gokogeri.Job {
+		j := &gokogeri.Job{}
+		j.SetClass(class)
+		return j
+	}
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	parent, err := enqueuer.NewBatch(ctx, gokogeri.BatchOptions{
+		Description: "Import",
+		OnComplete:  newJob("ImportComplete"),
+		OnSuccess:   newJob("ImportSuccess"),
+	})
+	assert.NoError(err)
+
+	child, err := enqueuer.NewBatch(ctx, gokogeri.BatchOptions{
+		OnSuccess: newJob("ChildSuccess"),
+		Parent:    parent.ID(),
+	})
+	assert.NoError(err)
+
+	failing := newJob("ImportRow")
+	assert.NoError(parent.Enqueue(ctx, failing))
+	assert.Equal(parent.ID(), failing.BatchID())
+	assert.NoError(child.Enqueue(ctx, newJob("ImportRow")))
+	assert.NoError(child.Commit(ctx))
+	assert.NoError(parent.Commit(ctx))
+
+	processed := make(chan *gokogeri.Job, 10)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			processed <- j
+			if j.ID() == failing.ID() {
+				return fmt.Errorf("invalid row")
+			}
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	var classes []string
+	for len(classes) < 4 {
+		select {
+		case <-ctx.Done():
+			assert.NoError(ctx.Err()) // fail on timeout
+		case j := <-processed:
+			classes = append(classes, j.Class())
+		}
+	}
+	assert.ElementsMatch([]string{"ImportRow", "ImportRow", "ChildSuccess", "ImportComplete"}, classes)
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+	assert.Len(processed, 0)
+
+	status, err := gokogeri.NewAdmin(cm).BatchStatus(ctx, parent.ID())
+	assert.NoError(err)
+	assert.Equal("Import", status.Description)
+	assert.Equal(int64(2), status.Total)
+	assert.Equal(int64(0), status.Pending)
+	assert.Equal([]string{failing.ID()}, status.Failed)
+	assert.True(status.Committed)
+	assert.WithinDuration(time.Now(), status.CompletedAt, time.Second)
+	assert.True(status.SucceededAt.IsZero())
+
+	_, err = gokogeri.NewAdmin(cm).BatchStatus(ctx, "missing")
+	assert.Equal(gokogeri.ErrBatchNotFound, err)
+}
+
+func TestWorkflows(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	newJob := func(class string) *gokogeri.Job {
+		j := &gokogeri.Job{}
+		j.SetClass(class)
+		return j
+	}
+
+	w := gokogeri.NewWorkflow()
+	w.Add("extract", newJob("Extract"))
+	w.Add("transform_a", newJob("Transform"), "extract")
+	w.Add("transform_b", newJob("Transform"), "extract")
+	w.Add("load", newJob("Load"), "transform_a", "transform_b")
+	w.Add("audit", newJob("Fail"))
+	w.Then("notify", newJob("Notify"))
+	w.Then("archive", newJob("Archive"))
+	w.Add("optional", newJob("Fail")).AllowFailure()
+	w.Then("cleanup", newJob("Cleanup"))
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	wid, err := enqueuer.EnqueueWorkflow(ctx, w)
+	assert.NoError(err)
+
+	processed := make(chan string, 10)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			id, step := j.Workflow()
+			if id != wid {
+				return fmt.Errorf("unexpected workflow %s", id)
+			}
+			processed <- step
+			if j.Class() == "Fail" {
+				return fmt.Errorf("failed")
+			}
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	var steps []string
+	for len(steps) < 7 {
+		select {
+		case <-ctx.Done():
+			assert.NoError(ctx.Err()) // fail on timeout
+		case step := <-processed:
+			steps = append(steps, step)
+		}
+	}
+	assert.ElementsMatch([]string{"extract", "transform_a", "transform_b", "load", "audit", "optional", "cleanup"},
+		steps)
+	index := make(map[string]int)
+	for i, step := range steps {
+		index[step] = i
+	}
+	assert.Less(index["extract"], index["transform_a"])
+	assert.Less(index["extract"], index["transform_b"])
+	assert.Less(index["transform_a"], index["load"])
+	assert.Less(index["transform_b"], index["load"])
+
+	admin := gokogeri.NewAdmin(cm)
+	var status *gokogeri.WorkflowStatus
+	for status == nil || status.Status == "" {
+		status, err = admin.WorkflowStatus(ctx, wid)
+		assert.NoError(err)
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+	assert.Len(processed, 0)
+
+	assert.Equal(gokogeri.StepFailed, status.Status)
+	assert.WithinDuration(time.Now(), status.FinishedAt, time.Second)
+	assert.Equal(map[string]string{
+		"extract":     gokogeri.StepSucceeded,
+		"transform_a": gokogeri.StepSucceeded,
+		"transform_b": gokogeri.StepSucceeded,
+		"load":        gokogeri.StepSucceeded,
+		"audit":       gokogeri.StepFailed,
+		"notify":      gokogeri.StepCancelled,
+		"archive":     gokogeri.StepCancelled,
+		"optional":    gokogeri.StepFailed,
+		"cleanup":     gokogeri.StepSucceeded,
+	}, status.Steps)
+
+	w = gokogeri.NewWorkflow()
+	w.Add("a", newJob("A"), "b")
+	w.Add("b", newJob("B"), "a")
+	_, err = enqueuer.EnqueueWorkflow(ctx, w)
+	assert.Error(err)
+
+	// A workflow whose first steps cannot all be enqueued is deleted.
+	conn, err := cm.Conn(ctx)
+	assert.NoError(err)
+	defer conn.Close()
+	_, err = conn.Do("SET", "queue:broken", "not a list")
+	assert.NoError(err)
+
+	w = gokogeri.NewWorkflow()
+	w.Add("a", newJob("A"))
+	w.Add("b", newJob("B").SetQueue("broken"))
+	wid, err = enqueuer.EnqueueWorkflow(ctx, w)
+	assert.Error(err)
+	assert.NotEmpty(wid)
+	_, err = admin.WorkflowStatus(ctx, wid)
+	assert.Equal(gokogeri.ErrWorkflowNotFound, err)
+
+	// The other step was enqueued anyway.
+	size, err := admin.QueueSize(ctx, "default")
+	assert.NoError(err)
+	assert.EqualValues(1, size)
+	assert.NoError(admin.ClearQueue(ctx, "default"))
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	for _, account := range []string{"a", "a", "b"} {
+		j := &gokogeri.Job{}
+		j.SetClass("CallPartner").SetArgs([]interface{}{account})
+		assert.NoError(enqueuer.Enqueue(ctx, j))
+	}
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	started := make(chan string, 3)
+	unblock := make(chan struct{})
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.SetSchedulePollInterval(time.Millisecond * 20)
+	assert.NoError(node.AddConcurrencyLimit(gokogeri.ConcurrencyLimit{
+		Name:  "partner",
+		Class: "CallPartner",
+		Key: func(j *gokogeri.Job) string {
+			return j.Args()[0].(string)
+		},
+		Limit: 1,
+		Backoff: func(int) time.Duration {
+			return time.Millisecond * 50
+		},
+	}))
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			account := j.Args()[0].(string)
+			mu.Lock()
+			running[account]++
+			n := running[account]
+			mu.Unlock()
+			if n > 1 {
+				return fmt.Errorf("over the limit")
+			}
+
+			started <- account
+			<-unblock
+
+			mu.Lock()
+			running[account]--
+			mu.Unlock()
+			return nil
+		}),
+		3,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	// One job of each account runs, and the other job of account a is rescheduled.
+	accounts := []string{<-started, <-started}
+	assert.ElementsMatch([]string{"a", "b"}, accounts)
+
+	admin := gokogeri.NewAdmin(cm)
+	for {
+		size, err := admin.SetSize(ctx, gokogeri.ScheduleSet)
+		assert.NoError(err)
+		if size > 0 {
+			break
+		}
+	}
+	assert.Len(started, 0)
+
+	close(unblock)
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case account := <-started:
+		assert.Equal("a", account)
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+
+	conn, err := cm.Conn(ctx)
+	assert.NoError(err)
+	defer conn.Close()
+	n, err := redigo.Int(conn.Do("ZCARD", "concurrency:partner:a"))
+	assert.NoError(err)
+	assert.Zero(n)
+}
+
+func TestConcurrencyLeaseRenewal(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	j := &gokogeri.Job{}
+	j.SetClass("Export")
+	assert.NoError(gokogeri.NewEnqueuer(cm).Enqueue(ctx, j))
+
+	started := make(chan time.Time, 1)
+	unblock := make(chan struct{})
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	assert.NoError(node.AddConcurrencyLimit(gokogeri.ConcurrencyLimit{
+		Name:     "export",
+		Limit:    1,
+		LeaseTTL: time.Second,
+	}))
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			started <- time.Now()
+			<-unblock
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	var start time.Time
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case start = <-started:
+	}
+
+	// The lease is renewed every third of its TTL, and so is the TTL of the set that holds it.
+	time.Sleep(time.Millisecond * 800)
+
+	conn, err := cm.Conn(ctx)
+	assert.NoError(err)
+	defer conn.Close()
+
+	expires, err := redigo.Int64(conn.Do("ZSCORE", "concurrency:export", j.ID()))
+	assert.NoError(err)
+	assert.Greater(expires, start.Add(time.Second).UnixMilli())
+	ttl, err := redigo.Int64(conn.Do("PTTL", "concurrency:export"))
+	assert.NoError(err)
+	assert.Greater(ttl, int64(0))
+
+	close(unblock)
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+
+	n, err := redigo.Int(conn.Do("ZCARD", "concurrency:export"))
+	assert.NoError(err)
+	assert.Zero(n, "released")
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	for _, strategy := range []gokogeri.RateStrategy{
+		gokogeri.FixedWindow,
+		gokogeri.SlidingWindow,
+		gokogeri.TokenBucket,
+	} {
+		limiter, err := gokogeri.NewRateLimiter(cm, gokogeri.RateLimit{
+			Name:     fmt.Sprintf("partner%d", strategy),
+			Strategy: strategy,
+			Limit:    2,
+			Period:   time.Hour,
+		})
+		assert.NoError(err)
+
+		for i := 0; i < 2; i++ {
+			delay, err := limiter.Allow(ctx, "a")
+			assert.NoError(err)
+			assert.Zero(delay, "strategy %d", strategy)
+		}
+		delay, err := limiter.Allow(ctx, "a")
+		assert.NoError(err)
+		assert.Greater(delay, time.Duration(0), "strategy %d", strategy)
+		assert.LessOrEqual(delay, time.Hour, "strategy %d", strategy)
+
+		// Every key has its own limit.
+		assert.NoError(limiter.Check(ctx, "b"))
+
+		var rescheduled *gokogeri.RescheduleError
+		assert.True(errors.As(limiter.Check(ctx, "a"), &rescheduled))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	for _, class := range []string{"CallPartner", "CallPartner", "Retry"} {
+		j := &gokogeri.Job{}
+		j.SetClass(class)
+		assert.NoError(enqueuer.Enqueue(ctx, j))
+	}
+
+	processed := make(chan string, 5)
+	var tries int32
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.SetSchedulePollInterval(time.Millisecond * 20)
+	assert.NoError(node.AddRateLimit(gokogeri.RateLimit{
+		Name:     "partner",
+		Class:    "CallPartner",
+		Strategy: gokogeri.TokenBucket,
+		Limit:    1,
+		Period:   time.Millisecond * 300,
+	}))
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			if j.Class() == "Retry" && atomic.AddInt32(&tries, 1) == 1 {
+				return gokogeri.Reschedule(time.Millisecond)
+			}
+			processed <- j.Class()
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	start := time.Now()
+	var classes []string
+	for len(classes) < 3 {
+		select {
+		case <-ctx.Done():
+			assert.NoError(ctx.Err()) // fail on timeout
+		case class := <-processed:
+			classes = append(classes, class)
+		}
+	}
+	assert.ElementsMatch([]string{"CallPartner", "CallPartner", "Retry"}, classes)
+	assert.GreaterOrEqual(time.Since(start), time.Millisecond*300)
+	assert.Equal(int32(2), atomic.LoadInt32(&tries))
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+
+	stats, err := gokogeri.NewAdmin(cm).Stats(ctx)
+	assert.NoError(err)
+	assert.Zero(stats.Failed)
+}
+
+func TestExpiredJobs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	expired := &gokogeri.Job{}
+	expired.SetClass("Notify").SetExpiresAt(time.Now().Add(-time.Second))
+	expired.SetUnique(gokogeri.UniqueUntilExecuted, time.Hour)
+	fresh := &gokogeri.Job{}
+	fresh.SetClass("Notify").SetArgs([]interface{}{"fresh"}).SetExpiresIn(time.Hour)
+	scheduled := &gokogeri.Job{}
+	scheduled.SetClass("Notify").SetExpiresIn(time.Minute)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	assert.NoError(enqueuer.Enqueue(ctx, expired))
+	assert.NoError(enqueuer.Enqueue(ctx, fresh))
+	assert.NoError(enqueuer.EnqueueIn(ctx, scheduled, time.Hour))
+	assert.WithinDuration(time.Now().Add(time.Hour+time.Minute), scheduled.ExpiresAt(), time.Second)
+
+	processed := make(chan *gokogeri.Job, 2)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.SetKeepExpiredJobs(true)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			processed <- j
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	select {
+	case <-ctx.Done():
+		assert.NoError(ctx.Err()) // fail on timeout
+	case j := <-processed:
+		assert.Equal(fresh.ID(), j.ID())
+	}
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+	assert.Len(processed, 0)
+
+	dead, err := gokogeri.NewAdmin(cm).PeekSet(ctx, gokogeri.DeadSet, 0, 10)
+	assert.NoError(err)
+	assert.Len(dead, 1)
+	assert.Equal(expired.ID(), dead[0].Job.ID())
+	assert.Contains(string(dead[0].Payload), `"error_class":"Gokogeri::JobExpired"`)
+
+	// The unique lock was released.
+	assert.NoError(enqueuer.Enqueue(ctx, expired))
+}
+
+func TestCancelJob(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	newJob := func(class string) *gokogeri.Job {
+		j := &gokogeri.Job{}
+		j.SetClass(class)
+		return j
+	}
+
+	export := newJob("Export")
+	queued := newJob("Queued")
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	assert.NoError(enqueuer.Enqueue(ctx, export))
+	assert.NoError(enqueuer.Enqueue(ctx, queued))
+
+	admin := gokogeri.NewAdmin(cm)
+	assert.NoError(admin.Cancel(ctx, queued.ID()))
+
+	started := make(chan string, 3)
+	exportErr := make(chan error, 1)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			started <- j.Class()
+			if j.Class() == "Export" {
+				<-ctx.Done()
+				exportErr <- ctx.Err()
+				return ctx.Err()
+			}
+			return nil
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	// The jobs were pushed on the left and are processed from the right.
+	assert.Equal("Export", <-started)
+
+	// The Node may not have subscribed yet.
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
+	for done := false; !done; {
+		assert.NoError(admin.Cancel(ctx, export.ID()))
+		select {
+		case <-ctx.Done():
+			assert.NoError(ctx.Err()) // fail on timeout
+		case err := <-exportErr:
+			assert.Equal(context.Canceled, err)
+			done = true
+		case <-ticker.C:
+		}
+	}
+
+	// The cancelled job in the queue is skipped.
+	assert.NoError(enqueuer.Enqueue(ctx, newJob("Next")))
+	assert.Equal("Next", <-started)
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+	assert.Len(started, 0)
+}
+
+func TestJobStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	report := &gokogeri.Job{}
+	report.SetClass("Report").SetTrackStatus(time.Hour)
+	broken := &gokogeri.Job{}
+	broken.SetClass("Broken").SetTrackStatus(time.Hour)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	assert.NoError(enqueuer.Enqueue(ctx, report))
+	assert.NoError(enqueuer.Enqueue(ctx, broken))
+
+	admin := gokogeri.NewAdmin(cm)
+	status, err := admin.JobStatus(ctx, report.ID())
+	assert.NoError(err)
+	assert.Equal(gokogeri.StatusQueued, status.State)
+
+	_, err = admin.JobStatus(ctx, "missing")
+	assert.Equal(gokogeri.ErrStatusNotFound, err)
+
+	reported := make(chan struct{})
+	unblock := make(chan struct{})
+	done := make(chan string, 2)
+
+	node := gokogeri.NewNode(zerolog.Nop(), cm, 1)
+	node.ProcessQueues(
+		gokogeri.OrderedQueueSet{"default"},
+		gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+			defer func() { done <- j.Class() }()
+			if j.Class() == "Broken" {
+				return fmt.Errorf("broken")
+			}
+
+			err := j.ReportProgress(ctx, 50, "Halfway", map[string]int{"rows": 500})
+			if err != nil {
+				return err
+			}
+			reported <- struct{}{}
+			<-unblock
+			return j.SetResult(ctx, map[string]string{"url": "/reports/1.pdf"})
+		}),
+		1,
+	)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.Run()
+	}()
+
+	<-reported
+	status, err = admin.JobStatus(ctx, report.ID())
+	assert.NoError(err)
+	assert.Equal(gokogeri.StatusRunning, status.State)
+	assert.Equal(50, status.Percent)
+	assert.Equal("Halfway", status.Message)
+	assert.JSONEq(`{"rows":500}`, string(status.Data))
+	assert.WithinDuration(time.Now(), status.StartedAt, time.Second)
+	close(unblock)
+
+	assert.Equal("Report", <-done)
+	assert.Equal("Broken", <-done)
+
+	node.Stop(ctx)
+	wg.Wait()
+	assert.NoError(ctx.Err())
+
+	status, err = admin.JobStatus(ctx, report.ID())
+	assert.NoError(err)
+	assert.Equal(gokogeri.StatusSucceeded, status.State)
+	assert.JSONEq(`{"url":"/reports/1.pdf"}`, string(status.Result))
+	assert.WithinDuration(time.Now(), status.FinishedAt, time.Second)
+
+	status, err = admin.JobStatus(ctx, broken.ID())
+	assert.NoError(err)
+	assert.Equal(gokogeri.StatusFailed, status.State)
+	assert.Equal("broken", status.Error)
+}
+
+func TestPriorityQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cm := redis.NewConnManager(testConfig())
+	defer cm.Close()
+
+	assert := require.New(t)
+	flushDB(t, cm)
+
+	enqueuer := gokogeri.NewEnqueuer(cm)
+	enqueue := func(name string, priority *int) {
+		j := &gokogeri.Job{}
+		j.SetClass("Report").SetArgs([]interface{}{name})
+		if priority != nil {
+			j.SetPriority(*priority)
+		}
+		assert.NoError(enqueuer.Enqueue(ctx, j))
+	}
+	priority := func(p int) *int {
+		return &p
+	}
+
+	enqueue("plain 1", nil)
+	enqueue("low", priority(-2))
+	enqueue("normal 1", priority(0))
+	enqueue("high", priority(5))
+	enqueue("normal 2", priority(0))
+	enqueue("plain 2", nil)
+
+	admin := gokogeri.NewAdmin(cm)
+	size, err := admin.QueueSize(ctx, "default")
+	assert.NoError(err)
+	assert.EqualValues(6, size)
+
+	// The jobs with a priority are taken first, by priority, then in order, and then the jobs without one.
+	want := []string{"high", "normal 1", "normal 2", "low", "plain 1", "plain 2"}
+
+	var buf bytes.Buffer
+	n, err := admin.ExportQueue(ctx, "default", &buf)
+	assert.NoError(err)
+	assert.Equal(6, n)
+	export := buf.String()
+	for i, line := range strings.Split(strings.TrimSpace(export), "\n") {
+		assert.Contains(line, fmt.Sprintf(`"args":["%s"]`, want[i]))
+	}
+
+	run := func(count, batchSize int) []string {
+		processed := make(chan string, count)
+
+		node := gokogeri.NewNode(zerolog.Nop(), cm, 2)
+		node.SetBatchSize(batchSize)
+		node.SetPrefetch(batchSize - 1)
+		node.ProcessQueues(
+			gokogeri.OrderedQueueSet{"default"},
+			gokogeri.WorkerFunc(func(ctx context.Context, j *gokogeri.Job) error {
+				processed <- j.Args()[0].(string)
+				return nil
+			}),
+			1,
+		)
+
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			node.Run()
+		}()
+
+		var order []string
+		for len(order) < count {
+			select {
+			case <-ctx.Done():
+				assert.NoError(ctx.Err()) // fail on timeout
+			case name := <-processed:
+				order = append(order, name)
+			}
+		}
+
+		node.Stop(ctx)
+		wg.Wait()
+		assert.NoError(ctx.Err())
+		return order
+	}
+
+	conn, err := cm.Conn(ctx)
+	assert.NoError(err)
+	defer conn.Close()
+
+	// Sidekiq processes only see the jobs without a priority.
+	n, err = redigo.Int(conn.Do("LLEN", "queue:default"))
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	assert.Equal(want, run(6, 1))
+
+	size, err = admin.QueueSize(ctx, "default")
+	assert.NoError(err)
+	assert.Zero(size)
+
+	// An exported queue keeps its order when imported, also when it is fetched in batches.
+	n, err = admin.Import(ctx, strings.NewReader(export), gokogeri.ImportOptions{})
+	assert.NoError(err)
+	assert.Equal(6, n)
+	assert.Equal(want, run(6, 3))
+
+	// A node blocked on the empty queue is woken up by a job with a priority.
+	late := &gokogeri.Job{}
+	late.SetClass("Report").SetArgs([]interface{}{"late"}).SetPriority(1)
+	timer := time.AfterFunc(time.Millisecond*200, func() {
+		_ = enqueuer.Enqueue(ctx, late)
+	})
+	defer timer.Stop()
+	start := time.Now()
+	assert.Equal([]string{"late"}, run(1, 1))
+	assert.Less(time.Since(start), time.Second)
+	n, err = redigo.Int(conn.Do("EXISTS", "queue:default:priority:wake"))
+	assert.NoError(err)
+	assert.Zero(n)
+
+	j := &gokogeri.Job{}
+	j.SetClass("Report").SetPriority(gokogeri.MaxPriority + 1)
+	assert.Error(enqueuer.Enqueue(ctx, j))
+
+	enqueue("cleared", priority(1))
+	assert.NoError(admin.ClearQueue(ctx, "default"))
+	exists, err := redigo.Int(conn.Do("EXISTS", "queue:default:priority"))
+	assert.NoError(err)
+	assert.Zero(exists)
+}
+
+func flushDB(t *testing.T, cm *redis.ConnManager) {
+	conn, err := cm.Conn(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Do("FLUSHDB")
+	require.NoError(t, err)
+}
+
 func testConfig() *redis.Config {
 	cfg := redis.NewDefaultConfig()
 	cfg.URL = "redis://localhost/10"
@@ -0,0 +1,2 @@
+// Package cron parses cron expressions and computes the times at which they are due.
+package cron
@@ -0,0 +1,70 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"x * * * *",
+	} {
+		_, err := Parse(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		spec string
+		from string
+		loc  *time.Location
+		next string
+	}{
+		{"* * * * * *", "2024-03-01T10:00:00Z", time.UTC, "2024-03-01T10:00:01Z"},
+		{"*/15 * * * * *", "2024-03-01T10:00:14.5Z", time.UTC, "2024-03-01T10:00:15Z"},
+		{"* * * * *", "2024-03-01T10:00:30Z", time.UTC, "2024-03-01T10:01:00Z"},
+		{"30 9 * * mon-fri", "2024-03-01T10:00:00Z", time.UTC, "2024-03-04T09:30:00Z"},
+		{"0 0 1 jan *", "2024-03-01T10:00:00Z", time.UTC, "2025-01-01T00:00:00Z"},
+		{"@hourly", "2024-03-01T10:59:59Z", time.UTC, "2024-03-01T11:00:00Z"},
+		{"0 8-18/2 * * *", "2024-03-01T10:00:00Z", time.UTC, "2024-03-01T12:00:00Z"},
+		{"0 12 29 2 *", "2024-03-01T10:00:00Z", time.UTC, "2028-02-29T12:00:00Z"},
+		// Either the day of the month or the day of the week.
+		{"0 0 15 * sun", "2024-03-01T10:00:00Z", time.UTC, "2024-03-03T00:00:00Z"},
+		{"0 0 * * 7", "2024-03-01T10:00:00Z", time.UTC, "2024-03-03T00:00:00Z"},
+		// In the local time, across the change to daylight saving time on 2024-03-10.
+		{"0 9 * * *", "2024-03-09T15:00:00Z", ny, "2024-03-10T13:00:00Z"},
+		{"0 0 31 2 *", "2024-03-01T10:00:00Z", time.UTC, ""},
+	} {
+		s, err := Parse(tc.spec)
+		require.NoError(t, err, tc.spec)
+
+		from, err := time.Parse(time.RFC3339Nano, tc.from)
+		require.NoError(t, err)
+
+		next := s.Next(from.In(tc.loc))
+		if tc.next == "" {
+			require.True(t, next.IsZero(), tc.spec)
+			continue
+		}
+		want, err := time.Parse(time.RFC3339, tc.next)
+		require.NoError(t, err)
+		require.True(t, want.Equal(next), "%s: want %v, got %v", tc.spec, want, next.UTC())
+		require.Equal(t, tc.loc, next.Location())
+	}
+}
@@ -38,3 +38,12 @@ func CheckReplies(replies []interface{}, expect int) error {
 	}
 	return nil
 }
+
+// Int64 converts a reply to an integer. Unlike redis.Int64, it treats a nil reply, such as the one GET returns for a
+// missing key, as 0.
+func Int64(reply interface{}) (int64, error) {
+	if reply == nil {
+		return 0, nil
+	}
+	return redis.Int64(reply, nil)
+}
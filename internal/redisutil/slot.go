@@ -0,0 +1,42 @@
+package redisutil
+
+import "strings"
+
+// SlotCount is the number of hash slots in a Redis Cluster.
+const SlotCount = 16384
+
+// HashSlot returns the Redis Cluster hash slot of the key. If the key contains a hash tag, only the tag is hashed, as
+// described in the Redis Cluster specification.
+func HashSlot(key string) int {
+	return int(crc16(HashTag(key))) % SlotCount
+}
+
+// HashTag returns the part of the key that determines its hash slot: the content of the first non-empty pair of braces,
+// or the whole key.
+func HashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// crc16 implements CRC16-CCITT (XMODEM), which is the variant used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,24 @@
+package redisutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashSlot(t *testing.T) {
+	assert := require.New(t)
+
+	// The test vector from the Redis Cluster specification.
+	assert.Equal(uint16(0x31C3), crc16("123456789"))
+	assert.Equal(12739, HashSlot("123456789"))
+
+	assert.Equal(HashSlot("user1000"), HashSlot("{user1000}.following"))
+	assert.Equal(HashSlot("user1000"), HashSlot("foo{user1000}{bar}"))
+	assert.Equal(HashSlot("{}user1000"), HashSlot("{}user1000"))
+	assert.NotEqual(HashSlot("user1000"), HashSlot("{}user1000"))
+
+	assert.Equal("user1000", HashTag("{user1000}.following"))
+	assert.Equal("foo{}bar", HashTag("foo{}bar"))
+	assert.Equal("foo{bar", HashTag("foo{bar"))
+}
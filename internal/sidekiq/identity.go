@@ -0,0 +1,23 @@
+package sidekiq
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Identity returns a string that uniquely identifies a process, in the same format as Sidekiq: hostname, PID and a
+// random nonce, separated by colons.
+func Identity() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("get hostname: %v", err)
+	}
+	b := make([]byte, 6)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("rand.Read: %v", err)
+	}
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(b)), nil
+}
@@ -18,6 +18,24 @@ type redisJob struct {
 	JobID      string  `json:"jid"`
 	CreatedAt  float64 `json:"created_at"`
 	EnqueuedAt float64 `json:"enqueued_at"`
+	ExpiresAt  float64 `json:"expires_at,omitempty"`
+
+	BatchID      string `json:"bid,omitempty"`
+	WorkflowID   string `json:"wid,omitempty"`
+	WorkflowStep string `json:"wstep,omitempty"`
+
+	// Limited is the number of times the job was rescheduled, because it was over a limit or returned a
+	// RescheduleError.
+	Limited int `json:"limited,omitempty"`
+
+	// Priority, if set, orders the job within its queue.
+	Priority *int `json:"priority,omitempty"`
+
+	StatusTTL int64 `json:"status_ttl,omitempty"` // seconds
+
+	UniqueFor   int64        `json:"unique_for,omitempty"` // seconds
+	UniqueUntil UniquePolicy `json:"unique_until,omitempty"`
+	UniqueKey   string       `json:"unique_key,omitempty"`
 }
 
 type Job struct {
@@ -25,8 +43,14 @@ type Job struct {
 
 	createdAt  time.Time
 	enqueuedAt time.Time
+	expiresIn  time.Duration
 
 	customRetryPolicy bool
+
+	shardKey string
+
+	// reporter is set while a worker processes the job.
+	reporter *statusReporter
 }
 
 func newJobFromJSON(data []byte) (*Job, error) {
@@ -35,11 +59,22 @@ func newJobFromJSON(data []byte) (*Job, error) {
 	if err != nil {
 		return nil, fmt.Errorf("decoding job json: %v", err)
 	}
-	job.createdAt = sidekiq.ToTime(job.enc.CreatedAt)
-	job.enqueuedAt = sidekiq.ToTime(job.enc.EnqueuedAt)
+	if job.enc.CreatedAt != 0 {
+		job.createdAt = sidekiq.ToTime(job.enc.CreatedAt)
+	}
+	if job.enc.EnqueuedAt != 0 {
+		job.enqueuedAt = sidekiq.ToTime(job.enc.EnqueuedAt)
+	}
 	return job, nil
 }
 
+// ParseJob decodes a job from the JSON representation used in Redis by gokogeri and Sidekiq.
+//
+// Fields that are missing from the JSON get their default values when the job is enqueued.
+func ParseJob(data []byte) (*Job, error) {
+	return newJobFromJSON(data)
+}
+
 func (j *Job) ID() string {
 	return j.enc.JobID
 }
@@ -90,6 +125,39 @@ func (j *Job) EnqueuedAt() time.Time {
 	return j.enqueuedAt
 }
 
+// ExpiresAt returns the time after which the job is discarded instead of processed. It is zero if the job does not
+// expire, or if it expires relative to when it is enqueued and has not been enqueued yet.
+func (j *Job) ExpiresAt() time.Time {
+	if j.enc.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return sidekiq.ToTime(j.enc.ExpiresAt)
+}
+
+// SetExpiresAt makes the job expire at the given time. A job that is dequeued after it has expired is not processed.
+// The zero time means that the job does not expire.
+func (j *Job) SetExpiresAt(t time.Time) *Job {
+	j.expiresIn = 0
+	j.enc.ExpiresAt = 0
+	if !t.IsZero() {
+		j.enc.ExpiresAt = sidekiq.Time(t)
+	}
+	return j
+}
+
+// SetExpiresIn makes the job expire after the given duration, counted from when it is enqueued, or from when it is
+// due if it is scheduled. Zero means that the job does not expire.
+func (j *Job) SetExpiresIn(d time.Duration) *Job {
+	j.enc.ExpiresAt = 0
+	j.expiresIn = d
+	return j
+}
+
+// expired reports whether the job has expired at the given time.
+func (j *Job) expired(now time.Time) bool {
+	return j.enc.ExpiresAt != 0 && sidekiq.ToTime(j.enc.ExpiresAt).Before(now)
+}
+
 // Retry reports whether the job should be retried if it fails.
 func (j *Job) Retry() bool {
 	return j.enc.Retry.ok
@@ -121,6 +189,84 @@ func (j *Job) SetRetryTimes(n int) *Job {
 	return j
 }
 
+// Unique returns the uniqueness policy of the job and the maximum lifetime of its lock, or zero if the job is not
+// unique.
+func (j *Job) Unique() (UniquePolicy, time.Duration) {
+	return j.enc.UniqueUntil, time.Duration(j.enc.UniqueFor) * time.Second
+}
+
+// SetUnique makes the Enqueuer reject a job while an equal one holds the lock, until the lock is released according to
+// the policy or the lifetime expires, in whole seconds. Jobs are equal if they have the same class, queue and
+// arguments, unless the Enqueuer has a custom key function. A zero lifetime makes the job not unique. The Enqueuer
+// returns an error for a policy other than UniqueWhileScheduled, UniqueUntilEnqueued, UniqueUntilExecuting and
+// UniqueUntilExecuted.
+func (j *Job) SetUnique(until UniquePolicy, lifetime time.Duration) *Job {
+	j.enc.UniqueUntil = until
+	j.enc.UniqueFor = int64(lifetime / time.Second)
+	if j.enc.UniqueFor <= 0 {
+		j.enc.UniqueUntil = ""
+		j.enc.UniqueFor = 0
+	}
+	return j
+}
+
+// TrackStatus returns how long the status of the job is kept after it was last updated, if it records its status.
+func (j *Job) TrackStatus() time.Duration {
+	return time.Duration(j.enc.StatusTTL) * time.Second
+}
+
+// SetTrackStatus makes the job record its state in Redis, from when it is enqueued until it is done, where
+// Admin.JobStatus can read it along with the progress and result reported by the worker. The status is kept for the
+// TTL, in whole seconds, after it was last updated. Zero disables it.
+func (j *Job) SetTrackStatus(ttl time.Duration) *Job {
+	j.enc.StatusTTL = int64(ttl / time.Second)
+	if j.enc.StatusTTL < 0 {
+		j.enc.StatusTTL = 0
+	}
+	return j
+}
+
+// Priority returns the priority of the job within its queue, and whether it has one.
+func (j *Job) Priority() (int, bool) {
+	if j.enc.Priority == nil {
+		return 0, false
+	}
+	return *j.enc.Priority, true
+}
+
+// SetPriority makes the job wait in the priority set of its queue, where the jobs with a higher priority are taken
+// first, and jobs of the same priority in the order in which they were enqueued. The minimum allowed value is
+// MinPriority and the maximum MaxPriority. The Enqueuer returns an error for a value outside of that range.
+//
+// A queue can also hold jobs without a priority, in its list. They are taken once the priority set of the queue is
+// empty. Sidekiq processes do not read the priority sets, so they never see the jobs with a priority.
+func (j *Job) SetPriority(p int) *Job {
+	j.enc.Priority = &p
+	return j
+}
+
+// BatchID returns the ID of the batch that the job belongs to, if any.
+func (j *Job) BatchID() string {
+	return j.enc.BatchID
+}
+
+// Workflow returns the ID of the workflow that the job belongs to, and the name of its step, if any.
+func (j *Job) Workflow() (id, step string) {
+	return j.enc.WorkflowID, j.enc.WorkflowStep
+}
+
+// ShardKey returns the key used to choose the shard of the job, if any.
+func (j *Job) ShardKey() string {
+	return j.shardKey
+}
+
+// SetShardKey configures the key used by Shards to choose the Redis instance where the job is stored, for example a
+// customer ID. The key is not stored with the job. Without a key, the job goes to the shard of its queue.
+func (j *Job) SetShardKey(key string) *Job {
+	j.shardKey = key
+	return j
+}
+
 func (j *Job) setDefaults() error {
 	if j.enc.Queue == "" {
 		j.enc.Queue = "default"
@@ -135,6 +281,10 @@ func (j *Job) setDefaults() error {
 	}
 	j.enc.CreatedAt = sidekiq.Time(j.createdAt)
 
+	if j.expiresIn > 0 {
+		j.enc.ExpiresAt = sidekiq.Time(now.Add(j.expiresIn))
+	}
+
 	var err error
 
 	if j.enc.JobID == "" {
@@ -266,4 +266,94 @@ func TestJobEncode(t *testing.T) {
 		assert.False(jsonJob.Retry())
 		assert.Equal(0, jsonJob.RetryTimes())
 	})
+
+	t.Run("SetUnique", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		var job Job
+		job.SetUnique(UniqueUntilExecuted, time.Minute+time.Millisecond)
+
+		enc, err := job.encode()
+		assert.NoError(err)
+
+		var encoding map[string]interface{}
+		err = json.Unmarshal(enc, &encoding)
+		assert.NoError(err, "unmarshal")
+		assert.Equal(float64(60), encoding["unique_for"])
+		assert.Equal("success", encoding["unique_until"])
+
+		jsonJob, err := newJobFromJSON(enc)
+		assert.NoError(err)
+		until, lifetime := jsonJob.Unique()
+		assert.Equal(UniqueUntilExecuted, until)
+		assert.Equal(time.Minute, lifetime)
+
+		job.SetUnique(UniqueUntilExecuted, time.Millisecond)
+		until, lifetime = job.Unique()
+		assert.Equal(UniquePolicy(""), until)
+		assert.Zero(lifetime)
+	})
+
+	t.Run("SetExpiresIn and SetExpiresAt", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		var job Job
+		job.SetExpiresIn(time.Hour)
+		assert.True(job.ExpiresAt().IsZero(), "not enqueued yet")
+
+		err := job.setDefaults()
+		assert.NoError(err, "setDefaults")
+		assert.WithinDuration(time.Now().Add(time.Hour), job.ExpiresAt(), time.Second)
+		assert.False(job.expired(time.Now()))
+		assert.True(job.expired(time.Now().Add(time.Hour + time.Second)))
+
+		expiresAt := time.Unix(1669852800, 0)
+		job.SetExpiresAt(expiresAt)
+		err = job.setDefaults()
+		assert.NoError(err, "setDefaults")
+
+		enc, err := job.encode()
+		assert.NoError(err)
+		jsonJob, err := newJobFromJSON(enc)
+		assert.NoError(err)
+		assert.Equal(expiresAt, jsonJob.ExpiresAt())
+		assert.True(jsonJob.expired(time.Now()))
+
+		job.SetExpiresAt(time.Time{})
+		assert.True(job.ExpiresAt().IsZero())
+		assert.False(job.expired(time.Now()))
+	})
+
+	t.Run("SetPriority", func(t *testing.T) {
+		t.Parallel()
+
+		assert := require.New(t)
+
+		var job Job
+		_, ok := job.Priority()
+		assert.False(ok)
+
+		job.SetPriority(-3)
+		err := job.setDefaults()
+		assert.NoError(err, "setDefaults")
+
+		enc, err := job.encode()
+		assert.NoError(err)
+		assert.Contains(string(enc), `"priority":-3`)
+		jsonJob, err := newJobFromJSON(enc)
+		assert.NoError(err)
+		p, ok := jsonJob.Priority()
+		assert.True(ok)
+		assert.Equal(-3, p)
+
+		var zero Job
+		zero.SetPriority(0)
+		enc, err = zero.encode()
+		assert.NoError(err)
+		assert.Contains(string(enc), `"priority":0`, "zero is a priority")
+	})
 }
@@ -0,0 +1,177 @@
+package gokogeri
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+)
+
+// keyspace builds the Redis keys, in the same layout as Sidekiq. With a namespace, every key is prefixed by the
+// namespace and a colon, as with the redis-namespace gem used by older Sidekiq applications.
+//
+// With Redis Cluster, the name in a queue key is wrapped in a hash tag, as in "queue:{default}", so that the queues are
+// spread across the nodes, but every queue stays in one slot. A name that already contains a hash tag is used as is,
+// which allows placing related queues in the same slot, for example "{billing}high" and "{billing}low".
+type keyspace struct {
+	prefix  string
+	cluster bool
+}
+
+func newKeyspace(namespace string, cluster bool) keyspace {
+	k := keyspace{cluster: cluster}
+	if namespace != "" {
+		k.prefix = namespace + ":"
+	}
+	return k
+}
+
+// newKeyspaceFor returns the keyspace used with the connections of the provider.
+func newKeyspaceFor(cp ConnProvider) keyspace {
+	var namespace string
+	if ns, ok := cp.(namespacer); ok {
+		namespace = ns.Namespace()
+	}
+	var cluster bool
+	if c, ok := cp.(clusterer); ok {
+		cluster = c.Cluster()
+	}
+	return newKeyspace(namespace, cluster)
+}
+
+// queues is the set of all known queue names.
+func (k keyspace) queues() string {
+	return k.prefix + "queues"
+}
+
+// paused is the set of the queues that no node takes jobs from.
+func (k keyspace) paused() string {
+	return k.prefix + "paused"
+}
+
+// queue is the list holding the jobs of a queue.
+func (k keyspace) queue(name string) string {
+	if k.cluster && redisutil.HashTag(name) == name {
+		return k.prefix + "queue:{" + name + "}"
+	}
+	return k.prefix + "queue:" + name
+}
+
+// queueName returns the name of the queue stored at the key.
+func (k keyspace) queueName(key string) string {
+	name := strings.TrimPrefix(key, k.prefix+"queue:")
+	if k.cluster && strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") {
+		return name[1 : len(name)-1]
+	}
+	return name
+}
+
+func (k keyspace) sortedSet(set SortedSet) string {
+	return k.prefix + string(set)
+}
+
+func (k keyspace) stat(name string) string {
+	return k.prefix + "stat:" + name
+}
+
+// processes is the set of the identities of the running processes.
+func (k keyspace) processes() string {
+	return k.prefix + "processes"
+}
+
+// process is the hash holding the information about a running process.
+func (k keyspace) process(identity string) string {
+	return k.prefix + identity
+}
+
+// signals is the list of signals sent to a process.
+func (k keyspace) signals(identity string) string {
+	return k.prefix + identity + "-signals"
+}
+
+// cronLeader holds the identity of the process that enqueues the cron jobs.
+func (k keyspace) cronLeader() string {
+	return k.prefix + "cron:leader"
+}
+
+// cronLast is the hash of the last tick enqueued for every cron job, in Unix seconds.
+func (k keyspace) cronLast() string {
+	return k.prefix + "cron:last"
+}
+
+// cronTick marks a tick of a cron job as enqueued.
+func (k keyspace) cronTick(name string, unix int64) string {
+	return k.prefix + "cron:tick:" + name + ":" + strconv.FormatInt(unix, 10)
+}
+
+// unique is the lock of the unique jobs with the given key.
+func (k keyspace) unique(key string) string {
+	return k.prefix + "unique:" + key
+}
+
+// batch is the hash holding the information about a batch. The keys of a batch share a hash tag, so that they can be
+// updated by a script in a cluster.
+func (k keyspace) batch(bid string) string {
+	return k.prefix + "batch:{" + bid + "}"
+}
+
+// batchPending is the set of the jobs and child batches of a batch that have not been processed yet.
+func (k keyspace) batchPending(bid string) string {
+	return k.batch(bid) + ":pending"
+}
+
+// batchFailed is the set of the jobs and child batches of a batch that failed the last time they were processed.
+func (k keyspace) batchFailed(bid string) string {
+	return k.batch(bid) + ":failed"
+}
+
+// workflow is the hash holding the steps of a workflow and their state.
+func (k keyspace) workflow(wid string) string {
+	return k.prefix + "workflow:{" + wid + "}"
+}
+
+// concurrency is the sorted set of the leases held by the running jobs that share a concurrency limit and a key.
+func (k keyspace) concurrency(name, key string) string {
+	if key == "" {
+		return k.prefix + "concurrency:" + name
+	}
+	return k.prefix + "concurrency:" + name + ":" + key
+}
+
+// rateLimit is the key, or the prefix of the keys, holding the state of a rate limit for a key.
+func (k keyspace) rateLimit(name, key string) string {
+	if key == "" {
+		return k.prefix + "ratelimit:" + name
+	}
+	return k.prefix + "ratelimit:" + name + ":" + key
+}
+
+// cancelled marks a job that was cancelled.
+func (k keyspace) cancelled(jid string) string {
+	return k.prefix + "cancelled:" + jid
+}
+
+// cancelChannel is the pub/sub channel where the IDs of the cancelled jobs are published.
+func (k keyspace) cancelChannel() string {
+	return k.prefix + "cancel"
+}
+
+// status is the hash holding the status of a job.
+func (k keyspace) status(jid string) string {
+	return k.prefix + "status:" + jid
+}
+
+// priorityQueue is the sorted set holding the jobs of a queue that have a priority. It is in the same slot as the list.
+func (k keyspace) priorityQueue(name string) string {
+	return k.queue(name) + ":priority"
+}
+
+// priorityWake is the list that wakes up the dequeuers blocked on a queue when a job is added to its priority set.
+func (k keyspace) priorityWake(name string) string {
+	return k.queue(name) + ":priority:wake"
+}
+
+// prioritySeq is the counter that orders the jobs of the same priority in a queue.
+func (k keyspace) prioritySeq(name string) string {
+	return k.queue(name) + ":priority:seq"
+}
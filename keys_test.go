@@ -0,0 +1,82 @@
+package gokogeri
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyspace(t *testing.T) {
+	assert := require.New(t)
+
+	k := newKeyspace("", false)
+	assert.Equal("queues", k.queues())
+	assert.Equal("queue:default", k.queue("default"))
+	assert.Equal("default", k.queueName("queue:default"))
+	assert.Equal("retry", k.sortedSet(RetrySet))
+	assert.Equal("stat:processed", k.stat("processed"))
+	assert.Equal("processes", k.processes())
+	assert.Equal("host:1:abc", k.process("host:1:abc"))
+	assert.Equal("host:1:abc-signals", k.signals("host:1:abc"))
+	assert.Equal("paused", k.paused())
+
+	k = newKeyspace("app", false)
+	assert.Equal("app:queues", k.queues())
+	assert.Equal("app:queue:default", k.queue("default"))
+	assert.Equal("default", k.queueName("app:queue:default"))
+	assert.Equal("app:retry", k.sortedSet(RetrySet))
+	assert.Equal("app:stat:processed", k.stat("processed"))
+	assert.Equal("app:processes", k.processes())
+	assert.Equal("app:host:1:abc", k.process("host:1:abc"))
+	assert.Equal("app:host:1:abc-signals", k.signals("host:1:abc"))
+	assert.Equal("app:paused", k.paused())
+	assert.Equal("app:cron:leader", k.cronLeader())
+	assert.Equal("app:cron:last", k.cronLast())
+	assert.Equal("app:cron:tick:report:1700000000", k.cronTick("report", 1700000000))
+	assert.Equal("app:unique:abc", k.unique("abc"))
+	assert.Equal("app:batch:{abc}", k.batch("abc"))
+	assert.Equal("app:batch:{abc}:pending", k.batchPending("abc"))
+	assert.Equal("app:batch:{abc}:failed", k.batchFailed("abc"))
+	assert.Equal("app:workflow:{abc}", k.workflow("abc"))
+	assert.Equal("app:concurrency:partner", k.concurrency("partner", ""))
+	assert.Equal("app:concurrency:partner:42", k.concurrency("partner", "42"))
+	assert.Equal("app:ratelimit:partner", k.rateLimit("partner", ""))
+	assert.Equal("app:ratelimit:partner:42", k.rateLimit("partner", "42"))
+	assert.Equal("app:cancelled:abc", k.cancelled("abc"))
+	assert.Equal("app:cancel", k.cancelChannel())
+	assert.Equal("app:status:abc", k.status("abc"))
+	assert.Equal("app:queue:default:priority", k.priorityQueue("default"))
+	assert.Equal("app:queue:default:priority:seq", k.prioritySeq("default"))
+	assert.Equal("app:queue:default:priority:wake", k.priorityWake("default"))
+
+	k = newKeyspace("app", true)
+	assert.Equal("app:queues", k.queues())
+	assert.Equal("app:queue:{default}", k.queue("default"))
+	assert.Equal("default", k.queueName("app:queue:{default}"))
+	assert.Equal("app:queue:{billing}high", k.queue("{billing}high"))
+	assert.Equal("{billing}high", k.queueName("app:queue:{billing}high"))
+	assert.Equal("app:queue:{default}:priority", k.priorityQueue("default"))
+	assert.Equal("app:queue:{default}:priority:wake", k.priorityWake("default"))
+	assert.Equal("app:retry", k.sortedSet(RetrySet))
+}
+
+type plainProvider struct{}
+
+func (plainProvider) Conn(context.Context) (redis.Conn, error)         { return nil, nil }
+func (plainProvider) DialLongPoll(context.Context) (redis.Conn, error) { return nil, nil }
+
+type namespacedProvider struct {
+	plainProvider
+}
+
+func (namespacedProvider) Namespace() string { return "app" }
+func (namespacedProvider) Cluster() bool     { return true }
+
+func TestKeyspaceFor(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal(newKeyspace("", false), newKeyspaceFor(plainProvider{}))
+	assert.Equal(newKeyspace("app", true), newKeyspaceFor(namespacedProvider{}))
+}
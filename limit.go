@@ -0,0 +1,292 @@
+package gokogeri
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// DefaultLimitBackoff returns the delay before a job that was over a limit for the given time, starting at 1, is tried
+// again. It grows exponentially from about a second to about five minutes, with a jitter of 25%.
+func DefaultLimitBackoff(attempt int) time.Duration {
+	d := time.Minute * 5
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt < 10 {
+		d = time.Second << (attempt - 1)
+		if d > time.Minute*5 {
+			d = time.Minute * 5
+		}
+	}
+	return d - d/4 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// jobLimit is a limit that a job must be within before a worker processes it.
+type jobLimit interface {
+	// acquire returns a function that releases what was acquired for the job, to be called after the job has run, or
+	// nil if there is nothing to release. If the job is over the limit, it returns the delay after which it should be
+	// tried again instead.
+	acquire(ctx context.Context, cp ConnProvider, keys keyspace, job *Job) (release func(), delay time.Duration,
+		err error)
+}
+
+// limits holds the limits of a Node, which are shared by its managers. They are added before the Node runs.
+type limits struct {
+	// list holds the concurrency limits, and then the other limits. The leases of the concurrency limits are given
+	// back if a later limit rejects the job, but the uses counted by a rate limit are not, so they are counted last.
+	list  []jobLimit
+	names []string
+
+	// leases is the number of concurrency limits.
+	leases int
+}
+
+func (l *limits) add(name string, limit jobLimit) error {
+	if name == "" {
+		return fmt.Errorf("limit without a name")
+	}
+	if containsString(l.names, name) {
+		return fmt.Errorf("limit %q: duplicate name", name)
+	}
+	l.names = append(l.names, name)
+
+	if _, ok := limit.(*concurrencyLimit); !ok {
+		l.list = append(l.list, limit)
+		return nil
+	}
+	l.list = append(l.list, nil)
+	copy(l.list[l.leases+1:], l.list[l.leases:])
+	l.list[l.leases] = limit
+	l.leases++
+	return nil
+}
+
+// ConcurrencyLimit limits how many jobs run at the same time across all the nodes. A job that is over the limit is not
+// processed, but moved to the schedule set, and tried again after a delay, so the node must poll the schedule set.
+//
+// A running job holds a lease in Redis, which the node renews. If the node dies, the lease expires after LeaseTTL.
+type ConcurrencyLimit struct {
+	// Name identifies the limit in Redis. It is required.
+	Name string
+
+	// Class selects the jobs of a class. If it is empty, every job is selected.
+	Class string
+
+	// Key, if set, gives every selected job a key, usually derived from its arguments, such as an account ID. Only
+	// the jobs with the same key count towards each other's limit, and the jobs with an empty key are not limited.
+	Key func(*Job) string
+
+	// Limit is the maximum number of selected jobs, or jobs with the same key, that run at the same time.
+	Limit int
+
+	// LeaseTTL is how long a lease lasts if it is not renewed. The default is 30 seconds.
+	LeaseTTL time.Duration
+
+	// Backoff returns the delay before a job that was over the limit is tried again, given the number of times it was
+	// over a limit. The default is DefaultLimitBackoff.
+	Backoff func(attempt int) time.Duration
+}
+
+// AddConcurrencyLimit adds a limit that a job must be within before a worker processes it. The concurrency limits are
+// checked in the order in which they were added, before the rate limits of AddRateLimit, so that a job that is over a
+// concurrency limit does not use up a rate limit. Do not call it after calling Run.
+func (n *Node) AddConcurrencyLimit(l ConcurrencyLimit) error {
+	if l.Limit < 1 {
+		return fmt.Errorf("limit %q: must allow at least one job", l.Name)
+	}
+	if l.LeaseTTL <= 0 {
+		l.LeaseTTL = time.Second * 30
+	}
+	if l.LeaseTTL < time.Second {
+		return fmt.Errorf("limit %q: lease TTL must be at least a second", l.Name)
+	}
+	if l.Backoff == nil {
+		l.Backoff = DefaultLimitBackoff
+	}
+	return n.limits.add(l.Name, &concurrencyLimit{l})
+}
+
+type concurrencyLimit struct {
+	ConcurrencyLimit
+}
+
+// acquireLeaseScript removes the expired leases from the sorted set at KEYS[1], and adds a lease for ARGV[1] that
+// expires at ARGV[2] plus ARGV[3], in milliseconds, if there are fewer than ARGV[4] leases.
+var acquireLeaseScript = redis.NewScript(1, `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) or redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[4]) then
+	redis.call('ZADD', KEYS[1], ARGV[2] + ARGV[3], ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// renewLeaseScript moves the expiration of the lease for ARGV[1] in the sorted set at KEYS[1] to ARGV[2], and the
+// expiration of the set to ARGV[3] milliseconds from now, so that the set outlives the lease. A lease that has already
+// expired is not renewed.
+var renewLeaseScript = redis.NewScript(1, `
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// acquire implements jobLimit.
+func (l *concurrencyLimit) acquire(ctx context.Context, cp ConnProvider, keys keyspace, job *Job) (func(),
+	time.Duration, error) {
+	if l.Class != "" && job.Class() != l.Class {
+		return nil, 0, nil
+	}
+	var key string
+	if l.Key != nil {
+		key = l.Key(job)
+		if key == "" {
+			return nil, 0, nil
+		}
+	}
+	setKey := keys.concurrency(l.Name, key)
+
+	conn, err := cp.Conn(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	ttl := l.LeaseTTL.Milliseconds()
+	ok, err := redis.Bool(acquireLeaseScript.Do(conn, setKey, job.ID(), time.Now().UnixMilli(), ttl, l.Limit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("acquire lease: %v", err)
+	}
+	if !ok {
+		return nil, l.Backoff(job.enc.Limited + 1), nil
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(l.LeaseTTL / 3):
+			}
+			_ = l.update(cp, func(conn redis.Conn) error {
+				_, err := renewLeaseScript.Do(conn, setKey, job.ID(), time.Now().UnixMilli()+ttl, ttl)
+				return err
+			})
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		_ = l.update(cp, func(conn redis.Conn) error {
+			_, err := conn.Do("ZREM", setKey, job.ID())
+			return err
+		})
+	}, 0, nil
+}
+
+// update runs the commands that renew or release a lease. If they fail, the lease expires.
+func (l *concurrencyLimit) update(cp ConnProvider, fn func(redis.Conn) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	return fn(conn)
+}
+
+// checkLimits acquires what the job needs from every limit of the Node. If the job is over a limit, it is moved to the
+// schedule set of the Redis instance it came from, and checkLimits returns false. Otherwise it returns a function that
+// releases what was acquired after the job has run.
+func (m *workerManager) checkLimits(log zerolog.Logger, r workItem, job *Job) (func(), bool) {
+	var releases []func()
+	release := func() {
+		for _, fn := range releases {
+			fn()
+		}
+	}
+	if m.limits == nil || r.cp == nil {
+		return release, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for _, l := range m.limits.list {
+		fn, delay, err := l.acquire(ctx, r.cp, r.keys, job)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to check a limit")
+			delay = DefaultLimitBackoff(job.enc.Limited + 1)
+		}
+		if fn != nil {
+			releases = append(releases, fn)
+		}
+		if delay <= 0 {
+			continue
+		}
+
+		release()
+		err = m.reschedule(r, delay)
+		if err != nil {
+			// Running the job over the limit is better than losing it.
+			log.Error().Err(err).Msg("Failed to reschedule a job over the limit, processing it anyway")
+			return func() {}, true
+		}
+		m.trackStatus(log, r, job, StatusScheduled)
+		log.Info().Dur("delay", delay).Msg("Over the limit, rescheduled")
+		return nil, false
+	}
+	return release, true
+}
+
+// reschedule adds the job to the schedule set of the Redis instance it came from, to be enqueued after the delay, and
+// counts the times it was rescheduled. It does not count as a retry.
+func (m *workerManager) reschedule(r workItem, delay time.Duration) error {
+	if r.cp == nil {
+		return fmt.Errorf("unknown origin")
+	}
+
+	payload, err := rewritePayload(r.P, func(fields map[string]interface{}) {
+		var limited int64
+		if n, ok := fields["limited"].(json.Number); ok {
+			limited, _ = n.Int64()
+		}
+		fields["limited"] = limited + 1
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := r.cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("ZADD", r.keys.sortedSet(ScheduleSet), sidekiq.Time(time.Now().Add(delay)), payload)
+	if err != nil {
+		return fmt.Errorf("schedule job: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package gokogeri
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultLimitBackoff(t *testing.T) {
+	assert := require.New(t)
+
+	for attempt, base := range map[int]time.Duration{
+		0:   time.Second,
+		1:   time.Second,
+		2:   time.Second * 2,
+		5:   time.Second * 16,
+		9:   time.Second * 256,
+		10:  time.Minute * 5,
+		100: time.Minute * 5,
+	} {
+		d := DefaultLimitBackoff(attempt)
+		assert.GreaterOrEqual(d, base-base/4, "attempt %d", attempt)
+		assert.LessOrEqual(d, base+base/4, "attempt %d", attempt)
+	}
+}
+
+func TestAddConcurrencyLimit(t *testing.T) {
+	assert := require.New(t)
+
+	n := NewNode(zerolog.Nop(), namedProvider("a"), 1)
+	assert.NoError(n.AddConcurrencyLimit(ConcurrencyLimit{Name: "partner", Limit: 2}))
+	assert.Error(n.AddConcurrencyLimit(ConcurrencyLimit{Name: "partner", Limit: 2}), "duplicate")
+	assert.Error(n.AddConcurrencyLimit(ConcurrencyLimit{Limit: 2}), "no name")
+	assert.Error(n.AddConcurrencyLimit(ConcurrencyLimit{Name: "zero"}), "no limit")
+	assert.Error(n.AddConcurrencyLimit(ConcurrencyLimit{Name: "ttl", Limit: 1, LeaseTTL: time.Millisecond}), "TTL")
+	assert.Len(n.limits.list, 1)
+
+	l := n.limits.list[0].(*concurrencyLimit)
+	assert.Equal(time.Second*30, l.LeaseTTL)
+	assert.NotNil(l.Backoff)
+}
+
+func TestLimitsOrder(t *testing.T) {
+	assert := require.New(t)
+
+	n := NewNode(zerolog.Nop(), namedProvider("a"), 1)
+	assert.NoError(n.AddRateLimit(RateLimit{Name: "rate 1", Limit: 1, Period: time.Second}))
+	assert.NoError(n.AddConcurrencyLimit(ConcurrencyLimit{Name: "concurrency 1", Limit: 1}))
+	assert.NoError(n.AddRateLimit(RateLimit{Name: "rate 2", Limit: 1, Period: time.Second}))
+	assert.NoError(n.AddConcurrencyLimit(ConcurrencyLimit{Name: "concurrency 2", Limit: 1}))
+
+	var names []string
+	for _, l := range n.limits.list {
+		switch l := l.(type) {
+		case *concurrencyLimit:
+			names = append(names, l.Name)
+		case *rateLimit:
+			names = append(names, l.Name)
+		}
+	}
+	assert.Equal([]string{"concurrency 1", "concurrency 2", "rate 1", "rate 2"}, names)
+}
@@ -2,21 +2,66 @@ package gokogeri
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/sidekiq"
 )
 
+// DefaultShutdownTimeout is the grace period used when a Node is stopped remotely, for example by Admin.StopProcess.
+const DefaultShutdownTimeout = time.Second * 25
+
 // A Node represents a single server instance processing as many queues with as many Worker instances as are needed.
 type Node struct {
 	log    zerolog.Logger
 	rawLog zerolog.Logger
 
-	dqf *dequeuerFactory
+	cp              ConnProvider
+	dqf             *dequeuerFactory
+	longPollTimeout int
+	dqOpts          dequeuerOptions
+
+	wg sync.WaitGroup
 
-	wg       sync.WaitGroup
+	// mu guards managers, sharded and running, and the start of managers after Run.
+	mu       sync.Mutex
 	managers []*workerManager
+	// sharded holds the managers created with ProcessShardedQueues, which do not share dequeuers.
+	sharded map[*workerManager]bool
+	running bool
+
+	sharedFetchers int
+	prefetch       int
+	batchSize      int
+	group          *fetchGroup
+	groupDQs       []*dequeuer
+
+	pauses            *pauses
+	limits            *limits
+	keepExpired       bool
+	runningJobs       *runningJobs
+	pausePollInterval time.Duration
+
+	schedulePollInterval time.Duration
+
+	identity        string
+	stats           processStats
+	quiet           int32
+	shutdownTimeout time.Duration
+
+	hbWG     sync.WaitGroup
+	hbCancel context.CancelFunc
+
+	cronEntries []*cronEntry
+	cronWG      sync.WaitGroup
+	cronCancel  context.CancelFunc
+
+	stopOnce sync.Once
+	stopped  chan struct{}
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -25,38 +70,292 @@ type Node struct {
 // NewNode returns a new instance.
 func NewNode(log zerolog.Logger, cp ConnProvider, longPollTimeout int) *Node {
 	n := &Node{
-		dqf:    newDequeuerFactory(log, cp, longPollTimeout),
-		log:    log.With().Str("component", "node").Logger(),
-		rawLog: log,
+		cp:              cp,
+		longPollTimeout: longPollTimeout,
+		log:             log.With().Str("component", "node").Logger(),
+		rawLog:          log,
+		shutdownTimeout: DefaultShutdownTimeout,
+		dqOpts:          dequeuerOptions{reconnect: DefaultReconnectPolicy(), skipCancelled: true},
+		stopped:         make(chan struct{}),
+		sharded:         make(map[*workerManager]bool),
+		pauses:          newPauses(),
+		limits:          &limits{},
+		runningJobs:     newRunningJobs(),
 	}
+	n.pausePollInterval = DefaultPausePollInterval
+	n.schedulePollInterval = DefaultSchedulePollInterval
 	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	var err error
+	n.identity, err = sidekiq.Identity()
+	if err != nil {
+		n.log.Error().Err(err).Msg("Failed to create the process identity, the heartbeat is disabled")
+	}
+
+	n.dqf = newDequeuerFactory(log, cp, longPollTimeout, n.identity, &n.dqOpts)
 	return n
 }
 
+// Identity returns the string that identifies the Node in Redis. It is empty if it could not be created, in which case
+// the Node does not report its presence.
+func (n *Node) Identity() string {
+	return n.identity
+}
+
+// SetShutdownTimeout configures the grace period used when the Node is stopped remotely. Do not call it after calling
+// Run.
+func (n *Node) SetShutdownTimeout(d time.Duration) {
+	n.shutdownTimeout = d
+}
+
+// SetPausePollInterval configures how often the Node reads the queues paused with Admin.PauseQueue. The default is
+// DefaultPausePollInterval. Do not call it after calling Run.
+func (n *Node) SetPausePollInterval(d time.Duration) {
+	n.pausePollInterval = d
+}
+
+// SetSchedulePollInterval configures how often the Node pushes the scheduled jobs that are due to their queues, on
+// average. The default is DefaultSchedulePollInterval. Zero or less disables it, for example when Sidekiq processes do
+// it. Do not call it after calling Run.
+func (n *Node) SetSchedulePollInterval(d time.Duration) {
+	n.schedulePollInterval = d
+}
+
+// PauseQueue stops the Node from taking jobs from the queue, until ResumeQueue is called. Other nodes are not affected,
+// see Admin.PauseQueue for that. A dequeuer already waiting on the queue may still take a job until its long poll
+// timeout.
+func (n *Node) PauseQueue(queue string) {
+	n.log.Info().Str("queue", queue).Msg("Pausing a queue")
+	n.pauses.setLocal(queue, true)
+}
+
+// ResumeQueue lets the Node take jobs from a queue paused with PauseQueue again. It does not resume a queue paused
+// with Admin.PauseQueue.
+func (n *Node) ResumeQueue(queue string) {
+	n.log.Info().Str("queue", queue).Msg("Resuming a queue")
+	n.pauses.setLocal(queue, false)
+}
+
+// AddCronJob makes the Node enqueue the job on its schedule. Every node that runs the same cron jobs, by name, takes
+// part in electing a leader through Redis, which is the only one to enqueue them. A tick that was missed for less than
+// 30 seconds, while the leadership moved to another node, is still enqueued. Do not call it after calling Run.
+//
+// The cron jobs stop when the Node is quiet.
+func (n *Node) AddCronJob(job CronJob) error {
+	e, err := newCronEntry(job)
+	if err != nil {
+		return fmt.Errorf("cron job %q: %v", job.Name, err)
+	}
+	for _, other := range n.cronEntries {
+		if other.job.Name == job.Name {
+			return fmt.Errorf("cron job %q: duplicate name", job.Name)
+		}
+	}
+
+	n.cronEntries = append(n.cronEntries, e)
+	return nil
+}
+
+// SetReconnectPolicy configures how the dequeuers reconnect to Redis after losing their connection. The default is
+// DefaultReconnectPolicy. Do not call it after calling Run.
+func (n *Node) SetReconnectPolicy(p ReconnectPolicy) {
+	n.dqOpts.reconnect = p
+}
+
+// OnConnState sets a function that is called when a dequeuer connects or starts reconnecting to Redis, for example to
+// update metrics. Do not call it after calling Run.
+func (n *Node) OnConnState(fn func(ConnStateEvent)) {
+	n.dqOpts.onConnState = fn
+}
+
+// SetSharedFetchers makes the queue sets registered with ProcessQueues share the given number of dequeuers, each with
+// its own long poll connection, instead of having one dequeuer each. Zero, the default, disables sharing.
+//
+// A shared dequeuer only fetches a job when one of the queue sets has an idle worker. It asks for the queues of all
+// the sets with idle workers at once, each set in its own order, and gives the job to a set that processes the queue.
+// The sets take turns at being checked first. While some sets are busy, the dequeuer blocks for at most a second, so
+// that they are checked again soon after they become idle.
+//
+// Do not call it after calling Run.
+func (n *Node) SetSharedFetchers(count int) {
+	n.sharedFetchers = count
+}
+
+// SetPrefetch sets the number of jobs that every queue set can fetch in advance, while all its workers are busy. The
+// default is zero: a job is only taken from a queue when a worker is ready to process it, so jobs do not wait in
+// memory, where they would be lost if the process died. Prefetching can improve the throughput of short jobs.
+//
+// Do not call it after calling Run.
+func (n *Node) SetPrefetch(count int) {
+	n.prefetch = count
+}
+
+// SetBatchSize lets the dequeuers fetch up to the given number of jobs from a queue in a single call, for tiny jobs
+// with a high rate, where one round trip per job would dominate. The jobs are distributed to the workers. A dequeuer
+// never fetches more jobs than it has idle workers, plus the prefetch count, so the batches are only full when many
+// workers are idle or with prefetching.
+//
+// The jobs that are ready are taken with a script. When the queues are empty, the dequeuers block with BLMPOP on Redis
+// 7 and later, or with BRPOP for the first job with older servers. The shared dequeuers of SetSharedFetchers always
+// fetch one job at a time.
+//
+// Jobs are removed from the queues when they are fetched, as there are no working lists, so prefetched jobs are lost if
+// the process dies before they are processed.
+//
+// Do not call it after calling Run.
+func (n *Node) SetBatchSize(size int) {
+	n.batchSize = size
+}
+
 // ProcessQueues configures the Node to process the given set of queues using the desired number of Worker instances.
 //
-// You can call ProcessQueues many times with different sets of queues and Workers.
-// Do not call it any more after calling Run.
-func (n *Node) ProcessQueues(qs QueueSet, w Worker, instances int) {
-	n.managers = append(n.managers, newWorkerManager(n.rawLog, n.dqf, qs, w, instances))
+// You can call ProcessQueues many times with different sets of queues and Workers, also while the Node is running, in
+// which case the queues are processed right away. The returned handle can scale the number of Worker instances, or
+// remove the queue set from the Node. Queue sets added after the Node is quiet or stopped are not processed.
+func (n *Node) ProcessQueues(qs QueueSet, w Worker, instances int) *QueueSetHandle {
+	m := newWorkerManager(n.rawLog, []*dequeuerFactory{n.dqf}, &n.stats, qs, w, instances)
+	return n.register(m, false)
+}
+
+// ProcessShardedQueues is like ProcessQueues, but it reads the queues from all the given Redis instances at once, with
+// a separate long poll connection for each. Use it with Shards.Providers to process jobs enqueued with a sharded
+// Enqueuer. The ConnProvider given to NewNode is still used for reporting the presence of the Node.
+//
+// Every dequeuer needs an idle worker to fetch a job, so with fewer idle workers than shards, the shards are checked in
+// turns, and every dequeuer blocks for at most a second.
+func (n *Node) ProcessShardedQueues(shards []ConnProvider, qs QueueSet, w Worker, instances int) *QueueSetHandle {
+	dqfs := make([]*dequeuerFactory, len(shards))
+	for i, cp := range shards {
+		dqfs[i] = newDequeuerFactory(n.rawLog, cp, n.longPollTimeout, n.identity, &n.dqOpts)
+	}
+	m := newWorkerManager(n.rawLog, dqfs, &n.stats, qs, w, instances)
+	return n.register(m, true)
+}
+
+// register adds the manager to the Node, and starts it if the Node is running.
+func (n *Node) register(m *workerManager, sharded bool) *QueueSetHandle {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	m.pauses = n.pauses
+	m.limits = n.limits
+	m.runningJobs = n.runningJobs
+	n.managers = append(n.managers, m)
+	if sharded {
+		n.sharded[m] = true
+	}
+
+	if n.running && atomic.LoadInt32(&n.quiet) == 0 {
+		n.log.Info().Strs("queue_set", m.qset.Names()).Msg("Adding a queue set")
+		n.setUpFetching(m)
+		n.startManager(m)
+	}
+
+	return &QueueSetHandle{n: n, m: m}
+}
+
+// unregister removes the manager from the Node, stops it, and waits for it to finish like Stop.
+func (n *Node) unregister(ctx context.Context, m *workerManager) error {
+	n.mu.Lock()
+	found := false
+	for i, other := range n.managers {
+		if other == m {
+			n.managers = append(n.managers[:i], n.managers[i+1:]...)
+			found = true
+			break
+		}
+	}
+	delete(n.sharded, m)
+	started := m.cancel != nil
+	group := n.group
+	n.mu.Unlock()
+
+	if !found {
+		return errRemoved
+	}
+	if !started {
+		return nil
+	}
+
+	n.log.Info().Strs("queue_set", m.qset.Names()).Msg("Removing a queue set")
+	m.Stop()
+	if group != nil && group.remove(m) {
+		go func() {
+			// Jobs may still be delivered for the reservations in progress.
+			m.reserved.Wait()
+			m.fetchers.Done()
+		}()
+	}
+
+	select {
+	case <-m.finished:
+	case <-ctx.Done():
+		n.log.Warn().Strs("queue_set", m.qset.Names()).Msg("Timeout while removing a queue set, aborting its workers")
+		m.cancel()
+		<-m.finished
+	}
+	return nil
 }
 
 // Run starts the process of getting jobs from queues and passing them to Workers.
 // It blocks until the Node is shut down. See Stop for more.
+//
+// Run returns only after Stop has completed, and not when the queue sets have finished. A Node that is quiet, or that
+// has no queue sets, keeps running its heartbeat and the other background tasks until Stop is called.
 func (n *Node) Run() {
+	// The cron jobs start first, because the heartbeat can quiet the Node.
+	n.startCron()
+	n.startHeartbeat()
+	pausesRead := make(chan struct{})
+	go n.pollPauses(n.ctx, pausesRead)
+	<-pausesRead
+	if n.schedulePollInterval > 0 {
+		go n.pollScheduled(n.ctx)
+	}
+	for _, cp := range n.providers() {
+		if supportsPubSub(cp) {
+			go n.listenForCancels(n.ctx, cp)
+		}
+	}
+
 	n.log.Debug().Msg("Starting managers")
 
-	n.wg.Add(len(n.managers))
+	n.mu.Lock()
+	n.running = true
+	if n.sharedFetchers > 0 {
+		n.group = newFetchGroup()
+		n.group.pauses = n.pauses
+	}
 	for _, m := range n.managers {
-		m := m
-		go func() {
-			defer n.wg.Done()
-			m.Run(n.ctx)
-		}()
+		n.setUpFetching(m)
+	}
+	n.runGroup()
+	for _, m := range n.managers {
+		n.startManager(m)
 	}
+	n.mu.Unlock()
 
 	n.log.Info().Msg("Running")
-	n.wg.Wait()
+
+	// The managers also stop when the Node is quiet, but the Node keeps running until it is stopped.
+	<-n.stopped
+}
+
+// Quiet stops the process of getting new jobs from queues, while letting the jobs in progress finish. The Node keeps
+// running and reporting its presence until Stop is called.
+//
+// Quiet does not block.
+func (n *Node) Quiet() {
+	n.mu.Lock()
+	changed := atomic.CompareAndSwapInt32(&n.quiet, 0, 1)
+	n.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	n.log.Info().Msg("Quieting managers")
+	n.stopManagers()
+	n.stopCron()
 }
 
 // Stop initiates worker shutdown. Once the shutdown process is complete, the call to Run will return.
@@ -68,6 +367,16 @@ func (n *Node) Run() {
 //
 // Stop blocks until the shutdown process has completed.
 func (n *Node) Stop(ctx context.Context) {
+	first := false
+	n.stopOnce.Do(func() {
+		first = true
+	})
+	if !first {
+		// Another call to Stop is in progress, for example one initiated remotely.
+		<-n.stopped
+		return
+	}
+
 	deadline, ok := ctx.Deadline()
 	if ok {
 		n.log.Info().Dur("timeout", time.Until(deadline)).Msg("Stopping managers with a grace period")
@@ -75,9 +384,12 @@ func (n *Node) Stop(ctx context.Context) {
 		n.log.Info().Msg("Stopping managers with no deadline")
 	}
 
-	for _, m := range n.managers {
-		m.Stop()
-	}
+	// No more managers are started after this.
+	n.mu.Lock()
+	atomic.StoreInt32(&n.quiet, 1)
+	n.mu.Unlock()
+	n.stopManagers()
+	n.stopCron()
 
 	done := make(chan struct{})
 	go func() {
@@ -96,5 +408,169 @@ func (n *Node) Stop(ctx context.Context) {
 
 	n.cancel()
 	<-done
+
+	n.cronWG.Wait()
+
+	if n.hbCancel != nil {
+		n.hbCancel()
+	}
+	n.hbWG.Wait()
+
+	close(n.stopped)
 	n.log.Info().Msg("Stopped")
 }
+
+// setUpFetching gives the manager its own dequeuers, or puts it in the shared fetch group. The caller holds mu.
+func (n *Node) setUpFetching(m *workerManager) {
+	m.setPrefetch(n.prefetch)
+	m.batch = n.batchSize
+	m.keepExpired = n.keepExpired
+	if n.group != nil && !n.sharded[m] {
+		m.fetchers.Add(1)
+		n.group.add(m)
+	} else {
+		m.createDequeuers()
+	}
+}
+
+// startManager runs the manager with a Context of its own, so that it can be aborted when it is removed. The caller
+// holds mu.
+func (n *Node) startManager(m *workerManager) {
+	var ctx context.Context
+	ctx, m.cancel = context.WithCancel(n.ctx)
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		defer close(m.finished)
+		m.Run(ctx)
+	}()
+}
+
+// runGroup starts the shared dequeuers. When they have all stopped, the managers of the group are told that there
+// will be no more work. The caller holds mu.
+func (n *Node) runGroup() {
+	if n.group == nil {
+		return
+	}
+
+	for i := 0; i < n.sharedFetchers; i++ {
+		n.groupDQs = append(n.groupDQs, n.dqf.newDequeuer(n.group))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(n.groupDQs))
+	for _, dq := range n.groupDQs {
+		dq := dq
+		go func() {
+			defer wg.Done()
+			dq.Run()
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		for _, m := range n.group.removeAll() {
+			m.fetchers.Done()
+		}
+	}()
+}
+
+func (n *Node) stopManagers() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, m := range n.managers {
+		m.Stop()
+	}
+	for _, dq := range n.groupDQs {
+		dq.Stop()
+	}
+}
+
+func (n *Node) startHeartbeat() {
+	if n.identity == "" {
+		return
+	}
+
+	hb, err := newHeartbeat(n.rawLog, n.cp, &n.stats, n.identity, processInfo{})
+	if err != nil {
+		n.log.Error().Err(err).Msg("Failed to create the heartbeat, it is disabled")
+		return
+	}
+	hb.quiet = func() bool {
+		return atomic.LoadInt32(&n.quiet) == 1
+	}
+	hb.onSignal = n.handleSignal
+	hb.describe = n.describe
+
+	var ctx context.Context
+	ctx, n.hbCancel = context.WithCancel(context.Background())
+
+	n.hbWG.Add(1)
+	go func() {
+		defer n.hbWG.Done()
+		hb.Run(ctx)
+	}()
+}
+
+func (n *Node) startCron() {
+	if len(n.cronEntries) == 0 {
+		return
+	}
+	if n.identity == "" {
+		n.log.Error().Msg("The cron jobs are disabled, because the Node has no identity")
+		return
+	}
+
+	s := newCronScheduler(n.rawLog, n.cp, n.identity, n.cronEntries)
+
+	var ctx context.Context
+	ctx, n.cronCancel = context.WithCancel(context.Background())
+
+	n.cronWG.Add(1)
+	go func() {
+		defer n.cronWG.Done()
+		s.Run(ctx)
+	}()
+}
+
+func (n *Node) stopCron() {
+	if n.cronCancel != nil {
+		n.cronCancel()
+	}
+}
+
+// describe sets the queues and the concurrency of the running queue sets in the process information.
+func (n *Node) describe(info *processInfo) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	info.Queues = []string{}
+	info.Concurrency = 0
+	seen := make(map[string]bool)
+	for _, m := range n.managers {
+		info.Concurrency += m.getInstances()
+		for _, q := range m.qset.Names() {
+			if !seen[q] {
+				seen[q] = true
+				info.Queues = append(info.Queues, q)
+			}
+		}
+	}
+}
+
+func (n *Node) handleSignal(sig string) {
+	switch sig {
+	case signalQuiet:
+		n.Quiet()
+	case signalStop:
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), n.shutdownTimeout)
+			defer cancel()
+			n.Stop(ctx)
+		}()
+	default:
+		n.log.Warn().Str("signal", sig).Msg("Unknown signal")
+	}
+}
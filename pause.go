@@ -0,0 +1,155 @@
+package gokogeri
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultPausePollInterval is how often a Node reads the queues paused with Admin.PauseQueue.
+const DefaultPausePollInterval = time.Second * 2
+
+// pauses holds the queues that a Node must not fetch jobs from: the ones paused for all the nodes, read from Redis,
+// and the ones paused only locally. A nil *pauses pauses nothing. It is safe for concurrent use.
+type pauses struct {
+	mu     sync.Mutex
+	remote map[string]bool
+	local  map[string]bool
+	// changed is closed and replaced when a queue is resumed.
+	changed chan struct{}
+}
+
+func newPauses() *pauses {
+	return &pauses{
+		remote:  make(map[string]bool),
+		local:   make(map[string]bool),
+		changed: make(chan struct{}),
+	}
+}
+
+// filter returns the queues that are not paused, keeping their order, and a channel that is closed when a queue is
+// resumed afterwards.
+func (p *pauses) filter(queues []string) ([]string, <-chan struct{}) {
+	if p == nil {
+		return queues, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.remote) == 0 && len(p.local) == 0 {
+		return queues, p.changed
+	}
+
+	active := make([]string, 0, len(queues))
+	for _, q := range queues {
+		if !p.remote[q] && !p.local[q] {
+			active = append(active, q)
+		}
+	}
+	return active, p.changed
+}
+
+// setLocal pauses or resumes a queue on this Node only.
+func (p *pauses) setLocal(queue string, paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if paused {
+		p.local[queue] = true
+		return
+	}
+	if p.local[queue] {
+		delete(p.local, queue)
+		p.notify()
+	}
+}
+
+// setRemote replaces the queues paused for all the nodes.
+func (p *pauses) setRemote(queues []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	remote := make(map[string]bool, len(queues))
+	for _, q := range queues {
+		remote[q] = true
+	}
+
+	resumed := false
+	for q := range p.remote {
+		if !remote[q] {
+			resumed = true
+		}
+	}
+	p.remote = remote
+	if resumed {
+		p.notify()
+	}
+}
+
+// notify wakes up the dequeuers waiting for a queue to be resumed. The caller holds mu.
+func (p *pauses) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// pollPauses reads the paused queues from Redis at every interval, until the Context is cancelled. It reads them from
+// every Redis instance that the Node reads queues from, and pauses a queue if it is paused on any of them. The last
+// known queues of an instance are kept while it cannot be reached. It closes ready after the first read, so that no
+// job is taken from a queue that was paused before the Node started.
+func (n *Node) pollPauses(ctx context.Context, ready chan<- struct{}) {
+	log := n.rawLog.With().Str("component", "pauses").Logger()
+	known := make(map[ConnProvider][]string)
+
+	read := func() {
+		cps := n.providers()
+		current := make(map[ConnProvider][]string, len(cps))
+		var all []string
+		for _, cp := range cps {
+			queues, err := readPausedQueues(ctx, cp, newKeyspaceFor(cp))
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error().Err(err).Msg("Failed to read the paused queues")
+				}
+				queues = known[cp]
+			}
+			current[cp] = queues
+			all = append(all, queues...)
+		}
+		known = current
+		n.pauses.setRemote(all)
+	}
+
+	ticker := time.NewTicker(n.pausePollInterval)
+	defer ticker.Stop()
+
+	read()
+	close(ready)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			read()
+		}
+	}
+}
+
+func readPausedQueues(ctx context.Context, cp ConnProvider, keys keyspace) ([]string, error) {
+	conn, err := cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	queues, err := redis.Strings(conn.Do("SMEMBERS", keys.paused()))
+	if err != nil {
+		return nil, fmt.Errorf("get paused queues: %v", err)
+	}
+	sort.Strings(queues)
+	return queues, nil
+}
@@ -0,0 +1,69 @@
+package gokogeri
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauses(t *testing.T) {
+	assert := require.New(t)
+
+	var none *pauses
+	queues, _ := none.filter([]string{"critical", "default"})
+	assert.Equal([]string{"critical", "default"}, queues)
+
+	p := newPauses()
+	p.setRemote([]string{"critical"})
+	p.setLocal("low", true)
+	queues, resumed := p.filter([]string{"critical", "default", "low"})
+	assert.Equal([]string{"default"}, queues)
+
+	p.setLocal("low", false)
+	<-resumed
+	queues, resumed = p.filter([]string{"critical", "default", "low"})
+	assert.Equal([]string{"default", "low"}, queues)
+
+	// A queue resumed locally is still paused remotely.
+	p.setLocal("critical", false)
+	p.setRemote([]string{"critical", "default"})
+	select {
+	case <-resumed:
+		assert.Fail("nothing was resumed")
+	default:
+	}
+
+	p.setRemote(nil)
+	<-resumed
+	queues, _ = p.filter([]string{"critical", "default", "low"})
+	assert.Equal([]string{"critical", "default", "low"}, queues)
+}
+
+func TestManagerReservePaused(t *testing.T) {
+	assert := require.New(t)
+
+	ctx := context.Background()
+
+	m := &workerManager{qset: OrderedQueueSet{"critical", "default"}, instances: 1, pauses: newPauses()}
+	m.setPrefetch(0)
+
+	m.pauses.setLocal("critical", true)
+	r := m.reserve(ctx)
+	assert.Equal([]string{"default"}, r.queues)
+	r.release()
+
+	// Nothing is reserved while all the queues are paused, and the slot is not held.
+	m.pauses.setLocal("default", true)
+	timeout, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	assert.Nil(m.reserve(timeout))
+	assert.True(m.cap.tryAcquire())
+	m.cap.release()
+
+	go m.pauses.setLocal("critical", false)
+	r = m.reserve(ctx)
+	assert.Equal([]string{"critical"}, r.queues)
+	r.release()
+}
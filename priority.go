@@ -0,0 +1,60 @@
+package gokogeri
+
+import (
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// MinPriority and MaxPriority are the limits of Job.SetPriority.
+const (
+	MinPriority = -1 << 15
+	MaxPriority = 1<<15 - 1
+)
+
+// prioritySeqRange is the range of the sequence numbers that order the jobs of the same priority. The score of a job is
+// -priority * prioritySeqRange + seq, which is an exact integer in a double. After 2^36 jobs in the same queue, the
+// sequence wraps around, which breaks the order of the jobs enqueued around that time.
+const prioritySeqRange = 1 << 36
+
+// pushPriorityScript adds the payload ARGV[1] with the priority ARGV[2] to the priority set at KEYS[1], with the next
+// sequence number from KEYS[2], and pushes to the list at KEYS[3] to wake up a dequeuer blocked on the queue. The score
+// is formatted by the script, because Lua numbers are converted to strings with only 14 digits.
+var pushPriorityScript = redis.NewScript(3, `
+local range = tonumber(ARGV[3])
+local seq = redis.call('INCR', KEYS[2]) % range
+local score = -tonumber(ARGV[2]) * range + seq
+redis.call('ZADD', KEYS[1], string.format('%.0f', score), ARGV[1])
+redis.call('LPUSH', KEYS[3], 1)
+return 1
+`)
+
+// priorityCommands returns the Redis commands that add the payload to the priority set of the queue.
+func priorityCommands(keys keyspace, queue string, priority int, payload []byte) ([][]interface{}, error) {
+	if priority < MinPriority || priority > MaxPriority {
+		return nil, fmt.Errorf("priority %d is out of range", priority)
+	}
+
+	return [][]interface{}{
+		{"SADD", keys.queues(), queue},
+		{
+			pushPriorityScript,
+			keys.priorityQueue(queue), keys.prioritySeq(queue), keys.priorityWake(queue),
+			payload, priority, prioritySeqRange,
+		},
+	}, nil
+}
+
+// readPriority returns jobs from the priority set of the queue, in the order in which they will be processed.
+func (a *Admin) readPriority(conn redis.Conn, queue string, start, count int) ([]*JobRecord, error) {
+	payloads, err := redis.ByteSlices(conn.Do("ZRANGE", a.keys.priorityQueue(queue), start, start+count-1))
+	if err != nil {
+		return nil, fmt.Errorf("read priority set: %v", err)
+	}
+
+	records := make([]*JobRecord, 0, len(payloads))
+	for _, p := range payloads {
+		records = append(records, newJobRecord(p, 0))
+	}
+	return records, nil
+}
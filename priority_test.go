@@ -0,0 +1,27 @@
+package gokogeri
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityCommands(t *testing.T) {
+	assert := require.New(t)
+
+	keys := newKeyspace("app", false)
+	commands, err := priorityCommands(keys, "reports", MaxPriority, []byte("payload"))
+	assert.NoError(err)
+	assert.Len(commands, 2)
+	assert.Equal([]interface{}{"SADD", "app:queues", "reports"}, commands[0])
+	assert.Equal(pushPriorityScript, commands[1][0])
+	assert.Equal(
+		[]interface{}{"app:queue:reports:priority", "app:queue:reports:priority:seq", "app:queue:reports:priority:wake"},
+		commands[1][1:4],
+	)
+
+	_, err = priorityCommands(keys, "reports", MaxPriority+1, []byte("payload"))
+	assert.EqualError(err, "priority 32768 is out of range")
+	_, err = priorityCommands(keys, "reports", MinPriority-1, []byte("payload"))
+	assert.Error(err)
+}
@@ -0,0 +1,242 @@
+package gokogeri
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// A RateStrategy is the algorithm of a RateLimit.
+type RateStrategy int
+
+const (
+	// FixedWindow allows Limit jobs in every Period, starting at multiples of Period since the Unix epoch. Up to twice
+	// the limit can pass around the boundary between two windows.
+	FixedWindow RateStrategy = iota
+
+	// SlidingWindow allows Limit jobs in any Period. It stores the time of every job in the last Period.
+	SlidingWindow
+
+	// TokenBucket allows bursts of up to Limit jobs, and refills the bucket evenly at Limit jobs per Period. With a
+	// Limit of 1, it works like a leaky bucket, spacing the jobs by Period.
+	TokenBucket
+)
+
+// RateLimit describes a rate limit that is shared by all the nodes through Redis.
+type RateLimit struct {
+	// Name identifies the limit in Redis. It is required.
+	Name string
+
+	// Class selects the jobs of a class for Node.AddRateLimit. If it is empty, every job is selected.
+	Class string
+
+	// Key, if set, gives every selected job a key for Node.AddRateLimit, usually derived from its arguments, such as a
+	// partner ID. Every key has its own limit, and the jobs with an empty key are not limited.
+	Key func(*Job) string
+
+	// Strategy is the algorithm that counts the jobs. The default is FixedWindow.
+	Strategy RateStrategy
+
+	// Limit is the number of jobs allowed per Period. With FixedWindow it is the number of jobs in a window, and with
+	// SlidingWindow the number of jobs in any span of Period. With TokenBucket it is the size of the bucket, which is
+	// the largest burst of jobs. It must be at least 1.
+	Limit int
+
+	// Period is the time over which Limit applies. With FixedWindow it is the length of a window, and with
+	// SlidingWindow the length of the span that is looked back on. With TokenBucket it is the time needed to refill an
+	// empty bucket, so one job is allowed every Period divided by Limit. It is counted in whole milliseconds and must
+	// be at least a millisecond.
+	Period time.Duration
+}
+
+func (l *RateLimit) validate() error {
+	if l.Name == "" {
+		return fmt.Errorf("limit without a name")
+	}
+	if l.Limit < 1 {
+		return fmt.Errorf("limit %q: must allow at least one job", l.Name)
+	}
+	if l.Period < time.Millisecond {
+		return fmt.Errorf("limit %q: period must be at least a millisecond", l.Name)
+	}
+	if l.Strategy < FixedWindow || l.Strategy > TokenBucket {
+		return fmt.Errorf("limit %q: unknown strategy %d", l.Name, l.Strategy)
+	}
+	return nil
+}
+
+// AddRateLimit adds a rate limit that a job must be within before a worker processes it. A job over the limit is moved
+// to the schedule set and enqueued again when the limit allows it, so the node must poll the schedule set. The rate
+// limits are checked in the order in which they were added, after the concurrency limits of AddConcurrencyLimit. A
+// job that passes a rate limit counts towards it, even if a later rate limit rejects it. Do not call it after calling
+// Run.
+func (n *Node) AddRateLimit(l RateLimit) error {
+	err := l.validate()
+	if err != nil {
+		return err
+	}
+	return n.limits.add(l.Name, &rateLimit{l})
+}
+
+type rateLimit struct {
+	RateLimit
+}
+
+// acquire implements jobLimit.
+func (l *rateLimit) acquire(ctx context.Context, cp ConnProvider, keys keyspace, job *Job) (func(), time.Duration,
+	error) {
+	if l.Class != "" && job.Class() != l.Class {
+		return nil, 0, nil
+	}
+	var key string
+	if l.Key != nil {
+		key = l.Key(job)
+		if key == "" {
+			return nil, 0, nil
+		}
+	}
+
+	delay, err := allowRate(ctx, cp, keys, &l.RateLimit, key)
+	return nil, delay, err
+}
+
+// A RateLimiter checks a RateLimit from a worker, for example before every call to a partner API. The Class and Key of
+// the RateLimit are not used. It is safe for concurrent use.
+type RateLimiter struct {
+	cp    ConnProvider
+	keys  keyspace
+	limit RateLimit
+}
+
+// NewRateLimiter returns a new instance.
+func NewRateLimiter(cp ConnProvider, l RateLimit) (*RateLimiter, error) {
+	err := l.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimiter{
+		cp:    cp,
+		keys:  newKeyspaceFor(cp),
+		limit: l,
+	}, nil
+}
+
+// Allow counts one use under the key, which can be empty, if the limit allows it, and returns zero. Otherwise it
+// returns how long to wait before trying again.
+func (r *RateLimiter) Allow(ctx context.Context, key string) (time.Duration, error) {
+	return allowRate(ctx, r.cp, r.keys, &r.limit, key)
+}
+
+// Check is like Allow, but returns a RescheduleError if the limit is exceeded. A worker can return it from Work to be
+// processed again once the limit allows it.
+func (r *RateLimiter) Check(ctx context.Context, key string) error {
+	delay, err := r.Allow(ctx, key)
+	if err != nil {
+		return err
+	}
+	if delay > 0 {
+		return Reschedule(delay)
+	}
+	return nil
+}
+
+// A RescheduleError returned by Worker.Work moves the job to the schedule set, to be enqueued again after Delay. The
+// job does not count as failed, and it is still unique, and part of its batch or workflow.
+type RescheduleError struct {
+	Delay time.Duration
+}
+
+// Reschedule returns a RescheduleError.
+func Reschedule(delay time.Duration) error {
+	return &RescheduleError{Delay: delay}
+}
+
+func (e *RescheduleError) Error() string {
+	return fmt.Sprintf("rescheduled in %v", e.Delay)
+}
+
+// fixedWindowScript counts a use in the window at KEYS[1], which lasts ARGV[2] milliseconds, if it has fewer than
+// ARGV[1] uses. Otherwise it returns the milliseconds until the window ends, given in ARGV[3].
+var fixedWindowScript = redis.NewScript(1, `
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if count >= tonumber(ARGV[1]) then
+	return tonumber(ARGV[3])
+end
+redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 0
+`)
+
+// slidingWindowScript counts a use at the time ARGV[3], in milliseconds, as ARGV[4] in the sorted set at KEYS[1], if
+// there are fewer than ARGV[1] uses in the last ARGV[2] milliseconds. Otherwise it returns the milliseconds until the
+// oldest use leaves the window.
+var slidingWindowScript = redis.NewScript(1, `
+local now, period = tonumber(ARGV[3]), tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - period)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[1]) then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return math.max(1, tonumber(oldest[2]) + period - now)
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], period)
+return 0
+`)
+
+// tokenBucketScript takes a token from the bucket at KEYS[1], which holds up to ARGV[1] tokens and is refilled with as
+// many every ARGV[2] milliseconds, at the time ARGV[3]. If the bucket is empty, it returns the milliseconds until the
+// next token.
+var tokenBucketScript = redis.NewScript(1, `
+local limit, period, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local rate = limit / period
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens, at = tonumber(bucket[1]), tonumber(bucket[2])
+if tokens == nil then
+	tokens, at = limit, now
+end
+tokens = math.min(limit, tokens + math.max(0, now - at) * rate)
+if tokens < 1 then
+	return math.max(1, math.ceil((1 - tokens) / rate))
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens - 1), 'at', now)
+redis.call('PEXPIRE', KEYS[1], period)
+return 0
+`)
+
+// allowRate implements RateLimiter.Allow.
+func allowRate(ctx context.Context, cp ConnProvider, keys keyspace, l *RateLimit, key string) (time.Duration,
+	error) {
+	conn, err := cp.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	now := time.Now().UnixMilli()
+	period := l.Period.Milliseconds()
+	rateKey := keys.rateLimit(l.Name, key)
+
+	var ms int64
+	switch l.Strategy {
+	case FixedWindow:
+		window := now / period
+		ms, err = redis.Int64(fixedWindowScript.Do(conn, fmt.Sprintf("%s:%d", rateKey, window), l.Limit, period,
+			(window+1)*period-now))
+	case SlidingWindow:
+		var id string
+		id, err = sidekiq.JobID()
+		if err != nil {
+			return 0, fmt.Errorf("create ID: %v", err)
+		}
+		ms, err = redis.Int64(slidingWindowScript.Do(conn, rateKey, l.Limit, period, now, id))
+	case TokenBucket:
+		ms, err = redis.Int64(tokenBucketScript.Do(conn, rateKey, l.Limit, period, now))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("check rate limit: %v", err)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
@@ -0,0 +1,39 @@
+package gokogeri
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitValidate(t *testing.T) {
+	assert := require.New(t)
+
+	l := RateLimit{Name: "partner", Strategy: SlidingWindow, Limit: 10, Period: time.Second}
+	assert.NoError(l.validate())
+
+	for _, change := range []func(*RateLimit){
+		func(l *RateLimit) { l.Name = "" },
+		func(l *RateLimit) { l.Limit = 0 },
+		func(l *RateLimit) { l.Period = time.Microsecond },
+		func(l *RateLimit) { l.Strategy = TokenBucket + 1 },
+	} {
+		invalid := l
+		change(&invalid)
+		assert.Error(invalid.validate())
+	}
+}
+
+func TestRescheduleError(t *testing.T) {
+	assert := require.New(t)
+
+	err := fmt.Errorf("calling partner: %w", Reschedule(time.Second))
+
+	var rescheduled *RescheduleError
+	assert.True(errors.As(err, &rescheduled))
+	assert.Equal(time.Second, rescheduled.Delay)
+	assert.Equal("calling partner: rescheduled in 1s", err.Error())
+}
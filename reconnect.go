@@ -0,0 +1,129 @@
+package gokogeri
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy controls how the dequeuers reconnect to Redis after losing their connection. The delay between
+// attempts grows exponentially up to a maximum, with some randomness, so that many dequeuers do not reconnect all at
+// once after a restart of Redis.
+type ReconnectPolicy struct {
+	// MinDelay is the delay before the second attempt. The first attempt is immediate.
+	MinDelay time.Duration
+
+	// MaxDelay is the maximum delay between attempts.
+	MaxDelay time.Duration
+
+	// Multiplier is the factor by which the delay grows after every failed attempt. Values below 1 are treated as 1.
+	Multiplier float64
+
+	// Jitter is the fraction of the delay that is random, between 0 and 1. For example, with a jitter of 0.5, a delay of
+	// 10 seconds becomes a random value between 5 and 10 seconds.
+	Jitter float64
+
+	// LogInterval limits the number of errors logged by each dequeuer while it cannot connect. The first failure is
+	// always logged, and then at most one every interval, with the number of failures that were not logged. Zero logs
+	// every failure.
+	LogInterval time.Duration
+}
+
+// DefaultReconnectPolicy returns the policy used by a Node unless it is configured otherwise.
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		MinDelay:    time.Second,
+		MaxDelay:    time.Second * 30,
+		Multiplier:  2,
+		Jitter:      0.5,
+		LogInterval: time.Minute,
+	}
+}
+
+// delay returns the delay before the given attempt, starting with 1. The random value must be in [0, 1).
+func (p ReconnectPolicy) delay(attempt int, random float64) time.Duration {
+	if attempt <= 1 {
+		return 0
+	}
+
+	multiplier := math.Max(p.Multiplier, 1)
+	d := float64(p.MinDelay) * math.Pow(multiplier, float64(attempt-2))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+
+	jitter := math.Min(math.Max(p.Jitter, 0), 1)
+	return time.Duration(d - d*jitter*random)
+}
+
+// ConnState is the state of the connection of a dequeuer.
+type ConnState int
+
+const (
+	// ConnStateConnected means the dequeuer has connected and is reading from the queues.
+	ConnStateConnected ConnState = iota + 1
+
+	// ConnStateReconnecting means the dequeuer has lost its connection, or failed to connect, and will try again.
+	ConnStateReconnecting
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateConnected:
+		return "connected"
+	case ConnStateReconnecting:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnStateEvent reports a change in the connection of a dequeuer, for example to update metrics. The handlers are
+// called from the dequeuer goroutines, so they must be quick and safe for concurrent use.
+type ConnStateEvent struct {
+	// QueueSet holds the names of the queues read by the dequeuer.
+	QueueSet []string
+
+	State ConnState
+
+	// Attempt is the number of connection attempts since the dequeuer was last working. It is 1 for the first attempt
+	// after the connection was lost.
+	Attempt int
+
+	// Delay is how long the dequeuer waits before the next attempt, when reconnecting.
+	Delay time.Duration
+
+	// Err is the reason for reconnecting.
+	Err error
+}
+
+// logLimiter limits how often a failure is logged. It is not safe for concurrent use.
+type logLimiter struct {
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+}
+
+// allow reports whether a failure should be logged now, and how many failures were suppressed since the last one
+// that was logged.
+func (l *logLimiter) allow(now time.Time) (bool, int) {
+	if l.interval > 0 && !l.last.IsZero() && now.Sub(l.last) < l.interval {
+		l.suppressed++
+		return false, 0
+	}
+	suppressed := l.suppressed
+	l.last = now
+	l.suppressed = 0
+	return true, suppressed
+}
+
+// reset makes the next failure be logged.
+func (l *logLimiter) reset() {
+	l.last = time.Time{}
+	l.suppressed = 0
+}
+
+// newRand returns a source of randomness for the jitter of one dequeuer.
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
@@ -0,0 +1,54 @@
+package gokogeri
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	assert := require.New(t)
+
+	p := ReconnectPolicy{
+		MinDelay:   time.Second,
+		MaxDelay:   time.Second * 10,
+		Multiplier: 2,
+		Jitter:     0.5,
+	}
+
+	assert.Equal(time.Duration(0), p.delay(1, 0))
+	assert.Equal(time.Second, p.delay(2, 0))
+	assert.Equal(time.Second*2, p.delay(3, 0))
+	assert.Equal(time.Second*8, p.delay(5, 0))
+	assert.Equal(time.Second*10, p.delay(6, 0))
+	assert.Equal(time.Second*10, p.delay(100, 0))
+
+	// The jitter removes up to half of the delay.
+	assert.Equal(time.Second*5, p.delay(100, 1))
+	assert.Equal(time.Millisecond*750, p.delay(2, 0.5))
+}
+
+func TestLogLimiter(t *testing.T) {
+	assert := require.New(t)
+
+	l := logLimiter{interval: time.Minute}
+	now := time.Now()
+
+	ok, suppressed := l.allow(now)
+	assert.True(ok)
+	assert.Equal(0, suppressed)
+
+	ok, _ = l.allow(now.Add(time.Second))
+	assert.False(ok)
+	ok, _ = l.allow(now.Add(time.Second * 2))
+	assert.False(ok)
+
+	ok, suppressed = l.allow(now.Add(time.Minute))
+	assert.True(ok)
+	assert.Equal(2, suppressed)
+
+	l.reset()
+	ok, _ = l.allow(now.Add(time.Minute + time.Second))
+	assert.True(ok)
+}
@@ -0,0 +1,534 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+)
+
+// maxRedirects is the number of times a command follows MOVED and ASK redirections before giving up.
+const maxRedirects = 5
+
+// errClosed is returned when using a cluster connection that has been closed.
+var errClosed = errors.New("redis cluster: connection closed")
+
+// dialFunc dials a node with the given read timeout and connection name.
+type dialFunc func(ctx context.Context, addr string, readTimeout time.Duration, name string) (redis.Conn, error)
+
+// cluster routes commands to the masters of a Redis Cluster according to the hash slots of their keys. It keeps a pool
+// of connections for every master. It is safe for concurrent use.
+type cluster struct {
+	cfg  *Config
+	dial dialFunc
+	name string
+
+	// mu guards the fields below.
+	mu sync.RWMutex
+	// nodes holds the addresses of the known nodes, starting with the configured ones.
+	nodes []string
+	// slots holds the address of the master serving each slot, or an empty string if it is not known.
+	slots [redisutil.SlotCount]string
+	pools map[string]*redis.Pool
+}
+
+func newCluster(cfg *Config, dial dialFunc, name string) *cluster {
+	nodes := make([]string, len(cfg.ClusterAddrs))
+	copy(nodes, cfg.ClusterAddrs)
+	return &cluster{
+		cfg:   cfg,
+		dial:  dial,
+		name:  name,
+		nodes: nodes,
+		pools: make(map[string]*redis.Pool),
+	}
+}
+
+// refresh loads the slot map with CLUSTER SLOTS from the first node that responds.
+func (c *cluster) refresh(ctx context.Context) error {
+	c.mu.RLock()
+	nodes := make([]string, len(c.nodes))
+	copy(nodes, c.nodes)
+	c.mu.RUnlock()
+
+	var errs []string
+	for _, addr := range nodes {
+		err := c.refreshFrom(ctx, addr)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+	}
+	return fmt.Errorf("redis cluster: refresh slots: %s", strings.Join(errs, "; "))
+}
+
+func (c *cluster) refreshFrom(ctx context.Context, addr string) error {
+	conn, err := c.dial(ctx, addr, c.cfg.ReadTimeout, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return err
+	}
+
+	var slots [redisutil.SlotCount]string
+	var masters []string
+	for _, r := range ranges {
+		start, end, master, err := parseSlotRange(r, addr)
+		if err != nil {
+			return err
+		}
+		for s := start; s <= end && s < redisutil.SlotCount; s++ {
+			slots[s] = master
+		}
+		masters = append(masters, master)
+	}
+
+	c.mu.Lock()
+	c.slots = slots
+	for _, m := range masters {
+		if !containsString(c.nodes, m) {
+			c.nodes = append(c.nodes, m)
+		}
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// parseSlotRange parses an element of the CLUSTER SLOTS reply. An empty IP address means the node that was queried.
+func parseSlotRange(r interface{}, queried string) (start, end int, master string, err error) {
+	fields, err := redis.Values(r, nil)
+	if err != nil || len(fields) < 3 {
+		return 0, 0, "", fmt.Errorf("unexpected CLUSTER SLOTS reply: %v", r)
+	}
+	start, err = redis.Int(fields[0], nil)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	end, err = redis.Int(fields[1], nil)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	node, err := redis.Values(fields[2], nil)
+	if err != nil || len(node) < 2 {
+		return 0, 0, "", fmt.Errorf("unexpected CLUSTER SLOTS node: %v", fields[2])
+	}
+	ip, err := redis.String(node[0], nil)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	port, err := redis.Int(node[1], nil)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(queried)
+	}
+	return start, end, net.JoinHostPort(ip, strconv.Itoa(port)), nil
+}
+
+// nodeFor returns the address of the master serving the slot, loading the slot map if needed. A negative slot means
+// any node.
+func (c *cluster) nodeFor(ctx context.Context, slot int) (string, error) {
+	addr := c.lookup(slot)
+	if addr != "" {
+		return addr, nil
+	}
+
+	err := c.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	addr = c.lookup(slot)
+	if addr == "" {
+		return "", fmt.Errorf("redis cluster: slot %d is not served", slot)
+	}
+	return addr, nil
+}
+
+func (c *cluster) lookup(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if slot < 0 {
+		for _, addr := range c.slots {
+			if addr != "" {
+				return addr
+			}
+		}
+		return ""
+	}
+	return c.slots[slot]
+}
+
+// moved records that the slot is served by another master, as reported by a MOVED redirection.
+func (c *cluster) moved(slot int, addr string) {
+	c.mu.Lock()
+	if slot >= 0 {
+		c.slots[slot] = addr
+	}
+	if !containsString(c.nodes, addr) {
+		c.nodes = append(c.nodes, addr)
+	}
+	c.mu.Unlock()
+}
+
+func (c *cluster) pool(addr string) *redis.Pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pools[addr]
+	if !ok {
+		p = &redis.Pool{
+			DialContext: func(ctx context.Context) (redis.Conn, error) {
+				return c.dial(ctx, addr, c.cfg.ReadTimeout, c.name)
+			},
+			MaxIdle:     c.cfg.MaxIdle,
+			MaxActive:   c.cfg.MaxActive,
+			IdleTimeout: c.cfg.IdleTimeout,
+			Wait:        true,
+		}
+		c.pools[addr] = p
+	}
+	return p
+}
+
+func (c *cluster) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for _, p := range c.pools {
+		if e := p.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// conn returns a connection that routes every command to the right master. A pooled connection takes a connection
+// from the pool of the master for every command. A dedicated one dials its own connection to every master it needs,
+// with the given read timeout.
+func (c *cluster) conn(
+	ctx context.Context,
+	dedicated bool,
+	readTimeout time.Duration,
+	name string,
+) (*clusterConn, error) {
+	// Loading the slot map is the only part that uses the Context.
+	if c.lookup(-1) == "" {
+		err := c.refresh(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cc := &clusterConn{
+		cluster:     c,
+		dedicated:   dedicated,
+		readTimeout: readTimeout,
+		name:        name,
+	}
+	if dedicated {
+		cc.conns = make(map[string]redis.Conn)
+	}
+	return cc, nil
+}
+
+// clusterConn implements redis.Conn for a Redis Cluster. Every command is routed according to the slot of its first
+// key, so all the keys of a command must be in the same slot. Commands sent in a pipeline may go to different masters.
+// In that case, they are executed in order, but not in a single round trip. Transactions are not supported.
+//
+// Close may be called concurrently with the other methods, to interrupt a blocking command.
+type clusterConn struct {
+	cluster     *cluster
+	dedicated   bool
+	readTimeout time.Duration
+	name        string
+
+	pending [][]interface{}
+	replies []interface{}
+
+	// mu guards the fields below.
+	mu     sync.Mutex
+	conns  map[string]redis.Conn
+	closed bool
+}
+
+// Close implements redis.Conn.
+func (cc *clusterConn) Close() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.closed = true
+	var err error
+	for addr, conn := range cc.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(cc.conns, addr)
+	}
+	return err
+}
+
+// Err implements redis.Conn.
+func (cc *clusterConn) Err() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.closed {
+		return errClosed
+	}
+	return nil
+}
+
+// Do implements redis.Conn.
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		if len(cc.pending) == 0 {
+			return nil, nil
+		}
+		err := cc.Flush()
+		if err != nil {
+			return nil, err
+		}
+		replies := cc.replies
+		cc.replies = nil
+		return replies, nil
+	}
+
+	err := cc.Send(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	err = cc.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	// Like redigo, return the last reply and the first error among the replies.
+	var first error
+	for _, r := range cc.replies {
+		if e, ok := r.(redis.Error); ok && first == nil {
+			first = e
+		}
+	}
+	reply := cc.replies[len(cc.replies)-1]
+	cc.replies = nil
+	return reply, first
+}
+
+// Send implements redis.Conn.
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+	if err := cc.Err(); err != nil {
+		return err
+	}
+	cc.pending = append(cc.pending, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+// Flush implements redis.Conn. It executes the pending commands and keeps their replies for Receive.
+func (cc *clusterConn) Flush() error {
+	pending := cc.pending
+	cc.pending = nil
+
+	for _, c := range pending {
+		reply, err := cc.execute(c[0].(string), c[1:])
+		if e, ok := err.(redis.Error); ok {
+			reply = e
+		} else if err != nil {
+			return err
+		}
+		cc.replies = append(cc.replies, reply)
+	}
+	return nil
+}
+
+// Receive implements redis.Conn.
+func (cc *clusterConn) Receive() (interface{}, error) {
+	if len(cc.replies) == 0 {
+		err := cc.Flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cc.replies) == 0 {
+		return nil, errors.New("redis cluster: no pending replies")
+	}
+
+	reply := cc.replies[0]
+	cc.replies = cc.replies[1:]
+	if e, ok := reply.(redis.Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// execute runs a single command on the right master, following redirections.
+func (cc *clusterConn) execute(cmd string, args []interface{}) (interface{}, error) {
+	slot := commandSlot(cmd, args)
+
+	addr, err := cc.cluster.nodeFor(context.Background(), slot)
+	if err != nil {
+		return nil, err
+	}
+
+	asking := false
+	for i := 0; ; i++ {
+		reply, err := cc.executeOn(addr, asking, cmd, args)
+		e, ok := err.(redis.Error)
+		if !ok || i == maxRedirects {
+			return reply, err
+		}
+
+		kind, target := parseRedirect(string(e))
+		switch kind {
+		case "MOVED":
+			cc.cluster.moved(slot, target)
+			addr, asking = target, false
+		case "ASK":
+			addr, asking = target, true
+		case "TRYAGAIN", "CLUSTERDOWN":
+			time.Sleep(time.Millisecond * 100)
+		default:
+			return reply, err
+		}
+	}
+}
+
+func (cc *clusterConn) executeOn(addr string, asking bool, cmd string, args []interface{}) (interface{}, error) {
+	conn, release, err := cc.nodeConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if asking {
+		err = conn.Send("ASKING")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := conn.Do(cmd, args...)
+	if err != nil && !cc.dedicated {
+		return reply, err
+	}
+	if err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			// The connection is broken, so it has to be dialed again.
+			cc.dropConn(addr, conn)
+		}
+	}
+	return reply, err
+}
+
+// nodeConn returns a connection to the node and a function that releases it.
+func (cc *clusterConn) nodeConn(addr string) (redis.Conn, func(), error) {
+	if !cc.dedicated {
+		conn, err := cc.cluster.pool(addr).GetContext(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, func() { conn.Close() }, nil
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.closed {
+		return nil, nil, errClosed
+	}
+
+	conn, ok := cc.conns[addr]
+	if !ok {
+		var err error
+		conn, err = cc.cluster.dial(context.Background(), addr, cc.readTimeout, cc.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		cc.conns[addr] = conn
+	}
+	return conn, func() {}, nil
+}
+
+func (cc *clusterConn) dropConn(addr string, conn redis.Conn) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.conns[addr] == conn {
+		delete(cc.conns, addr)
+	}
+	conn.Close()
+}
+
+// commandSlot returns the slot of the first key of the command, or -1 if the command has no keys.
+func commandSlot(cmd string, args []interface{}) int {
+	switch strings.ToUpper(cmd) {
+	case "EVAL", "EVALSHA", "BLMPOP":
+		return numkeysSlot(args, 1)
+	case "LMPOP":
+		return numkeysSlot(args, 0)
+	case "PING", "INFO", "SCRIPT", "CLUSTER", "ROLE", "CLIENT", "TIME", "DBSIZE", "FLUSHDB", "FLUSHALL", "PUBLISH":
+		return -1
+	}
+	if len(args) == 0 {
+		return -1
+	}
+	return redisutil.HashSlot(keyString(args[0]))
+}
+
+// numkeysSlot returns the slot of the first key of a command whose keys follow their number at args[i], or -1 if it has
+// no keys.
+func numkeysSlot(args []interface{}, i int) int {
+	if len(args) < i+2 {
+		return -1
+	}
+	n, err := strconv.Atoi(keyString(args[i]))
+	if err != nil || n == 0 {
+		return -1
+	}
+	return redisutil.HashSlot(keyString(args[i+1]))
+}
+
+func keyString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseRedirect parses an error such as "MOVED 3999 127.0.0.1:6381" and returns its kind and target address.
+func parseRedirect(msg string) (kind, addr string) {
+	parts := strings.Fields(msg)
+	if len(parts) == 0 {
+		return "", ""
+	}
+	if len(parts) == 3 && (parts[0] == "MOVED" || parts[0] == "ASK") {
+		return parts[0], parts[2]
+	}
+	return parts[0], ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+)
+
+func TestCommandSlot(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal(redisutil.HashSlot("queue:{default}"), commandSlot("LPUSH", []interface{}{"queue:{default}", "x"}))
+	assert.Equal(redisutil.HashSlot("retry"), commandSlot("evalsha", []interface{}{"abc", 3, []byte("retry"), "q"}))
+	assert.Equal(-1, commandSlot("EVAL", []interface{}{"return 1", 0}))
+	assert.Equal(-1, commandSlot("PING", nil))
+
+	// The timeout and the number of keys come before the keys.
+	assert.Equal(
+		redisutil.HashSlot("queue:{a}"),
+		commandSlot("BLMPOP", []interface{}{2, 2, "queue:{a}", "queue:{a}:low", "RIGHT", "COUNT", 10}),
+	)
+	assert.Equal(redisutil.HashSlot("queue:{a}"), commandSlot("LMPOP", []interface{}{1, "queue:{a}", "RIGHT"}))
+	assert.Equal(-1, commandSlot("BLMPOP", []interface{}{2}))
+}
+
+func TestParseRedirect(t *testing.T) {
+	assert := require.New(t)
+
+	kind, addr := parseRedirect("MOVED 3999 127.0.0.1:6381")
+	assert.Equal("MOVED", kind)
+	assert.Equal("127.0.0.1:6381", addr)
+
+	kind, addr = parseRedirect("ASK 3999 127.0.0.1:6382")
+	assert.Equal("ASK", kind)
+	assert.Equal("127.0.0.1:6382", addr)
+
+	kind, _ = parseRedirect("TRYAGAIN Multiple keys request during rehashing of slot")
+	assert.Equal("TRYAGAIN", kind)
+}
+
+func TestMoved(t *testing.T) {
+	assert := require.New(t)
+
+	c := newCluster(&Config{}, nil, "")
+	c.moved(42, "127.0.0.1:6381")
+	assert.Equal("127.0.0.1:6381", c.lookup(42))
+
+	// A command without keys has no slot, but the node is still learned.
+	c.moved(-1, "127.0.0.1:6382")
+	assert.Contains(c.nodes, "127.0.0.1:6382")
+}
@@ -5,8 +5,54 @@ import "time"
 // Config holds the configuration for Redis connections.
 type Config struct {
 	// URL is used to connect to Redis.
+	//
+	// When Sentinel is enabled, the host and port in the URL are ignored and replaced by the address of the current
+	// master, but the rest of the URL, such as the password and the database, still applies.
 	URL string
 
+	// Username is the ACL username. If it is set, it takes precedence over the username in the URL.
+	Username string
+
+	// Password is used for authentication, with the ACL username or with requirepass. If it is set, it takes
+	// precedence over the password in the URL.
+	Password string
+
+	// TLS enables TLS with the given settings, even for URLs with the redis:// scheme. URLs with the rediss:// scheme
+	// use TLS with the default settings if it is nil.
+	TLS *TLSConfig
+
+	// ClientName is the prefix of the names given to the connections with CLIENT SETNAME, so that they can be told
+	// apart in CLIENT LIST. The name continues with the identity of the Node, or the host name and process ID if it is
+	// not known, and ends with the component that uses the connection, such as "pool" or "dequeuer". It is empty by
+	// default, which disables naming, since the CLIENT command may not be allowed.
+	ClientName string
+
+	// Namespace is the prefix of all the keys used by gokogeri, compatible with the redis-namespace gem used by older
+	// Sidekiq applications. For example, with the namespace "billing", the default queue is stored at the key
+	// "billing:queue:default". It allows many applications to share a Redis database. An empty namespace means no
+	// prefix.
+	Namespace string
+
+	// SentinelMasterName enables Redis Sentinel. It is the name of the master, as configured in the sentinels.
+	SentinelMasterName string
+
+	// SentinelAddrs holds the addresses of the sentinels, in the host:port format.
+	SentinelAddrs []string
+
+	// SentinelUsername is the ACL username used to authenticate with the sentinels, if they require it.
+	SentinelUsername string
+
+	// SentinelPassword is the password used to authenticate with the sentinels, if they require it.
+	SentinelPassword string
+
+	// SentinelTLS enables TLS for the connections to the sentinels.
+	SentinelTLS *TLSConfig
+
+	// ClusterAddrs enables Redis Cluster. It holds the addresses of some of the nodes, in the host:port format, which
+	// are used to discover the others. The host and port in the URL are ignored, but the rest of the URL, such as the
+	// password, still applies. The database must be 0.
+	ClusterAddrs []string
+
 	// LongPollTimeout is the timeout in seconds for the BRPOP Redis command that reads from the queues. Zero means no
 	// timeout, but it is better that you set a value, because it also has the effect of pinging the connection, to make
 	// sure it is still active.
@@ -40,3 +86,22 @@ func NewDefaultConfig() *Config {
 		WriteTimeout:    time.Second * 5,
 	}
 }
+
+// TLSConfig holds the TLS settings for Redis connections.
+//
+// The files are read for every new connection, so renewed certificates are picked up without a restart.
+type TLSConfig struct {
+	// CAFile is a PEM file with the certificates of the authorities used to verify the server. The system pool is used
+	// if it is empty.
+	CAFile string
+
+	// CertFile and KeyFile are PEM files with the client certificate and its key, for servers that require mutual TLS.
+	CertFile string
+	KeyFile  string
+
+	// ServerName is used to verify the certificate of the server, if it is different from the host being dialed.
+	ServerName string
+
+	// InsecureSkipVerify disables the verification of the server certificate. Use it only for development.
+	InsecureSkipVerify bool
+}
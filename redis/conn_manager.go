@@ -2,6 +2,10 @@ package redis
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -13,48 +17,256 @@ var _ gokogeri.ConnProvider = (*ConnManager)(nil)
 
 // ConnManager implements the ConnProvider interface and encapsulates the process of establishing and configuring Redis
 // connections. The non-dedicated connections use redis.Pool.
+//
+// When Sentinel is enabled, every new connection goes to the current master, as reported by the sentinels. On failover,
+// the pooled connections to the old master are discarded and the long poll connections are closed, so the dequeuers
+// reconnect to the new master.
+//
+// When Cluster is enabled, the connections route every command to the master serving the slot of its first key, and
+// follow the MOVED and ASK redirections. There is one pool for every master.
 type ConnManager struct {
 	cfg  *Config
 	pool redis.Pool
+
+	sentinel *sentinel
+	cluster  *cluster
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	// hostPID is used in the connection names when the identity of the Node is not known.
+	hostPID string
+
+	// mu guards longPoll.
+	mu       sync.Mutex
+	longPoll map[*masterConn]struct{}
 }
 
 // NewConnManager returns a new instance. Make sure to call Close when you are done.
 func NewConnManager(cfg *Config) *ConnManager {
-	return &ConnManager{
+	cm := &ConnManager{
 		cfg: cfg,
 		pool: redis.Pool{
-			DialContext: func(ctx context.Context) (redis.Conn, error) {
-				return redis.DialURLContext(
-					ctx,
-					cfg.URL,
-					redis.DialReadTimeout(cfg.ReadTimeout),
-					redis.DialWriteTimeout(cfg.WriteTimeout),
-				)
-			},
 			MaxIdle:     cfg.MaxIdle,
 			MaxActive:   cfg.MaxActive,
 			IdleTimeout: cfg.IdleTimeout,
 			Wait:        true,
 		},
+		longPoll: make(map[*masterConn]struct{}),
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	cm.hostPID = fmt.Sprintf("%s:%d", host, os.Getpid())
+
+	cm.pool.DialContext = func(ctx context.Context) (redis.Conn, error) {
+		return cm.dial(ctx, cfg.ReadTimeout, cm.clientName(nil, "pool"))
+	}
+
+	if len(cfg.ClusterAddrs) > 0 {
+		cm.cluster = newCluster(cfg, cm.dialAddr, cm.clientName(nil, "pool"))
 	}
+
+	if cfg.SentinelMasterName != "" {
+		cm.sentinel = newSentinel(cfg)
+		cm.pool.TestOnBorrow = cm.testOnBorrow
+
+		var ctx context.Context
+		ctx, cm.cancel = context.WithCancel(context.Background())
+
+		cm.wg.Add(1)
+		go func() {
+			defer cm.wg.Done()
+			cm.sentinel.watch(ctx, cm.onSwitchMaster)
+		}()
+	}
+
+	return cm
 }
 
 // Conn implements ConnProvider. It returns connections from a shared pool.
 func (cm *ConnManager) Conn(ctx context.Context) (redis.Conn, error) {
+	if cm.cluster != nil {
+		return cm.cluster.conn(ctx, false, cm.cfg.ReadTimeout, "")
+	}
 	return cm.pool.GetContext(ctx)
 }
 
 // DialLongPoll implements ConnProvider.
 func (cm *ConnManager) DialLongPoll(ctx context.Context) (redis.Conn, error) {
-	return redis.DialURLContext(
-		ctx,
-		cm.cfg.URL,
-		redis.DialReadTimeout(time.Second*time.Duration(cm.cfg.LongPollTimeout)+cm.cfg.ReadTimeout),
-		redis.DialWriteTimeout(cm.cfg.WriteTimeout),
-	)
+	var info *gokogeri.ConnInfo
+	if i, ok := gokogeri.ConnInfoFromContext(ctx); ok {
+		info = &i
+	}
+
+	readTimeout := time.Second*time.Duration(cm.cfg.LongPollTimeout) + cm.cfg.ReadTimeout
+	name := cm.clientName(info, "long_poll")
+
+	if cm.cluster != nil {
+		return cm.cluster.conn(ctx, true, readTimeout, name)
+	}
+
+	conn, err := cm.dial(ctx, readTimeout, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if mc, ok := conn.(*masterConn); ok {
+		mc.onClose = func() {
+			cm.mu.Lock()
+			delete(cm.longPoll, mc)
+			cm.mu.Unlock()
+		}
+		cm.mu.Lock()
+		cm.longPoll[mc] = struct{}{}
+		cm.mu.Unlock()
+	}
+
+	return conn, nil
+}
+
+// Namespace implements ConnProvider. It returns the namespace from the configuration.
+func (cm *ConnManager) Namespace() string {
+	return cm.cfg.Namespace
+}
+
+// Cluster implements ConnProvider. It reports whether Redis Cluster is enabled.
+func (cm *ConnManager) Cluster() bool {
+	return cm.cluster != nil
+}
+
+// PubSub implements ConnProvider. The connections to a Redis Cluster only read the replies to the commands they
+// send, so they do not support pub/sub.
+func (cm *ConnManager) PubSub() bool {
+	return cm.cluster == nil
 }
 
 // Close releases resources used by the connection pool.
 func (cm *ConnManager) Close() error {
+	if cm.cancel != nil {
+		cm.cancel()
+		cm.sentinel.stopWatching()
+		cm.wg.Wait()
+	}
+	if cm.cluster != nil {
+		cm.cluster.close()
+	}
 	return cm.pool.Close()
 }
+
+func (cm *ConnManager) dial(ctx context.Context, readTimeout time.Duration, name string) (redis.Conn, error) {
+	if cm.sentinel == nil {
+		return cm.dialAddr(ctx, "", readTimeout, name)
+	}
+
+	master, err := cm.sentinel.discoverMaster(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := cm.dialAddr(ctx, master, readTimeout, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkRole(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %v", master, err)
+	}
+
+	return &masterConn{Conn: conn, addr: master}, nil
+}
+
+// dialAddr dials the address, or the one in the URL if it is empty, with the rest of the settings from the URL and the
+// configuration.
+func (cm *ConnManager) dialAddr(
+	ctx context.Context,
+	addr string,
+	readTimeout time.Duration,
+	name string,
+) (redis.Conn, error) {
+	e, err := parseURL(cm.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if addr == "" {
+		addr = e.addr
+	}
+
+	opts, err := e.dialOptions(cm.cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, redis.DialReadTimeout(readTimeout))
+
+	return redis.DialContext(ctx, "tcp", addr, opts...)
+}
+
+// clientName returns the name of a new connection, or an empty string if naming is disabled. The component is used if
+// the connection information is missing.
+func (cm *ConnManager) clientName(info *gokogeri.ConnInfo, component string) string {
+	if cm.cfg.ClientName == "" {
+		return ""
+	}
+
+	id := cm.hostPID
+	if info != nil {
+		if info.Identity != "" {
+			id = info.Identity
+		}
+		if info.Component != "" {
+			component = info.Component
+		}
+	}
+
+	// Names cannot contain spaces.
+	return strings.ReplaceAll(strings.Join([]string{cm.cfg.ClientName, id, component}, ":"), " ", "_")
+}
+
+// testOnBorrow discards pooled connections to a master that has been replaced.
+func (cm *ConnManager) testOnBorrow(c redis.Conn, _ time.Time) error {
+	mc, ok := c.(*masterConn)
+	if !ok {
+		return nil
+	}
+	if master := cm.sentinel.currentMaster(); master != "" && mc.addr != master {
+		return errNotMaster
+	}
+	return nil
+}
+
+// onSwitchMaster closes the long poll connections to the old master. The dequeuers using them will reconnect.
+func (cm *ConnManager) onSwitchMaster(master string) {
+	cm.mu.Lock()
+	var stale []*masterConn
+	for mc := range cm.longPoll {
+		if mc.addr != master {
+			stale = append(stale, mc)
+		}
+	}
+	cm.mu.Unlock()
+
+	for _, mc := range stale {
+		mc.Close()
+	}
+}
+
+// masterConn is a connection to a master discovered through Sentinel.
+type masterConn struct {
+	redis.Conn
+
+	// addr is the address of the master.
+	addr string
+
+	// onClose is called when the connection is closed.
+	onClose func()
+}
+
+func (c *masterConn) Close() error {
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return c.Conn.Close()
+}
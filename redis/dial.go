@@ -0,0 +1,154 @@
+package redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// endpoint holds what is needed to dial Redis, as parsed from a URL.
+type endpoint struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+}
+
+var pathDBRegexp = regexp.MustCompile(`^/(\d*)$`)
+
+// parseURL parses a URL with the redis:// or rediss:// scheme, in the same way as redis.DialURL.
+func parseURL(rawurl string) (*endpoint, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %v", err)
+	}
+
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid redis URL scheme: %s", u.Scheme)
+	}
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		// The port is missing.
+		host = u.Host
+		port = "6379"
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	e := &endpoint{
+		addr: net.JoinHostPort(host, port),
+		tls:  u.Scheme == "rediss",
+	}
+
+	if u.User != nil {
+		password, isSet := u.User.Password()
+		if isSet {
+			e.username = u.User.Username()
+			e.password = password
+		} else {
+			// redis-cli treats a single value in the user info as the password.
+			e.password = u.User.Username()
+		}
+	}
+
+	if u.Path != "" {
+		match := pathDBRegexp.FindStringSubmatch(u.Path)
+		if match == nil {
+			return nil, fmt.Errorf("invalid database: %s", strings.TrimPrefix(u.Path, "/"))
+		}
+		if match[1] != "" {
+			e.db, err = strconv.Atoi(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid database: %s", match[1])
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// dialOptions returns the options for dialing the endpoint, with the overrides from the configuration.
+func (e *endpoint) dialOptions(cfg *Config, name string) ([]redis.DialOption, error) {
+	username := e.username
+	password := e.password
+	if cfg.Username != "" {
+		username = cfg.Username
+	}
+	if cfg.Password != "" {
+		password = cfg.Password
+	}
+
+	opts := []redis.DialOption{
+		redis.DialUsername(username),
+		redis.DialPassword(password),
+		redis.DialDatabase(e.db),
+		redis.DialWriteTimeout(cfg.WriteTimeout),
+	}
+
+	if name != "" {
+		opts = append(opts, redis.DialClientName(name))
+	}
+
+	tlsOpts, err := tlsDialOptions(cfg.TLS, e.tls)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, tlsOpts...), nil
+}
+
+// tlsDialOptions returns the options for TLS. TLS is enabled if the configuration is not nil or if the default is to
+// use it.
+func tlsDialOptions(cfg *TLSConfig, useTLS bool) ([]redis.DialOption, error) {
+	if cfg == nil {
+		return []redis.DialOption{redis.DialUseTLS(useTLS)}, nil
+	}
+
+	tc, err := cfg.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return []redis.DialOption{
+		redis.DialUseTLS(true),
+		redis.DialTLSConfig(tc),
+	}, nil
+}
+
+func (c *TLSConfig) load() (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %v", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the CA file %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
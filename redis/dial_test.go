@@ -0,0 +1,53 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kapvode/gokogeri"
+)
+
+func TestParseURL(t *testing.T) {
+	testCases := []struct {
+		url  string
+		want endpoint
+	}{
+		{"redis://localhost", endpoint{addr: "localhost:6379"}},
+		{"redis://", endpoint{addr: "localhost:6379"}},
+		{"redis://example.com:6380/4", endpoint{addr: "example.com:6380", db: 4}},
+		{"rediss://secret@example.com/", endpoint{addr: "example.com:6379", password: "secret", tls: true}},
+		{"redis://:secret@example.com", endpoint{addr: "example.com:6379", password: "secret"}},
+		{"redis://app:secret@[::1]:6380", endpoint{addr: "[::1]:6380", username: "app", password: "secret"}},
+	}
+
+	assert := require.New(t)
+
+	for _, tc := range testCases {
+		e, err := parseURL(tc.url)
+		assert.NoError(err, tc.url)
+		assert.Equal(tc.want, *e, tc.url)
+	}
+
+	_, err := parseURL("http://localhost")
+	assert.ErrorContains(err, "invalid redis URL scheme")
+
+	_, err = parseURL("redis://localhost/db")
+	assert.ErrorContains(err, "invalid database")
+}
+
+func TestClientName(t *testing.T) {
+	assert := require.New(t)
+
+	cm := &ConnManager{cfg: &Config{ClientName: "billing"}, hostPID: "web-1:42"}
+
+	assert.Equal("billing:web-1:42:pool", cm.clientName(nil, "pool"))
+	assert.Equal("billing:web-1:42:long_poll", cm.clientName(&gokogeri.ConnInfo{}, "long_poll"))
+	assert.Equal(
+		"billing:web-1:42:abc:dequeuer",
+		cm.clientName(&gokogeri.ConnInfo{Identity: "web-1:42:abc", Component: "dequeuer"}, "long_poll"),
+	)
+
+	cm.cfg.ClientName = ""
+	assert.Equal("", cm.clientName(nil, "pool"))
+}
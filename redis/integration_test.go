@@ -0,0 +1,62 @@
+//go:build integration
+
+package redis_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kapvode/gokogeri/redis"
+)
+
+// TestSentinel needs a master monitored by local sentinels, for example:
+//
+//	redis-server --port 6380
+//	redis-sentinel sentinel.conf # sentinel monitor mymaster 127.0.0.1 6380 1
+//
+//	GOKOGERI_SENTINEL_ADDRS=localhost:26379 GOKOGERI_SENTINEL_MASTER=mymaster go test -tags integration ./redis
+func TestSentinel(t *testing.T) {
+	addrs := os.Getenv("GOKOGERI_SENTINEL_ADDRS")
+	master := os.Getenv("GOKOGERI_SENTINEL_MASTER")
+	if addrs == "" || master == "" {
+		t.Skip("GOKOGERI_SENTINEL_ADDRS and GOKOGERI_SENTINEL_MASTER are not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	cfg := redis.NewDefaultConfig()
+	cfg.URL = "redis://ignored/10"
+	cfg.SentinelMasterName = master
+	cfg.SentinelAddrs = append([]string{"localhost:1"}, strings.Split(addrs, ",")...)
+
+	cm := redis.NewConnManager(cfg)
+	defer cm.Close()
+
+	assert := require.New(t)
+
+	conn, err := cm.Conn(ctx)
+	assert.NoError(err)
+	defer conn.Close()
+
+	role, err := redigo.Values(conn.Do("ROLE"))
+	assert.NoError(err)
+	assert.Equal([]byte("master"), role[0])
+
+	_, err = conn.Do("SET", "sentinel_test", "1")
+	assert.NoError(err)
+
+	lp, err := cm.DialLongPoll(ctx)
+	assert.NoError(err)
+	defer lp.Close()
+
+	v, err := redigo.String(lp.Do("GET", "sentinel_test"))
+	assert.NoError(err)
+	assert.Equal("1", v)
+}
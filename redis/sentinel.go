@@ -0,0 +1,229 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// errNotMaster is returned when a connection does not lead to the current master.
+var errNotMaster = errors.New("not connected to the master")
+
+// sentinel discovers the current master through Redis Sentinel and watches for failovers.
+// It is safe for concurrent use.
+type sentinel struct {
+	cfg *Config
+
+	// mu guards the fields below.
+	mu    sync.Mutex
+	addrs []string
+	// master is the last known address of the master.
+	master string
+	// watchConn is the connection used to receive failover notifications.
+	watchConn redis.Conn
+}
+
+func newSentinel(cfg *Config) *sentinel {
+	addrs := make([]string, len(cfg.SentinelAddrs))
+	copy(addrs, cfg.SentinelAddrs)
+	return &sentinel{
+		cfg:   cfg,
+		addrs: addrs,
+	}
+}
+
+// currentMaster returns the last known address of the master, which can be empty.
+func (s *sentinel) currentMaster() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.master
+}
+
+// discoverMaster asks the sentinels, in order, for the address of the master. The first sentinel that responds is
+// moved to the front of the list, so it is asked first next time.
+func (s *sentinel) discoverMaster(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	addrs := make([]string, len(s.addrs))
+	copy(addrs, s.addrs)
+	s.mu.Unlock()
+
+	var errs []string
+	for i, addr := range addrs {
+		master, err := s.queryMaster(ctx, addr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+			continue
+		}
+
+		s.mu.Lock()
+		if i > 0 {
+			s.addrs = append([]string{addr}, append(addrs[:i:i], addrs[i+1:]...)...)
+		}
+		s.master = master
+		s.mu.Unlock()
+
+		return master, nil
+	}
+
+	return "", fmt.Errorf("no sentinel knows the master %q: %s", s.cfg.SentinelMasterName, strings.Join(errs, "; "))
+}
+
+func (s *sentinel) queryMaster(ctx context.Context, addr string) (string, error) {
+	conn, err := s.dial(ctx, addr, s.cfg.ReadTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	res, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.cfg.SentinelMasterName))
+	if err != nil {
+		return "", err
+	}
+	if len(res) != 2 {
+		return "", fmt.Errorf("expected 2 values for the master address, got %d", len(res))
+	}
+	return net.JoinHostPort(res[0], res[1]), nil
+}
+
+func (s *sentinel) dial(ctx context.Context, addr string, readTimeout time.Duration) (redis.Conn, error) {
+	opts, err := tlsDialOptions(s.cfg.SentinelTLS, false)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(
+		opts,
+		redis.DialUsername(s.cfg.SentinelUsername),
+		redis.DialPassword(s.cfg.SentinelPassword),
+		redis.DialReadTimeout(readTimeout),
+		redis.DialWriteTimeout(s.cfg.WriteTimeout),
+	)
+
+	return redis.DialContext(ctx, "tcp", addr, opts...)
+}
+
+// watch subscribes to failover notifications and calls onSwitch with the address of the new master, until the Context
+// is cancelled. If the connection to a sentinel is lost, it connects to the next one.
+func (s *sentinel) watch(ctx context.Context, onSwitch func(master string)) {
+	for ctx.Err() == nil {
+		err := s.watchOnce(ctx, onSwitch)
+		if err != nil && ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+func (s *sentinel) watchOnce(ctx context.Context, onSwitch func(master string)) error {
+	s.mu.Lock()
+	addrs := make([]string, len(s.addrs))
+	copy(addrs, s.addrs)
+	s.mu.Unlock()
+
+	var conn redis.Conn
+	var err error
+	for _, addr := range addrs {
+		// No read timeout, because the connection waits for notifications. It is closed on shutdown.
+		conn, err = s.dial(ctx, addr, 0)
+		if err == nil {
+			break
+		}
+	}
+	if conn == nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.watchConn = conn
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.watchConn = nil
+		s.mu.Unlock()
+	}()
+
+	// The connection may have been established after the Context was cancelled, but before watchConn was set.
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	psc := redis.PubSubConn{Conn: conn}
+	err = psc.Subscribe("+switch-master")
+	if err != nil {
+		return err
+	}
+
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.Subscription:
+			// A failover may have happened while no sentinel was watched, such as between two connections.
+			s.resync(ctx, onSwitch)
+		case redis.Message:
+			name, master, ok := parseSwitchMaster(string(msg.Data))
+			if !ok || name != s.cfg.SentinelMasterName {
+				continue
+			}
+			s.mu.Lock()
+			s.master = master
+			s.mu.Unlock()
+			onSwitch(master)
+		case error:
+			return msg
+		}
+	}
+}
+
+// resync asks the sentinels for the address of the master, and calls onSwitch if it is not the last known one.
+func (s *sentinel) resync(ctx context.Context, onSwitch func(master string)) {
+	old := s.currentMaster()
+	master, err := s.discoverMaster(ctx)
+	if err == nil && master != old {
+		onSwitch(master)
+	}
+}
+
+// stopWatching closes the connection used for failover notifications, which unblocks watch.
+func (s *sentinel) stopWatching() {
+	s.mu.Lock()
+	if s.watchConn != nil {
+		s.watchConn.Close()
+	}
+	s.mu.Unlock()
+}
+
+// parseSwitchMaster parses a +switch-master message: "<name> <old-ip> <old-port> <new-ip> <new-port>".
+func parseSwitchMaster(msg string) (name, master string, ok bool) {
+	parts := strings.Fields(msg)
+	if len(parts) != 5 {
+		return "", "", false
+	}
+	return parts[0], net.JoinHostPort(parts[3], parts[4]), true
+}
+
+// checkRole verifies that the connection leads to a master, as the sentinel might have reported an outdated address.
+func checkRole(conn redis.Conn) error {
+	res, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return fmt.Errorf("check role: %v", err)
+	}
+	if len(res) == 0 {
+		return fmt.Errorf("check role: empty reply")
+	}
+	role, err := redis.String(res[0], nil)
+	if err != nil {
+		return fmt.Errorf("check role: %v", err)
+	}
+	if role != "master" {
+		return errNotMaster
+	}
+	return nil
+}
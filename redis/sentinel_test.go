@@ -0,0 +1,23 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSwitchMaster(t *testing.T) {
+	assert := require.New(t)
+
+	name, master, ok := parseSwitchMaster("mymaster 10.0.0.1 6379 10.0.0.2 6380")
+	assert.True(ok)
+	assert.Equal("mymaster", name)
+	assert.Equal("10.0.0.2:6380", master)
+
+	_, _, ok = parseSwitchMaster("mymaster 10.0.0.1 6379")
+	assert.False(ok)
+
+	_, master, ok = parseSwitchMaster("mymaster ::1 6379 ::2 6380")
+	assert.True(ok)
+	assert.Equal("[::2]:6380", master)
+}
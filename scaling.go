@@ -0,0 +1,206 @@
+package gokogeri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+)
+
+// errStopped is returned when scaling a queue set that has stopped.
+var errStopped = errors.New("the queue set has stopped")
+
+// errRemoved is returned when removing a queue set that was already removed.
+var errRemoved = errors.New("the queue set was already removed")
+
+// A QueueSetHandle controls the processing of a queue set registered with a Node. It is safe for concurrent use.
+type QueueSetHandle struct {
+	n *Node
+	m *workerManager
+}
+
+// Remove stops processing the queue set and removes it from the Node, while the other queue sets keep running. Like
+// Node.Stop, it lets the jobs in progress finish, until the Context expires and the Context passed to the Workers is
+// cancelled. It blocks until the Workers have returned.
+func (h *QueueSetHandle) Remove(ctx context.Context) error {
+	return h.n.unregister(ctx, h.m)
+}
+
+// Instances returns the current number of Worker instances.
+func (h *QueueSetHandle) Instances() int {
+	return h.m.getInstances()
+}
+
+// Scale changes the number of Worker instances, at least 1, while the Node is running or before. New instances start
+// right away. Instances that are removed finish their current job first.
+func (h *QueueSetHandle) Scale(instances int) error {
+	return h.m.scale(instances)
+}
+
+// Autoscale makes the Node call the function at every interval while the queue set is running, and scale it to the
+// number of instances it returns. Call it once, before or after Run.
+func (h *QueueSetHandle) Autoscale(interval time.Duration, fn AutoscaleFunc) {
+	m := h.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.autoscaler = fn
+	m.autoscaleInterval = interval
+	if m.running {
+		go m.autoscale(fn, interval)
+	}
+}
+
+// AutoscaleFunc returns the desired number of Worker instances for a queue set, given its current state.
+type AutoscaleFunc func(ScaleState) int
+
+// ScaleState describes a queue set for an AutoscaleFunc.
+type ScaleState struct {
+	// QueueSet holds the names of the queues.
+	QueueSet []string
+
+	// Instances is the current number of Worker instances.
+	Instances int
+
+	// Busy is the number of instances processing a job.
+	Busy int
+
+	// Backlog is the number of jobs waiting in the queues, on all the shards.
+	Backlog int64
+}
+
+func (m *workerManager) getInstances() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.instances
+}
+
+func (m *workerManager) scale(instances int) error {
+	if instances < 1 {
+		return fmt.Errorf("invalid number of instances: %d", instances)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.draining {
+		return errStopped
+	}
+
+	delta := instances - m.instances
+	m.instances = instances
+	if m.cap != nil {
+		m.cap.add(delta)
+	}
+	if !m.running {
+		return nil
+	}
+
+	if delta > 0 {
+		// Keep the instances that have not retired yet.
+		kept := delta
+		if kept > m.retiring {
+			kept = m.retiring
+		}
+		m.retiring -= kept
+		m.startWorkers(delta - kept)
+	} else if delta < 0 {
+		m.retiring += -delta
+		close(m.retireSignal)
+		m.retireSignal = make(chan struct{})
+	}
+
+	m.log.Info().Int("instances", instances).Msg("Scaled")
+	return nil
+}
+
+func (m *workerManager) autoscale(fn AutoscaleFunc, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		backlog, err := m.backlog(ctx)
+		cancel()
+		if err != nil {
+			m.log.Error().Err(err).Msg("Failed to get the backlog for autoscaling")
+			continue
+		}
+
+		instances := m.getInstances()
+
+		desired := fn(ScaleState{
+			QueueSet:  m.qset.Names(),
+			Instances: instances,
+			Busy:      int(atomic.LoadInt64(&m.busy)),
+			Backlog:   backlog,
+		})
+		if desired == instances {
+			continue
+		}
+
+		err = m.scale(desired)
+		if err != nil && err != errStopped {
+			m.log.Error().Err(err).Msg("Failed to autoscale")
+		}
+	}
+}
+
+// backlog returns the number of jobs in the queues of the manager, on all the shards.
+func (m *workerManager) backlog(ctx context.Context) (int64, error) {
+	names := m.qset.Names()
+
+	var total int64
+	for _, f := range m.dqfs {
+		n, err := queueSizes(ctx, f.cp, f.keys, names)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// queueSizes returns the number of jobs waiting in the queues, including those with a priority.
+func queueSizes(ctx context.Context, cp ConnProvider, keys keyspace, queues []string) (int64, error) {
+	conn, err := cp.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	for _, q := range queues {
+		err = conn.Send("LLEN", keys.queue(q))
+		if err != nil {
+			return 0, fmt.Errorf("send: %v", err)
+		}
+		err = conn.Send("ZCARD", keys.priorityQueue(q))
+		if err != nil {
+			return 0, fmt.Errorf("send: %v", err)
+		}
+	}
+
+	replies, err := redisutil.DoMany(conn, len(queues)*2)
+	if err != nil {
+		return 0, fmt.Errorf("queue sizes: %v", err)
+	}
+
+	var total int64
+	for _, r := range replies {
+		n, err := redisutil.Int64(r)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,79 @@
+package gokogeri
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerScale(t *testing.T) {
+	assert := require.New(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	started := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	w := WorkerFunc(func(ctx context.Context, j *Job) error {
+		started <- struct{}{}
+		<-unblock
+		return nil
+	})
+
+	m := newWorkerManager(zerolog.Nop(), nil, &processStats{}, OrderedQueueSet{"default"}, w, 1)
+	m.setPrefetch(10)
+	// Stands in for a dequeuer.
+	m.fetchers.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+
+	deliver := func(count int) {
+		for i := 0; i < count; i++ {
+			m.c <- workItem{Q: "default", P: []byte(`{"class":"TestJob","jid":"1"}`)}
+		}
+	}
+
+	// Counts the jobs that start within a short time.
+	startedSoon := func() int {
+		n := 0
+		for {
+			select {
+			case <-started:
+				n++
+			case <-time.After(time.Millisecond * 50):
+				return n
+			}
+		}
+	}
+
+	assert.NoError(m.scale(3))
+	deliver(4)
+	assert.Equal(3, startedSoon())
+
+	assert.NoError(m.scale(1))
+	assert.Equal(1, m.getInstances())
+	assert.Error(m.scale(0))
+
+	// The busy workers finish their jobs, the remaining one is taken by the only worker left.
+	unblock <- struct{}{}
+	unblock <- struct{}{}
+	unblock <- struct{}{}
+	assert.Equal(1, startedSoon())
+
+	deliver(1)
+	unblock <- struct{}{}
+	assert.Equal(1, startedSoon())
+
+	close(unblock)
+	m.fetchers.Done()
+	<-done
+	assert.NoError(ctx.Err())
+	assert.Equal(0, m.retiring)
+}
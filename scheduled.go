@@ -0,0 +1,142 @@
+package gokogeri
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// DefaultSchedulePollInterval is how often a Node pushes the scheduled jobs that are due to their queues.
+const DefaultSchedulePollInterval = time.Second * 5
+
+// pollScheduled pushes the scheduled jobs that are due to their queues, at every interval with a random jitter, until
+// the Context is cancelled. It checks every Redis instance that the Node reads queues from. It pauses while the Node is
+// quiet, like Sidekiq.
+func (n *Node) pollScheduled(ctx context.Context) {
+	log := n.rawLog.With().Str("component", "scheduler").Logger()
+	rnd := newRand()
+
+	for {
+		// Between half and one and a half intervals, so that the nodes do not all poll at once.
+		d := time.Duration(float64(n.schedulePollInterval) * (0.5 + rnd.Float64()))
+		if !sleep(ctx, d) {
+			return
+		}
+		if atomic.LoadInt32(&n.quiet) == 1 {
+			continue
+		}
+
+		for _, cp := range n.providers() {
+			err := enqueueDue(ctx, log, cp, newKeyspaceFor(cp), time.Now())
+			if err != nil && ctx.Err() == nil {
+				log.Error().Err(err).Msg("Failed to enqueue the scheduled jobs")
+			}
+		}
+	}
+}
+
+// providers returns the distinct providers of the Node and of its sharded queue sets.
+func (n *Node) providers() []ConnProvider {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	cps := []ConnProvider{n.cp}
+	for m := range n.sharded {
+		for _, f := range m.dqfs {
+			if !containsProvider(cps, f.cp) {
+				cps = append(cps, f.cp)
+			}
+		}
+	}
+	return cps
+}
+
+func containsProvider(list []ConnProvider, cp ConnProvider) bool {
+	for _, v := range list {
+		if v == cp {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueueDue pushes the jobs of the schedule set that are due at the given time to their queues. A job is only pushed
+// by the process that removed it from the set, so several processes can do it at once.
+func enqueueDue(ctx context.Context, log zerolog.Logger, cp ConnProvider, keys keyspace, now time.Time) error {
+	conn, err := cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	key := keys.sortedSet(ScheduleSet)
+	for ctx.Err() == nil {
+		payloads, err := redis.ByteSlices(conn.Do("ZRANGEBYSCORE", key, "-inf", sidekiq.Time(now), "LIMIT", 0, pageSize))
+		if err != nil {
+			return fmt.Errorf("get due jobs: %v", err)
+		}
+
+		for _, p := range payloads {
+			removed, err := redis.Int(conn.Do("ZREM", key, p))
+			if err != nil {
+				return fmt.Errorf("remove due job: %v", err)
+			}
+			if removed == 0 {
+				// Another process took it.
+				continue
+			}
+
+			j, err := newJobFromJSON(p)
+			if err != nil {
+				log.Warn().Err(err).Msg("Dropping an invalid scheduled job")
+				continue
+			}
+
+			err = pushPayload(conn, keys, j, setEnqueuedAt(p, now))
+			if err != nil {
+				// Put it back for the next attempt.
+				_, _ = conn.Do("ZADD", key, sidekiq.Time(now), p)
+				return err
+			}
+
+			if j.enc.UniqueUntil == UniqueWhileScheduled && j.enc.UniqueKey != "" {
+				err = unlockUnique(conn, keys, j)
+				if err != nil {
+					log.Warn().Err(err).Str("job_id", j.ID()).Msg("Failed to release the unique lock")
+				}
+			}
+		}
+
+		if len(payloads) < pageSize {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// setEnqueuedAt returns the payload with the time it was pushed to its queue, keeping the fields that are unknown to
+// gokogeri. It returns the payload unchanged if it cannot be decoded.
+func setEnqueuedAt(payload []byte, t time.Time) []byte {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	var fields map[string]interface{}
+	if dec.Decode(&fields) != nil {
+		return payload
+	}
+	fields["enqueued_at"] = sidekiq.Time(t)
+
+	enc, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return enc
+}
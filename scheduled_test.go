@@ -0,0 +1,26 @@
+package gokogeri
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+func TestSetEnqueuedAt(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Unix(1700000000, 0)
+
+	// Fields unknown to gokogeri and large numbers are kept.
+	p := setEnqueuedAt([]byte(`{"class":"A","args":[12345678901234567890],"tags":["x"]}`), now)
+	j, err := newJobFromJSON(p)
+	assert.NoError(err)
+	assert.Equal(sidekiq.Time(now), j.enc.EnqueuedAt)
+	assert.Contains(string(p), `"args":[12345678901234567890]`)
+	assert.Contains(string(p), `"tags":["x"]`)
+
+	assert.Equal([]byte("nope"), setEnqueuedAt([]byte("nope"), now))
+}
@@ -0,0 +1,100 @@
+package gokogeri
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// A Router chooses the Redis instance where a job is stored, in the form of its ConnProvider.
+type Router interface {
+	// Route returns the provider for the job. The job already has its queue set.
+	Route(j *Job) ConnProvider
+}
+
+var _ Router = (*Shards)(nil)
+
+// Shards spreads jobs across several Redis instances, called shards, similar to Sidekiq::Client.via. A job goes to the
+// shard assigned to its queue, if there is one. Otherwise, the shard is chosen by hashing the shard key of the job, or
+// the name of its queue if it has no key. Hashing by queue keeps every queue on one shard.
+//
+// Do not change the shards or the assignments while jobs are being enqueued, as that would move the queues and leave
+// the jobs stored on the old shards behind, unless every shard is processed.
+type Shards struct {
+	providers []ConnProvider
+	queues    map[string]int
+}
+
+// NewShards returns a new instance. It panics if no provider is given.
+func NewShards(providers ...ConnProvider) *Shards {
+	if len(providers) == 0 {
+		panic("gokogeri: no shards")
+	}
+	return &Shards{
+		providers: providers,
+		queues:    make(map[string]int),
+	}
+}
+
+// AssignQueue stores all the jobs of the queue on the shard with the given index, in the order in which the providers
+// were given to NewShards. It takes precedence over the shard keys of the jobs. It panics if the index is out of
+// range.
+func (s *Shards) AssignQueue(queue string, shard int) *Shards {
+	if shard < 0 || shard >= len(s.providers) {
+		panic(fmt.Sprintf("gokogeri: shard %d out of range [0, %d)", shard, len(s.providers)))
+	}
+	s.queues[queue] = shard
+	return s
+}
+
+// Providers returns the providers of all the shards.
+func (s *Shards) Providers() []ConnProvider {
+	return s.providers
+}
+
+// ForQueue returns the provider of the shard holding the queue, for jobs without a shard key.
+func (s *Shards) ForQueue(queue string) ConnProvider {
+	if i, ok := s.queues[queue]; ok {
+		return s.providers[i]
+	}
+	return s.providers[s.index(queue)]
+}
+
+// Route implements Router.
+func (s *Shards) Route(j *Job) ConnProvider {
+	if i, ok := s.queues[j.Queue()]; ok {
+		return s.providers[i]
+	}
+	key := j.ShardKey()
+	if key == "" {
+		key = j.Queue()
+	}
+	return s.providers[s.index(key)]
+}
+
+func (s *Shards) index(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.providers)))
+}
+
+// syncQueueSet makes a QueueSet safe for concurrent use by several dequeuers.
+type syncQueueSet struct {
+	mu   sync.Mutex
+	qset QueueSet
+}
+
+// GetQueues implements QueueSet. It returns a copy, because sets may reuse the returned slice.
+func (s *syncQueueSet) GetQueues() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queues := s.qset.GetQueues()
+	return append(make([]string, 0, len(queues)), queues...)
+}
+
+// Names implements QueueSet.
+func (s *syncQueueSet) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.qset.Names()
+}
@@ -0,0 +1,41 @@
+package gokogeri
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+)
+
+type namedProvider string
+
+func (namedProvider) Conn(context.Context) (redis.Conn, error)         { return nil, nil }
+func (namedProvider) DialLongPoll(context.Context) (redis.Conn, error) { return nil, nil }
+func (namedProvider) Namespace() string                                { return "" }
+func (namedProvider) Cluster() bool                                    { return false }
+
+func TestShards(t *testing.T) {
+	assert := require.New(t)
+
+	shards := NewShards(namedProvider("a"), namedProvider("b"), namedProvider("c"))
+	shards.AssignQueue("critical", 2)
+
+	var j Job
+	j.SetQueue("critical").SetShardKey("customer-1")
+	assert.Equal(namedProvider("c"), shards.Route(&j))
+
+	// Jobs of the same queue without a key stay together.
+	j.SetQueue("default").SetShardKey("")
+	assert.Equal(shards.ForQueue("default"), shards.Route(&j))
+
+	// Jobs with a key are spread.
+	seen := make(map[ConnProvider]bool)
+	for _, key := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		j.SetShardKey(key)
+		seen[shards.Route(&j)] = true
+	}
+	assert.Len(seen, 3)
+
+	assert.Panics(func() { shards.AssignQueue("low", 3) })
+}
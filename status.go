@@ -0,0 +1,195 @@
+package gokogeri
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// DefaultStatusTTL is how long the status of a job that does not have a status TTL of its own is kept after a worker
+// reports progress or a result.
+const DefaultStatusTTL = time.Hour * 24
+
+// A JobState is the state of a job in its JobStatus.
+type JobState string
+
+const (
+	// StatusQueued means the job is waiting in its queue.
+	StatusQueued JobState = "queued"
+
+	// StatusScheduled means the job is waiting in the schedule set, for example after being over a limit.
+	StatusScheduled JobState = "scheduled"
+
+	// StatusRunning means a worker is processing the job.
+	StatusRunning JobState = "running"
+
+	// StatusSucceeded means the job has been processed without an error.
+	StatusSucceeded JobState = "succeeded"
+
+	// StatusFailed means the job has returned an error.
+	StatusFailed JobState = "failed"
+
+	// StatusSkipped means the job was not processed, because it had expired or had been cancelled.
+	StatusSkipped JobState = "skipped"
+)
+
+// ErrStatusNotFound is returned by Admin.JobStatus for a job without a status, or whose status has expired.
+var ErrStatusNotFound = errors.New("job status not found")
+
+// JobStatus is what is known about a job that records its status, or whose worker reported progress.
+type JobStatus struct {
+	JobID string
+
+	// State is empty if the job does not record its state, and only its progress was reported.
+	State JobState
+
+	Percent int
+	Message string
+
+	// Data is the JSON encoding of the data reported with the progress.
+	Data json.RawMessage
+
+	// Result is the JSON encoding of the result reported by the worker.
+	Result json.RawMessage
+
+	// Error is the error returned by a failed job.
+	Error string
+
+	UpdatedAt  time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// JobStatus returns the status of the job.
+func (a *Admin) JobStatus(ctx context.Context, jid string) (*JobStatus, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	fields, err := redis.StringMap(conn.Do("HGETALL", a.keys.status(jid)))
+	if err != nil {
+		return nil, fmt.Errorf("get job status: %v", err)
+	}
+	if len(fields) == 0 {
+		return nil, ErrStatusNotFound
+	}
+
+	s := &JobStatus{
+		JobID:      jid,
+		State:      JobState(fields["state"]),
+		Message:    fields["message"],
+		Error:      fields["error"],
+		UpdatedAt:  parseTimeField(fields["updated_at"]),
+		StartedAt:  parseTimeField(fields["started_at"]),
+		FinishedAt: parseTimeField(fields["finished_at"]),
+	}
+	s.Percent, _ = strconv.Atoi(fields["percent"])
+	if v, ok := fields["data"]; ok {
+		s.Data = json.RawMessage(v)
+	}
+	if v, ok := fields["result"]; ok {
+		s.Result = json.RawMessage(v)
+	}
+	return s, nil
+}
+
+// statusReporter lets a worker report the progress and result of the job it is processing.
+type statusReporter struct {
+	cp   ConnProvider
+	keys keyspace
+}
+
+// ReportProgress stores the progress of the job, where Admin.JobStatus can read it, for example for a front end that
+// polls it. The data is encoded as JSON, and can be nil. It can only be called by the worker processing the job.
+func (j *Job) ReportProgress(ctx context.Context, percent int, message string, data interface{}) error {
+	fields := []interface{}{"percent", percent, "message", message}
+	if data != nil {
+		enc, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("encode progress data: %v", err)
+		}
+		fields = append(fields, "data", enc)
+	}
+	return j.report(ctx, fields)
+}
+
+// SetResult stores the result of the job, encoded as JSON, where Admin.JobStatus can read it. It can only be called
+// by the worker processing the job.
+func (j *Job) SetResult(ctx context.Context, result interface{}) error {
+	enc, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("encode result: %v", err)
+	}
+	return j.report(ctx, []interface{}{"result", enc})
+}
+
+func (j *Job) report(ctx context.Context, fields []interface{}) error {
+	if j.reporter == nil {
+		return fmt.Errorf("the job is not being processed")
+	}
+	return writeStatus(ctx, j.reporter.cp, j.reporter.keys, j, fields)
+}
+
+// statusTTL returns how long the status of the job is kept after it was last updated.
+func (j *Job) statusTTL() time.Duration {
+	if j.enc.StatusTTL > 0 {
+		return time.Duration(j.enc.StatusTTL) * time.Second
+	}
+	return DefaultStatusTTL
+}
+
+// writeStatus updates the status of the job, and its TTL.
+func writeStatus(ctx context.Context, cp ConnProvider, keys keyspace, j *Job, fields []interface{}) error {
+	conn, err := cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	return sendStatus(conn, keys, j, fields)
+}
+
+// sendStatus is like writeStatus, with a connection.
+func sendStatus(conn redis.Conn, keys keyspace, j *Job, fields []interface{}) error {
+	key := keys.status(j.enc.JobID)
+	args := append([]interface{}{key, "updated_at", sidekiq.Time(time.Now())}, fields...)
+	err := conn.Send("HSET", args...)
+	if err != nil {
+		return fmt.Errorf("send: %v", err)
+	}
+	err = conn.Send("PEXPIRE", key, j.statusTTL().Milliseconds())
+	if err != nil {
+		return fmt.Errorf("send: %v", err)
+	}
+	_, err = redisutil.DoMany(conn, 2)
+	if err != nil {
+		return fmt.Errorf("update job status: %v", err)
+	}
+	return nil
+}
+
+// trackStatus records the state of a job that records its status, in the Redis instance it came from.
+func (m *workerManager) trackStatus(log zerolog.Logger, r workItem, job *Job, state JobState, fields ...interface{}) {
+	if job.enc.StatusTTL <= 0 || r.cp == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	err := writeStatus(ctx, r.cp, r.keys, job, append([]interface{}{"state", state}, fields...))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to update the job status")
+	}
+}
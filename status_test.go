@@ -0,0 +1,35 @@
+package gokogeri
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobStatusSettings(t *testing.T) {
+	assert := require.New(t)
+
+	var job Job
+	assert.Equal(DefaultStatusTTL, job.statusTTL())
+
+	job.SetTrackStatus(time.Hour + time.Millisecond)
+	assert.Equal(time.Hour, job.TrackStatus())
+	assert.Equal(time.Hour, job.statusTTL())
+
+	enc, err := job.encode()
+	assert.NoError(err)
+	var encoding map[string]interface{}
+	assert.NoError(json.Unmarshal(enc, &encoding))
+	assert.Equal(float64(3600), encoding["status_ttl"])
+
+	job.SetTrackStatus(-time.Second)
+	assert.Zero(job.TrackStatus())
+
+	err = job.ReportProgress(context.Background(), 10, "", nil)
+	assert.EqualError(err, "the job is not being processed")
+	err = job.SetResult(context.Background(), "done")
+	assert.EqualError(err, "the job is not being processed")
+}
@@ -0,0 +1,96 @@
+package gokogeri
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// A UniquePolicy tells when the lock of a unique job is released. The lock is also released when its lifetime
+// expires, whatever the policy.
+type UniquePolicy string
+
+const (
+	// UniqueWhileScheduled releases the lock when a scheduled job is pushed to its queue, so it only applies while the
+	// job waits in the schedule set. A job enqueued right away is not locked.
+	UniqueWhileScheduled UniquePolicy = "scheduled"
+
+	// UniqueUntilEnqueued releases the lock when a worker takes the job from its queue, so it applies while the job is
+	// scheduled or waits in its queue.
+	UniqueUntilEnqueued UniquePolicy = "enqueued"
+
+	// UniqueUntilExecuting releases the lock when a worker starts processing the job. An equal job can be enqueued
+	// while it runs.
+	UniqueUntilExecuting UniquePolicy = "start"
+
+	// UniqueUntilExecuted releases the lock when a worker has processed the job successfully, like the policy of
+	// Sidekiq with the same value. A job that fails keeps the lock while it is retried.
+	UniqueUntilExecuted UniquePolicy = "success"
+)
+
+// valid reports whether the policy is one of the known ones.
+func (p UniquePolicy) valid() bool {
+	switch p {
+	case UniqueWhileScheduled, UniqueUntilEnqueued, UniqueUntilExecuting, UniqueUntilExecuted:
+		return true
+	}
+	return false
+}
+
+// ErrDuplicateJob is returned by an Enqueuer for a unique job when an equal job holds the lock.
+var ErrDuplicateJob = errors.New("duplicate unique job")
+
+// UniqueKeyFunc returns the key that identifies equal unique jobs.
+type UniqueKeyFunc func(j *Job) string
+
+// DefaultUniqueKey returns a digest of the class, the queue and the arguments of the job.
+func DefaultUniqueKey(j *Job) string {
+	args, _ := json.Marshal(j.enc.Args)
+
+	h := sha256.New()
+	h.Write([]byte(j.enc.Class))
+	h.Write([]byte{0})
+	h.Write([]byte(j.enc.Queue))
+	h.Write([]byte{0})
+	h.Write(args)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lockUnique takes the lock of a unique job, which must have its defaults set. It returns ErrDuplicateJob if the lock
+// is held by another job.
+func lockUnique(conn redis.Conn, keys keyspace, j *Job) error {
+	_, err := redis.String(conn.Do("SET", keys.unique(j.enc.UniqueKey), j.enc.JobID, "NX", "EX", j.enc.UniqueFor))
+	if err == redis.ErrNil {
+		return ErrDuplicateJob
+	}
+	if err != nil {
+		return fmt.Errorf("lock unique job: %v", err)
+	}
+	return nil
+}
+
+// unlockUnique releases the lock of a unique job, if the job still holds it.
+func unlockUnique(conn redis.Conn, keys keyspace, j *Job) error {
+	_, err := releaseScript.Do(conn, keys.unique(j.enc.UniqueKey), j.enc.JobID)
+	if err != nil {
+		return fmt.Errorf("unlock unique job: %v", err)
+	}
+	return nil
+}
+
+// unlockUniqueWith releases the lock of a unique job with a connection of the provider, after the job reached the
+// point of its policy. A failure is only logged by the caller, because the lock expires anyway.
+func unlockUniqueWith(ctx context.Context, cp ConnProvider, keys keyspace, j *Job) error {
+	conn, err := cp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	return unlockUnique(conn, keys, j)
+}
@@ -0,0 +1,34 @@
+package gokogeri
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultUniqueKey(t *testing.T) {
+	assert := require.New(t)
+
+	var a, b Job
+	a.SetClass("RebuildCache").SetQueue("default").SetArgs([]interface{}{"users", 1})
+	b.SetClass("RebuildCache").SetQueue("default").SetArgs([]interface{}{"users", 1})
+	assert.Equal(DefaultUniqueKey(&a), DefaultUniqueKey(&b))
+	assert.Len(DefaultUniqueKey(&a), 64)
+
+	b.SetArgs([]interface{}{"users", 2})
+	assert.NotEqual(DefaultUniqueKey(&a), DefaultUniqueKey(&b))
+
+	b.SetArgs([]interface{}{"users", 1}).SetQueue("low")
+	assert.NotEqual(DefaultUniqueKey(&a), DefaultUniqueKey(&b))
+}
+
+func TestUnknownUniquePolicy(t *testing.T) {
+	assert := require.New(t)
+
+	var j Job
+	j.SetClass("RebuildCache").SetUnique("success!", time.Minute)
+	err := NewEnqueuer(plainProvider{}).Enqueue(context.Background(), &j)
+	assert.EqualError(err, `unknown unique policy "success!"`)
+}
@@ -1,9 +1,16 @@
 package gokogeri
 
 type workItem struct {
-	// Q is the name of the queue.
+	// Q is the name of the queue, without the key prefix.
 	Q string
 
 	// P is the payload from the queue.
 	P []byte
+
+	// cp and keys are those of the Redis instance that the job came from.
+	cp   ConnProvider
+	keys keyspace
+
+	// cancelled is set if the job was cancelled with Admin.Cancel before it was dequeued.
+	cancelled bool
 }
@@ -2,34 +2,175 @@ package gokogeri
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/sidekiq"
 )
 
-// workerManager controls a group of workers processing a set of queues.
+// workerManager controls a group of workers processing a set of queues. It has one dequeuer for every Redis instance
+// holding the queues, unless it shares the dequeuers of a fetchGroup.
 type workerManager struct {
 	log zerolog.Logger
 
-	dq        *dequeuer
-	worker    Worker
-	instances int
+	dqfs   []*dequeuerFactory
+	dqs    []*dequeuer
+	qset   QueueSet
+	worker Worker
+	stats  *processStats
+	pauses *pauses
+	limits *limits
+	// runningJobs holds the running jobs of the Node, to cancel them.
+	runningJobs *runningJobs
+	// keepExpired moves expired jobs to the dead set.
+	keepExpired bool
+
+	// busy is the number of workers processing a job.
+	busy int64
+
+	// mu guards the fields below.
+	mu                sync.Mutex
+	autoscaler        AutoscaleFunc
+	autoscaleInterval time.Duration
+	instances         int
+	ctx               context.Context
+	running           bool
+	draining          bool
+	// lastWorker numbers the workers.
+	lastWorker int
+	// retiring is the number of workers that should exit instead of taking another job.
+	retiring int
+	// retireSignal is closed and replaced when workers should retire.
+	retireSignal chan struct{}
+
+	workers  sync.WaitGroup
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// cancel aborts the workers. It is set when the Node starts the manager, and finished is closed when it has
+	// stopped.
+	cancel   context.CancelFunc
+	finished chan struct{}
+
+	// reserved counts the reservations of a shared fetch group that include the manager.
+	reserved sync.WaitGroup
+
+	// batch is the maximum number of jobs fetched at once.
+	batch int
+
+	// cap tracks the idle workers and the prefetched jobs. A dequeuer only fetches a job after acquiring a slot.
+	cap *capacity
+
+	// c receives the work from the dequeuers. It has room for all the slots, so delivering never blocks.
+	c chan workItem
+
+	// fetchers counts the dequeuers, own or shared, that can still send on c. It is closed when they have all stopped.
+	fetchers sync.WaitGroup
 }
 
 func newWorkerManager(
 	log zerolog.Logger,
-	dqf *dequeuerFactory,
+	dqfs []*dequeuerFactory,
+	stats *processStats,
 	qset QueueSet,
 	worker Worker,
 	instances int,
 ) *workerManager {
-	return &workerManager{
-		dq:        dqf.newDequeuer(qset),
-		worker:    worker,
-		instances: instances,
-		log:       log.With().Str("component", "manager").Strs("queue_set", qset.Names()).Logger(),
+	m := &workerManager{
+		dqfs:         dqfs,
+		qset:         qset,
+		worker:       worker,
+		instances:    instances,
+		stats:        stats,
+		retireSignal: make(chan struct{}),
+		quit:         make(chan struct{}),
+		finished:     make(chan struct{}),
+		log:          log.With().Str("component", "manager").Strs("queue_set", qset.Names()).Logger(),
+	}
+
+	if len(dqfs) > 1 {
+		m.qset = &syncQueueSet{qset: qset}
+	}
+	return m
+}
+
+// setPrefetch sets the number of jobs that can be fetched in advance, while all the workers are busy. It must be called
+// before Run.
+func (m *workerManager) setPrefetch(prefetch int) {
+	if prefetch < 0 {
+		prefetch = 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cap = newCapacity(m.instances + prefetch)
+	m.c = make(chan workItem, m.instances+prefetch)
+}
+
+// createDequeuers creates the own dequeuers of the manager. It must be called before Run, unless the manager is part of
+// a fetchGroup.
+func (m *workerManager) createDequeuers() {
+	for _, f := range m.dqfs {
+		m.dqs = append(m.dqs, f.newDequeuer(m))
+	}
+	m.fetchers.Add(len(m.dqs))
+}
+
+// reserve implements demand. It waits for an idle worker, or room for a prefetched job, and then reserves as many of
+// the other free slots as allowed by the batch size. With several dequeuers, one for each shard, a dequeuer may hold
+// the last free slot while others wait for it, so the reservation is partial. While all the queues are paused, it waits
+// for one of them to be resumed.
+func (m *workerManager) reserve(ctx context.Context) *reservation {
+	var queues []string
+	for {
+		if !m.cap.acquire(ctx) {
+			return nil
+		}
+
+		var resumed <-chan struct{}
+		queues, resumed = m.pauses.filter(m.qset.GetQueues())
+		if len(queues) > 0 {
+			break
+		}
+
+		m.cap.release()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-resumed:
+		}
+	}
+
+	count := 1
+	for count < m.batch && m.cap.tryAcquire() {
+		count++
 	}
+
+	used := 0
+	return &reservation{
+		queues:  queues,
+		count:   count,
+		partial: len(m.dqfs) > 1,
+		deliver: func(w workItem) {
+			used++
+			m.c <- w
+		},
+		release: func() {
+			for i := used; i < count; i++ {
+				m.cap.release()
+			}
+		},
+	}
+}
+
+// names implements demand.
+func (m *workerManager) names() []string {
+	return m.qset.Names()
 }
 
 // Run starts the worker instances and blocks. Call Stop to initiate shutdown, which will ultimately unblock Run.
@@ -37,26 +178,49 @@ func newWorkerManager(
 func (m *workerManager) Run(ctx context.Context) {
 	m.log.Debug().Msg("Starting")
 
-	var wg sync.WaitGroup
+	for _, dq := range m.dqs {
+		dq := dq
+		go func() {
+			defer m.fetchers.Done()
+			dq.Run()
+		}()
+	}
+
+	m.mu.Lock()
+	m.ctx = ctx
+	m.running = true
+	m.startWorkers(m.instances)
+	if m.autoscaler != nil {
+		go m.autoscale(m.autoscaler, m.autoscaleInterval)
+	}
+	m.mu.Unlock()
 
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
-		m.dq.Run()
+		m.fetchers.Wait()
+
+		// No more workers can be started once the channel is closed.
+		m.mu.Lock()
+		m.draining = true
+		m.mu.Unlock()
+
+		close(m.c)
 	}()
 
-	wg.Add(m.instances)
+	m.workers.Wait()
+	m.log.Debug().Msg("Stopped")
+}
 
-	for i := 0; i < m.instances; i++ {
-		n := i + 1
+// startWorkers starts more worker instances. The caller holds mu.
+func (m *workerManager) startWorkers(count int) {
+	m.workers.Add(count)
+	for i := 0; i < count; i++ {
+		m.lastWorker++
+		n := m.lastWorker
 		go func() {
-			defer wg.Done()
-			m.jobLoop(ctx, n)
+			defer m.workers.Done()
+			m.jobLoop(m.ctx, n)
 		}()
 	}
-
-	wg.Wait()
-	m.log.Debug().Msg("Stopped")
 }
 
 // Stop initiates worker shutdown.
@@ -68,7 +232,12 @@ func (m *workerManager) Run(ctx context.Context) {
 // Stop does not block.
 func (m *workerManager) Stop() {
 	m.log.Debug().Msg("Stopping")
-	m.dq.Stop()
+	m.quitOnce.Do(func() {
+		close(m.quit)
+	})
+	for _, dq := range m.dqs {
+		dq.Stop()
+	}
 }
 
 func (m *workerManager) jobLoop(ctx context.Context, n int) {
@@ -78,8 +247,27 @@ func (m *workerManager) jobLoop(ctx context.Context, n int) {
 	defer log.Debug().Msg("Stopped")
 
 	for {
+		m.mu.Lock()
+		retire := m.retiring > 0
+		if retire {
+			m.retiring--
+		}
+		signal := m.retireSignal
+		m.mu.Unlock()
+
+		if retire {
+			log.Debug().Msg("Retired")
+			return
+		}
+
 		log.Trace().Msg("Waiting for a job")
-		r, ok := <-m.dq.C
+		var r workItem
+		var ok bool
+		select {
+		case r, ok = <-m.c:
+		case <-signal:
+			continue
+		}
 		if !ok {
 			log.Debug().Msg("No more work")
 			return
@@ -88,21 +276,172 @@ func (m *workerManager) jobLoop(ctx context.Context, n int) {
 		job, err := newJobFromJSON(r.P)
 		if err != nil {
 			log.Warn().Msg("Invalid job")
+			m.done()
 			continue
 		}
 
-		log = log.With().Str("job_id", job.ID()).Logger()
-		log.Info().Msg("Processing")
+		jobLog := log.With().Str("job_id", job.ID()).Logger()
+
+		if job.enc.UniqueUntil == UniqueUntilEnqueued {
+			m.unlockUnique(jobLog, r, job)
+		}
+
+		if job.expired(time.Now()) {
+			m.expire(jobLog, r, job)
+			m.done()
+			continue
+		}
+
+		// The job is registered before checking whether it was cancelled, so that a cancellation published since the
+		// dequeuer checked it is not missed.
+		jobCtx, cancelJob := context.WithCancel(ctx)
+		running := m.runningJobs.add(job.ID(), cancelJob)
+		stopJob := func() {
+			m.runningJobs.remove(job.ID(), running)
+			cancelJob()
+		}
+
+		if r.cancelled || running.cancelled {
+			stopJob()
+			jobLog.Info().Msg("Job cancelled")
+			m.skip(jobLog, r, job)
+			m.done()
+			continue
+		}
+
+		release, ok := m.checkLimits(jobLog, r, job)
+		if !ok {
+			stopJob()
+			m.done()
+			continue
+		}
+
+		jobLog.Info().Msg("Processing")
+
+		if job.enc.UniqueUntil == UniqueUntilExecuting {
+			m.unlockUnique(jobLog, r, job)
+		}
+
+		m.trackStatus(jobLog, r, job, StatusRunning, "started_at", sidekiq.Time(time.Now()))
+		if r.cp != nil {
+			job.reporter = &statusReporter{cp: r.cp, keys: r.keys}
+		}
+
+		m.stats.start()
+		atomic.AddInt64(&m.busy, 1)
+		err = m.safelyWork(jobCtx, job)
+		atomic.AddInt64(&m.busy, -1)
+		stopJob()
+		release()
+		job.reporter = nil
+
+		var rescheduled *RescheduleError
+		if errors.As(err, &rescheduled) {
+			err = m.reschedule(r, rescheduled.Delay)
+			if err == nil {
+				m.trackStatus(jobLog, r, job, StatusScheduled)
+				m.stats.finish(false)
+				m.done()
+				jobLog.Info().Dur("delay", rescheduled.Delay).Msg("Job rescheduled")
+				continue
+			}
+			jobLog.Error().Err(err).Msg("Failed to reschedule the job")
+		}
+		m.stats.finish(err != nil)
 
-		err = m.safelyWork(ctx, job)
 		if err != nil {
-			log.Warn().Msg("Job has failed")
+			m.trackStatus(jobLog, r, job, StatusFailed, "finished_at", sidekiq.Time(time.Now()), "error", err.Error())
 		} else {
-			log.Info().Msg("Job done")
+			m.trackStatus(jobLog, r, job, StatusSucceeded, "finished_at", sidekiq.Time(time.Now()))
 		}
+
+		if job.enc.UniqueUntil == UniqueUntilExecuted && err == nil {
+			m.unlockUnique(jobLog, r, job)
+		}
+		if job.enc.BatchID != "" {
+			m.finishInBatch(jobLog, r, job, err != nil)
+		}
+		if job.enc.WorkflowID != "" {
+			m.finishStep(jobLog, r, job, err != nil)
+		}
+
+		m.done()
+		if err != nil {
+			jobLog.Warn().Msg("Job has failed")
+		} else {
+			jobLog.Info().Msg("Job done")
+		}
+	}
+}
+
+// unlockUnique releases the lock of a unique job in the Redis instance it came from. The lock expires if it fails.
+func (m *workerManager) unlockUnique(log zerolog.Logger, r workItem, job *Job) {
+	if job.enc.UniqueKey == "" || r.cp == nil {
+		return
+	}
+
+	// The lock must be released even if the Context of the job was cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	err := unlockUniqueWith(ctx, r.cp, r.keys, job)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to release the unique lock")
+	}
+}
+
+// finishInBatch records that a job of a batch has been processed, in the Redis instance it came from, and enqueues the
+// callbacks of the batch if it is done.
+func (m *workerManager) finishInBatch(log zerolog.Logger, r workItem, job *Job, failed bool) {
+	if r.cp == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := r.cp.Conn(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to update the batch")
+		return
+	}
+	defer conn.Close()
+
+	t := &batchTracker{log: log, keys: r.keys}
+	err = t.finish(conn, job.enc.BatchID, job.enc.JobID, failed)
+	if err != nil {
+		log.Warn().Err(err).Str("bid", job.enc.BatchID).Msg("Failed to update the batch")
 	}
 }
 
+// finishStep records that a step of a workflow has been processed, in the Redis instance it came from, and enqueues
+// the steps that were waiting for it.
+func (m *workerManager) finishStep(log zerolog.Logger, r workItem, job *Job, failed bool) {
+	if r.cp == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := r.cp.Conn(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to update the workflow")
+		return
+	}
+	defer conn.Close()
+
+	err = finishStep(conn, log, r.keys, job.enc.WorkflowID, job.enc.WorkflowStep, failed)
+	if err != nil {
+		log.Warn().Err(err).Str("wid", job.enc.WorkflowID).Msg("Failed to update the workflow")
+	}
+}
+
+// done is called by a worker when it is ready for the next job.
+func (m *workerManager) done() {
+	m.cap.release()
+}
+
 func (m *workerManager) safelyWork(ctx context.Context, job *Job) (err error) {
 	defer func() {
 		if val := recover(); val != nil {
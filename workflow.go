@@ -0,0 +1,410 @@
+package gokogeri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+
+	"github.com/kapvode/gokogeri/internal/redisutil"
+	"github.com/kapvode/gokogeri/internal/sidekiq"
+)
+
+// workflowTTL is how long a workflow is kept in Redis after it last changed.
+const workflowTTL = time.Hour * 24 * 30
+
+// The states of a workflow step.
+const (
+	StepWaiting   = "waiting"
+	StepEnqueued  = "enqueued"
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+	StepCancelled = "cancelled"
+)
+
+// A Workflow is a graph of jobs, called steps, where a step is only enqueued after the steps it depends on have
+// succeeded. When a step fails, the steps that depend on it, directly or not, are cancelled, unless it allows failure.
+// The graph is stored in Redis, and the steps are enqueued by the nodes that process their dependencies.
+//
+// A step is finished the first time its job is processed. Retrying a failed step, for example from the dead set, runs
+// its job again, but does not change the workflow or revive the steps that were cancelled.
+type Workflow struct {
+	steps []*WorkflowStep
+}
+
+// A WorkflowStep is a job of a Workflow.
+type WorkflowStep struct {
+	name         string
+	job          *Job
+	after        []string
+	allowFailure bool
+}
+
+// NewWorkflow returns a new empty workflow.
+func NewWorkflow() *Workflow {
+	return &Workflow{}
+}
+
+// Add adds a step with a name that is unique within the workflow. The job is enqueued after the steps named in after,
+// which can be added later, or right away if there are none.
+func (w *Workflow) Add(name string, j *Job, after ...string) *WorkflowStep {
+	s := &WorkflowStep{
+		name:  name,
+		job:   j,
+		after: after,
+	}
+	w.steps = append(w.steps, s)
+	return s
+}
+
+// Then adds a step that runs after the last step that was added, to build a chain of jobs.
+func (w *Workflow) Then(name string, j *Job) *WorkflowStep {
+	if len(w.steps) == 0 {
+		return w.Add(name, j)
+	}
+	return w.Add(name, j, w.steps[len(w.steps)-1].name)
+}
+
+// AllowFailure makes the steps that depend on this one run even if it fails.
+func (s *WorkflowStep) AllowFailure() *WorkflowStep {
+	s.allowFailure = true
+	return s
+}
+
+// validate checks that the names are unique, that the dependencies exist, and that there are no cycles. It returns
+// the dependents of every step.
+func (w *Workflow) validate() (map[string][]string, error) {
+	if len(w.steps) == 0 {
+		return nil, fmt.Errorf("workflow has no steps")
+	}
+
+	byName := make(map[string]*WorkflowStep, len(w.steps))
+	for _, s := range w.steps {
+		if s.name == "" || strings.Contains(s.name, "\n") {
+			return nil, fmt.Errorf("invalid workflow step name %q", s.name)
+		}
+		if s.job == nil {
+			return nil, fmt.Errorf("workflow step %s has no job", s.name)
+		}
+		if byName[s.name] != nil {
+			return nil, fmt.Errorf("duplicate workflow step %s", s.name)
+		}
+		byName[s.name] = s
+	}
+
+	next := make(map[string][]string, len(w.steps))
+	for _, s := range w.steps {
+		for _, dep := range s.after {
+			if byName[dep] == nil {
+				return nil, fmt.Errorf("workflow step %s depends on unknown step %s", s.name, dep)
+			}
+			if !containsString(next[dep], s.name) {
+				next[dep] = append(next[dep], s.name)
+			}
+		}
+	}
+
+	// Depth-first search for cycles.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int, len(w.steps))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			return fmt.Errorf("workflow has a cycle through step %s", name)
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, n := range next[name] {
+			err := visit(n)
+			if err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		return nil
+	}
+	for _, s := range w.steps {
+		err := visit(s.name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return next, nil
+}
+
+// EnqueueWorkflow stores the workflow in Redis and enqueues the steps that do not depend on others. It returns the ID
+// of the workflow, which is stored in its jobs as wid. It does not work with a sharded Enqueuer, and the jobs are not
+// checked for uniqueness.
+//
+// If it fails after sending the workflow, it tries to delete it, and returns its ID with the error. The steps that were
+// enqueued anyway still run, but do not enqueue the steps that depend on them.
+func (e *Enqueuer) EnqueueWorkflow(ctx context.Context, w *Workflow) (string, error) {
+	if e.router != nil {
+		return "", fmt.Errorf("workflows are not supported by a sharded enqueuer")
+	}
+
+	next, err := w.validate()
+	if err != nil {
+		return "", err
+	}
+
+	id, err := sidekiq.JobID()
+	if err != nil {
+		return "", fmt.Errorf("create workflow ID: %v", err)
+	}
+
+	fields := []interface{}{"created_at", sidekiq.Time(time.Now()), "remaining", len(w.steps)}
+	type root struct {
+		job     *Job
+		payload []byte
+	}
+	var roots []root
+	for _, s := range w.steps {
+		err = s.job.setDefaults()
+		if err != nil {
+			return "", fmt.Errorf("setting job defaults: %v", err)
+		}
+		s.job.enc.WorkflowID = id
+		s.job.enc.WorkflowStep = s.name
+
+		enc, err := s.job.encode()
+		if err != nil {
+			return "", fmt.Errorf("encode job: %v", err)
+		}
+
+		state := StepWaiting
+		if len(s.after) == 0 {
+			state = StepEnqueued
+			roots = append(roots, root{s.job, enc})
+		}
+
+		deps := 0
+		seen := make(map[string]bool)
+		for _, dep := range s.after {
+			if !seen[dep] {
+				seen[dep] = true
+				deps++
+			}
+		}
+
+		fields = append(fields,
+			"job:"+s.name, enc,
+			"state:"+s.name, state,
+			"wait:"+s.name, deps,
+			"next:"+s.name, encodeStepNames(next[s.name]),
+		)
+		if s.allowFailure {
+			fields = append(fields, "allow_failure:"+s.name, 1)
+		}
+	}
+
+	commands := [][]interface{}{
+		append([]interface{}{"HSET", e.keys.workflow(id)}, fields...),
+		{"PEXPIRE", e.keys.workflow(id), workflowTTL.Milliseconds()},
+	}
+	for _, r := range roots {
+		push, err := pushCommands(e.keys, r.job, r.payload)
+		if err != nil {
+			return "", err
+		}
+		commands = append(commands, push...)
+	}
+
+	conn, err := e.cp.Conn(ctx)
+	if err != nil {
+		return "", fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	// The workflow and its first steps are sent in a single round trip. If anything failed, the workflow is deleted, so
+	// that the steps that were enqueued do not enqueue others.
+	for _, c := range commands {
+		err = sendCommand(conn, c)
+		if err != nil {
+			return "", err
+		}
+	}
+	_, err = redisutil.DoMany(conn, len(commands))
+	if err != nil {
+		_, _ = conn.Do("DEL", e.keys.workflow(id))
+		return id, fmt.Errorf("create workflow: %v", err)
+	}
+	return id, nil
+}
+
+// encodeStepNames encodes a list of step names for the Lua script, which splits it on newlines.
+func encodeStepNames(names []string) string {
+	return strings.Join(names, "\n")
+}
+
+// finishStepScript records that the step ARGV[1] of the workflow at KEYS[1] has been processed, and has failed if
+// ARGV[2] is 1. The steps that were waiting only for it are marked as enqueued, or cancelled if it failed. It returns
+// the new state of the workflow if it has just finished, or an empty string, then an empty string, followed by the jobs
+// to enqueue. If the step had already finished, or the workflow is gone, it returns an empty string and the state of
+// the step instead, without changing anything.
+var finishStepScript = redis.NewScript(1, `
+local key = KEYS[1]
+local current = redis.call('HGET', key, 'state:' .. ARGV[1])
+if current ~= 'enqueued' then
+	return {'', current or 'unknown'}
+end
+
+local result = {'', ''}
+local failed = false
+
+local function finish(step, state)
+	redis.call('HSET', key, 'state:' .. step, state)
+	if state ~= 'succeeded' then
+		failed = true
+	end
+	redis.call('HINCRBY', key, 'remaining', -1)
+end
+
+local function dependents(step)
+	local names = {}
+	for name in string.gmatch(redis.call('HGET', key, 'next:' .. step) or '', '[^\n]+') do
+		table.insert(names, name)
+	end
+	return names
+end
+
+local function cancel(step)
+	if redis.call('HGET', key, 'state:' .. step) ~= 'waiting' then
+		return
+	end
+	finish(step, 'cancelled')
+	for _, name in ipairs(dependents(step)) do
+		cancel(name)
+	end
+end
+
+local state = 'succeeded'
+if ARGV[2] == '1' then
+	state = 'failed'
+end
+finish(ARGV[1], state)
+
+local proceed = state == 'succeeded' or redis.call('HGET', key, 'allow_failure:' .. ARGV[1]) == '1'
+for _, name in ipairs(dependents(ARGV[1])) do
+	if proceed then
+		if redis.call('HINCRBY', key, 'wait:' .. name, -1) == 0
+			and redis.call('HGET', key, 'state:' .. name) == 'waiting' then
+			redis.call('HSET', key, 'state:' .. name, 'enqueued')
+			table.insert(result, redis.call('HGET', key, 'job:' .. name))
+		end
+	else
+		cancel(name)
+	end
+end
+
+if failed then
+	redis.call('HSET', key, 'failed', 1)
+end
+if tonumber(redis.call('HGET', key, 'remaining')) == 0 then
+	local status = 'succeeded'
+	if redis.call('HGET', key, 'failed') == '1' then
+		status = 'failed'
+	end
+	redis.call('HSET', key, 'status', status, 'finished_at', ARGV[4])
+	result[1] = status
+end
+redis.call('PEXPIRE', key, ARGV[3])
+return result
+`)
+
+// finishStep records that a step of a workflow has been processed, and enqueues the steps that were waiting for it.
+func finishStep(conn redis.Conn, log zerolog.Logger, keys keyspace, wid, step string, failed bool) error {
+	failedArg := 0
+	if failed {
+		failedArg = 1
+	}
+
+	reply, err := redis.ByteSlices(finishStepScript.Do(conn, keys.workflow(wid), step, failedArg,
+		workflowTTL.Milliseconds(), sidekiq.Time(time.Now())))
+	if err != nil {
+		return fmt.Errorf("finish workflow step: %v", err)
+	}
+
+	if state := string(reply[1]); state != "" {
+		// The job was processed again, for example after an operator retried it from the dead set.
+		log.Warn().Str("wid", wid).Str("step", step).Str("state", state).
+			Msg("The workflow step had already finished, so the workflow is unchanged")
+		return nil
+	}
+
+	now := time.Now()
+	for _, payload := range reply[2:] {
+		j, err := newJobFromJSON(payload)
+		if err != nil {
+			return fmt.Errorf("workflow step: %v", err)
+		}
+		err = pushPayload(conn, keys, j, setEnqueuedAt(payload, now))
+		if err != nil {
+			return err
+		}
+	}
+
+	if status := string(reply[0]); status != "" {
+		log.Info().Str("wid", wid).Str("status", status).Msg("Workflow finished")
+	}
+	return nil
+}
+
+// ErrWorkflowNotFound is returned by Admin.WorkflowStatus for a workflow that does not exist, or has expired.
+var ErrWorkflowNotFound = errors.New("workflow not found")
+
+// WorkflowStatus describes the progress of a workflow.
+type WorkflowStatus struct {
+	ID        string
+	CreatedAt time.Time
+
+	// Steps holds the state of every step: StepWaiting, StepEnqueued, StepSucceeded, StepFailed or StepCancelled.
+	Steps map[string]string
+
+	// Status is empty while the workflow is running. Once every step has been processed or cancelled, it is
+	// StepSucceeded if they all succeeded, and StepFailed otherwise.
+	Status     string
+	FinishedAt time.Time
+}
+
+// WorkflowStatus returns the progress of the workflow.
+func (a *Admin) WorkflowStatus(ctx context.Context, wid string) (*WorkflowStatus, error) {
+	conn, err := a.cp.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get conn: %v", err)
+	}
+	defer conn.Close()
+
+	fields, err := redis.StringMap(conn.Do("HGETALL", a.keys.workflow(wid)))
+	if err != nil {
+		return nil, fmt.Errorf("get workflow: %v", err)
+	}
+	if len(fields) == 0 {
+		return nil, ErrWorkflowNotFound
+	}
+
+	s := &WorkflowStatus{
+		ID:         wid,
+		CreatedAt:  parseTimeField(fields["created_at"]),
+		Steps:      make(map[string]string),
+		Status:     fields["status"],
+		FinishedAt: parseTimeField(fields["finished_at"]),
+	}
+	for k, v := range fields {
+		const prefix = "state:"
+		if strings.HasPrefix(k, prefix) {
+			s.Steps[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return s, nil
+}
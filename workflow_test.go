@@ -0,0 +1,47 @@
+package gokogeri
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkflowValidate(t *testing.T) {
+	assert := require.New(t)
+
+	w := NewWorkflow()
+	w.Add("extract", &Job{})
+	w.Then("transform", &Job{})
+	w.Add("report", &Job{}, "extract")
+	w.Add("load", &Job{}, "transform", "report", "transform")
+	next, err := w.validate()
+	assert.NoError(err)
+	assert.Equal(map[string][]string{
+		"extract":   {"transform", "report"},
+		"transform": {"load"},
+		"report":    {"load"},
+	}, next)
+
+	_, err = NewWorkflow().validate()
+	assert.EqualError(err, "workflow has no steps")
+
+	w = NewWorkflow()
+	w.Add("a", &Job{})
+	w.Add("a", &Job{})
+	_, err = w.validate()
+	assert.EqualError(err, "duplicate workflow step a")
+
+	w = NewWorkflow()
+	w.Add("a", &Job{}, "b")
+	_, err = w.validate()
+	assert.EqualError(err, "workflow step a depends on unknown step b")
+
+	w = NewWorkflow()
+	w.Add("a", &Job{})
+	w.Add("b", &Job{}, "a", "d")
+	w.Then("c", &Job{})
+	w.Then("d", &Job{})
+	_, err = w.validate()
+	assert.Error(err)
+	assert.Contains(err.Error(), "cycle")
+}